@@ -5,20 +5,32 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/patrickjmcd/go-version"
 	"github.com/spf13/cobra"
 )
 
 var (
-	thingName string
+	thingName     string
+	serviceFlags  []string
+	listenHost    string
+	tunnelTimeout time.Duration
+	keepOpen      bool
 )
 
 func init() {
 	openTunnelCmd.Flags().StringVarP(&thingName, "thing-name", "n", "", "thing name")
+	openTunnelCmd.Flags().StringArrayVarP(&serviceFlags, "service", "s", []string{"SSH=2222"}, "A service of the tunnel and the local port it is listened on as <service>=<port>")
+	openTunnelCmd.Flags().StringVar(&listenHost, "listen-host", "localhost", "The host the local ports are listened on")
+	openTunnelCmd.Flags().DurationVar(&tunnelTimeout, "timeout", 0, "The lifetime of the tunnel, at most 12h which is also the default")
+	openTunnelCmd.Flags().BoolVar(&keepOpen, "keep-open", false, "Keep the tunnel open on exit instead of closing it")
 
 	rootCmd.AddCommand(createCertsAndKeysCmd)
 	rootCmd.AddCommand(openTunnelCmd)
+	rootCmd.AddCommand(tunnelsCmd)
 
 }
 
@@ -44,14 +56,34 @@ var createCertsAndKeysCmd = &cobra.Command{
 var openTunnelCmd = &cobra.Command{
 	Use:   "open-tunnel",
 	Short: "Open a tunnel to the AWS IoT Core",
-	Long:  `Open a tunnel to the AWS IoT Core`,
-	Args:  cobra.NoArgs,
+	Long: `Open a secure tunnel to a thing and forward the local ports of its services through it until the tunnel
+ends, the timeout expires or the command is interrupted. The tunnel is closed on exit unless --keep-open is set.`,
+	Args: cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(thingName) == 0 {
 			log.Fatal("--thing-name is required")
 		}
 
-		err := createTunnel(thingName)
+		sourcePorts, err := parseSourcePorts(serviceFlags)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		client, err := newTunnelClient(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = createTunnel(ctx, client, tunnelOptions{
+			ThingName:   thingName,
+			SourcePorts: sourcePorts,
+			ListenHost:  listenHost,
+			Timeout:     tunnelTimeout,
+			KeepOpen:    keepOpen,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -2,56 +2,135 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling"
 	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling/types"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
 )
 
-func createTunnel(thingName string) error {
-	ctx := context.Background()
+// maxTunnelLifetime is the longest lifetime AWS IoT secure tunneling allows
+const maxTunnelLifetime = 12 * time.Hour
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+// startLocalProxy runs the source side of a tunnel, replaced in tests
+var startLocalProxy = tunnel.StartLocalProxy
+
+// tunnelOptions configures the tunnel opened by the open-tunnel command
+type tunnelOptions struct {
+	ThingName string
+	// SourcePorts maps the services of the tunnel to the local ports they are listened on
+	SourcePorts map[string]int
+	ListenHost  string
+	// Timeout is the lifetime of the tunnel, the AWS default of 12 hours if zero
+	Timeout  time.Duration
+	KeepOpen bool
+}
+
+// parseSourcePorts parses service ports given as <service>=<port>, e.g. SSH=2222
+func parseSourcePorts(specs []string) (map[string]int, error) {
+	ports := map[string]int{}
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("service %q is not in the <service>=<port> format", spec)
+		}
+		port, err := strconv.Atoi(spec[i+1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port of service %s: %q", spec[:i], spec[i+1:])
+		}
+		ports[spec[:i]] = port
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("at least one service is required")
+	}
+	return ports, nil
+}
+
+// timeoutConfig returns the tunnel lifetime in whole minutes, as the API expects
+func timeoutConfig(timeout time.Duration) (*types.TimeoutConfig, error) {
+	if timeout == 0 {
+		return nil, nil
+	}
+	if timeout < 0 || timeout > maxTunnelLifetime {
+		return nil, fmt.Errorf("timeout must be positive and at most %s", maxTunnelLifetime)
+	}
+	minutes := int32((timeout + time.Minute - 1) / time.Minute)
+	return &types.TimeoutConfig{MaxLifetimeTimeoutMinutes: minutes}, nil
+}
+
+// createTunnel opens a tunnel to the thing and runs the source side of it in-process until the tunnel ends, the
+// timeout expires or the context is done. Unless KeepOpen is set, the tunnel is closed on return.
+func createTunnel(ctx context.Context, client tunnelClient, opts tunnelOptions) error {
+	timeout, err := timeoutConfig(opts.Timeout)
 	if err != nil {
 		return err
 	}
 
-	client := iotsecuretunneling.NewFromConfig(cfg)
+	services := make([]string, 0, len(opts.SourcePorts))
+	for service := range opts.SourcePorts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
 
 	// create a new tunnel
 	openOutput, err := client.OpenTunnel(ctx, &iotsecuretunneling.OpenTunnelInput{
 		Description: aws.String("aws iot secure tunnel"),
 		DestinationConfig: &types.DestinationConfig{
-			Services:  []string{"SSH"},
-			ThingName: &thingName,
+			Services:  services,
+			ThingName: aws.String(opts.ThingName),
 		},
+		TimeoutConfig: timeout,
 	})
 	if err != nil {
 		return err
 	}
+	tunnelID := aws.ToString(openOutput.TunnelId)
+	log.Printf("Opened tunnel %s to %s\n", tunnelID, opts.ThingName)
 
-	return localproxyTunnel(cfg.Region, *openOutput.SourceAccessToken)
-}
+	if !opts.KeepOpen {
+		defer func() {
+			closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := client.CloseTunnel(closeCtx, &iotsecuretunneling.CloseTunnelInput{TunnelId: aws.String(tunnelID)}); err != nil {
+				log.Printf("failed to close tunnel %s: %v\n", tunnelID, err)
+				return
+			}
+			log.Printf("Closed tunnel %s\n", tunnelID)
+		}()
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
-func localproxyTunnel(region, sourceToken string) error {
+	for _, service := range services {
+		log.Printf("Forwarding %s on %s\n", service, netAddress(opts.ListenHost, opts.SourcePorts[service]))
+	}
 
-	_, err := exec.LookPath("localproxy")
-	if err != nil {
-		return fmt.Errorf("localproxy not found in path")
-	}
-
-	log.Println("localproxy",
-		"-access-token", sourceToken,
-		"-region", region,
-		"-source-listen-port", "2222")
-	cmnd := exec.Command("localproxy",
-		"-access-token", sourceToken,
-		"-region", region,
-		"-source-listen-port", "2222")
-	err = cmnd.Run()
+	err = startLocalProxy(ctx, tunnel.ProxyParams{
+		AccessToken: aws.ToString(openOutput.SourceAccessToken),
+		Region:      client.Region(),
+		SourcePorts: opts.SourcePorts,
+		SourceHost:  opts.ListenHost,
+	})
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
 	return err
 }
+
+func netAddress(host string, port int) string {
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSourcePorts(t *testing.T) {
+	ports, err := parseSourcePorts([]string{"SSH=2222", "HTTP=8080"})
+	assert.NoError(t, err, "service ports parsed without error")
+	assert.Equal(t, map[string]int{"SSH": 2222, "HTTP": 8080}, ports)
+
+	for _, spec := range []string{"SSH", "=22", "SSH=0", "SSH=70000", "SSH=ssh"} {
+		_, err := parseSourcePorts([]string{spec})
+		assert.Error(t, err, spec)
+	}
+	_, err = parseSourcePorts(nil)
+	assert.Error(t, err, "at least one service is required")
+}
+
+func TestTimeoutConfig(t *testing.T) {
+	config, err := timeoutConfig(0)
+	assert.NoError(t, err)
+	assert.Nil(t, config, "AWS default lifetime without timeout")
+
+	config, err = timeoutConfig(90 * time.Second)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, config.MaxLifetimeTimeoutMinutes, "lifetime rounded up to whole minutes")
+
+	_, err = timeoutConfig(13 * time.Hour)
+	assert.Error(t, err, "lifetime longer than 12 hours rejected")
+}
+
+func TestCreateTunnel_CloseTunnel(t *testing.T) {
+	defer func(original func(context.Context, tunnel.ProxyParams) error) { startLocalProxy = original }(startLocalProxy)
+
+	for _, tc := range []struct {
+		name     string
+		keepOpen bool
+		proxy    func(ctx context.Context, cancel context.CancelFunc) error
+		closed   []string
+		fails    bool
+	}{
+		{"proxy returns", false, func(ctx context.Context, cancel context.CancelFunc) error { return nil }, []string{"new"}, false},
+		{"proxy fails", false, func(ctx context.Context, cancel context.CancelFunc) error { return errors.New("connection lost") }, []string{"new"}, true},
+		{"context cancelled", false, func(ctx context.Context, cancel context.CancelFunc) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}, []string{"new"}, false},
+		{"keep open after proxy returns", true, func(ctx context.Context, cancel context.CancelFunc) error { return nil }, nil, false},
+		{"keep open after context cancelled", true, func(ctx context.Context, cancel context.CancelFunc) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}, nil, false},
+	} {
+		client := newFakeTunnelClient()
+		ctx, cancel := context.WithCancel(context.Background())
+		var params tunnel.ProxyParams
+		startLocalProxy = func(ctx context.Context, p tunnel.ProxyParams) error {
+			params = p
+			return tc.proxy(ctx, cancel)
+		}
+
+		err := createTunnel(ctx, client, tunnelOptions{
+			ThingName:   "gateway-1",
+			SourcePorts: map[string]int{"SSH": 2222},
+			KeepOpen:    tc.keepOpen,
+		})
+		cancel()
+		assert.Equal(t, tc.fails, err != nil, "%s: %v", tc.name, err)
+		assert.Equal(t, "eu-west-1", params.Region, tc.name)
+		assert.Equal(t, map[string]int{"SSH": 2222}, params.SourcePorts, tc.name)
+		assert.Equal(t, tc.closed, client.closed, tc.name)
+	}
+}
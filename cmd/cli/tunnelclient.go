@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling"
+)
+
+// tunnelClient is the part of the secure tunneling API the tunnel commands use, so they can be tested without AWS
+type tunnelClient interface {
+	OpenTunnel(ctx context.Context, params *iotsecuretunneling.OpenTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.OpenTunnelOutput, error)
+	ListTunnels(ctx context.Context, params *iotsecuretunneling.ListTunnelsInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.ListTunnelsOutput, error)
+	DescribeTunnel(ctx context.Context, params *iotsecuretunneling.DescribeTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.DescribeTunnelOutput, error)
+	CloseTunnel(ctx context.Context, params *iotsecuretunneling.CloseTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.CloseTunnelOutput, error)
+	RotateTunnelAccessToken(ctx context.Context, params *rotateTunnelAccessTokenInput) (*rotateTunnelAccessTokenOutput, error)
+	Region() string
+}
+
+// rotateTunnelAccessTokenInput is the request of the RotateTunnelAccessToken operation
+type rotateTunnelAccessTokenInput struct {
+	TunnelID          string                   `json:"tunnelId"`
+	ClientMode        string                   `json:"clientMode"`
+	DestinationConfig *rotateDestinationConfig `json:"destinationConfig,omitempty"`
+}
+
+type rotateDestinationConfig struct {
+	ThingName string   `json:"thingName,omitempty"`
+	Services  []string `json:"services"`
+}
+
+// rotateTunnelAccessTokenOutput is the response of the RotateTunnelAccessToken operation
+type rotateTunnelAccessTokenOutput struct {
+	TunnelArn              string `json:"tunnelArn"`
+	SourceAccessToken      string `json:"sourceAccessToken,omitempty"`
+	DestinationAccessToken string `json:"destinationAccessToken,omitempty"`
+}
+
+// awsTunnelClient is the tunnelClient of the AWS account of the default configuration
+type awsTunnelClient struct {
+	*iotsecuretunneling.Client
+	options iotsecuretunneling.Options
+}
+
+func newTunnelClient(ctx context.Context) (tunnelClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newAWSTunnelClient(cfg), nil
+}
+
+func newAWSTunnelClient(cfg aws.Config) *awsTunnelClient {
+	c := &awsTunnelClient{}
+	c.Client = iotsecuretunneling.NewFromConfig(cfg, func(o *iotsecuretunneling.Options) {
+		c.options = *o
+	})
+	return c
+}
+
+func (c *awsTunnelClient) Region() string {
+	return c.options.Region
+}
+
+// RotateTunnelAccessToken calls the operation with a signed request, as the iotsecuretunneling client of the SDK
+// version in go.mod predates it. The endpoint, credentials, signer and HTTP client are the ones of the generated
+// operations, so it honours the same endpoint configuration. Replace it with the generated operation once the SDK is
+// updated.
+func (c *awsTunnelClient) RotateTunnelAccessToken(ctx context.Context, params *rotateTunnelAccessTokenInput) (*rotateTunnelAccessTokenOutput, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rotate request: %w", err)
+	}
+
+	endpoint, err := c.options.EndpointResolver.ResolveEndpoint(c.options.Region, c.options.EndpointOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the secure tunneling endpoint: %w", err)
+	}
+	signingRegion := endpoint.SigningRegion
+	if signingRegion == "" {
+		signingRegion = c.options.Region
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rotate request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "IoTSecuredTunneling.RotateTunnelAccessToken")
+
+	creds, err := c.options.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	if err := c.options.HTTPSignerV4.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "iotsecuredtunneling", signingRegion, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign rotate request: %w", err)
+	}
+
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate tunnel access token: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rotate response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(respBody, &apiErr)
+		return nil, fmt.Errorf("failed to rotate tunnel access token: %s (%d): %s", apiErr.Type, resp.StatusCode, apiErr.Message)
+	}
+
+	out := &rotateTunnelAccessTokenOutput{}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rotate response: %w", err)
+	}
+	return out, nil
+}
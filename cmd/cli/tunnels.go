@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling"
+	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outputFormat     string
+	tunnelsThingName string
+	tunnelsStatus    string
+	rotateClientMode string
+	rotateServices   []string
+	deleteTunnel     bool
+)
+
+func init() {
+	tunnelsCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "table", "The output format: table or json")
+	listTunnelsCmd.Flags().StringVarP(&tunnelsThingName, "thing-name", "n", "", "Only list the tunnels of this thing")
+	listTunnelsCmd.Flags().StringVar(&tunnelsStatus, "status", "", "Only list tunnels with this status: OPEN or CLOSED")
+	rotateTunnelCmd.Flags().StringVar(&rotateClientMode, "client-mode", "all", "The access tokens to rotate: source, destination or all")
+	rotateTunnelCmd.Flags().StringVarP(&tunnelsThingName, "thing-name", "n", "", "The thing the new destination token is sent to, defaults to the destination of the tunnel")
+	rotateTunnelCmd.Flags().StringArrayVarP(&rotateServices, "service", "s", nil, "The services of the new destination token, defaults to the services of the tunnel")
+	closeTunnelCmd.Flags().BoolVar(&deleteTunnel, "delete", false, "Delete the tunnel instead of only closing it")
+
+	tunnelsCmd.AddCommand(listTunnelsCmd)
+	tunnelsCmd.AddCommand(describeTunnelCmd)
+	tunnelsCmd.AddCommand(rotateTunnelCmd)
+	tunnelsCmd.AddCommand(closeTunnelCmd)
+}
+
+// tunnelSummaryView is the output of a tunnel in the list
+type tunnelSummaryView struct {
+	ID            string     `json:"tunnelId"`
+	ARN           string     `json:"tunnelArn"`
+	Status        string     `json:"status"`
+	Description   string     `json:"description,omitempty"`
+	CreatedAt     *time.Time `json:"createdAt,omitempty"`
+	LastUpdatedAt *time.Time `json:"lastUpdatedAt,omitempty"`
+}
+
+// tunnelView is the output of a described tunnel
+type tunnelView struct {
+	tunnelSummaryView
+	ThingName             string   `json:"thingName,omitempty"`
+	Services              []string `json:"services,omitempty"`
+	SourceConnection      string   `json:"sourceConnectionState,omitempty"`
+	DestinationConnection string   `json:"destinationConnectionState,omitempty"`
+	LifetimeMinutes       int32    `json:"maxLifetimeTimeoutMinutes,omitempty"`
+}
+
+func newTunnelView(t *types.Tunnel) tunnelView {
+	view := tunnelView{
+		tunnelSummaryView: tunnelSummaryView{
+			ID:            aws.ToString(t.TunnelId),
+			ARN:           aws.ToString(t.TunnelArn),
+			Status:        string(t.Status),
+			Description:   aws.ToString(t.Description),
+			CreatedAt:     t.CreatedAt,
+			LastUpdatedAt: t.LastUpdatedAt,
+		},
+		SourceConnection:      connectionStatus(t.SourceConnectionState),
+		DestinationConnection: connectionStatus(t.DestinationConnectionState),
+	}
+	if t.DestinationConfig != nil {
+		view.ThingName = aws.ToString(t.DestinationConfig.ThingName)
+		view.Services = t.DestinationConfig.Services
+	}
+	if t.TimeoutConfig != nil {
+		view.LifetimeMinutes = t.TimeoutConfig.MaxLifetimeTimeoutMinutes
+	}
+	return view
+}
+
+func connectionStatus(state *types.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	return string(state.Status)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// listTunnels returns the tunnels of the account, or of the thing, with the status if it is not empty
+func listTunnels(ctx context.Context, client tunnelClient, thingName, status string) ([]tunnelSummaryView, error) {
+	input := &iotsecuretunneling.ListTunnelsInput{}
+	if thingName != "" {
+		input.ThingName = aws.String(thingName)
+	}
+
+	views := []tunnelSummaryView{}
+	for {
+		out, err := client.ListTunnels(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tunnels: %w", err)
+		}
+		for _, t := range out.TunnelSummaries {
+			if status != "" && !strings.EqualFold(string(t.Status), status) {
+				continue
+			}
+			views = append(views, tunnelSummaryView{
+				ID:            aws.ToString(t.TunnelId),
+				ARN:           aws.ToString(t.TunnelArn),
+				Status:        string(t.Status),
+				Description:   aws.ToString(t.Description),
+				CreatedAt:     t.CreatedAt,
+				LastUpdatedAt: t.LastUpdatedAt,
+			})
+		}
+		if out.NextToken == nil || *out.NextToken == "" {
+			return views, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func describeTunnel(ctx context.Context, client tunnelClient, tunnelID string) (tunnelView, error) {
+	out, err := client.DescribeTunnel(ctx, &iotsecuretunneling.DescribeTunnelInput{TunnelId: aws.String(tunnelID)})
+	if err != nil {
+		return tunnelView{}, fmt.Errorf("failed to describe tunnel %s: %w", tunnelID, err)
+	}
+	if out.Tunnel == nil {
+		return tunnelView{}, fmt.Errorf("tunnel %s not found", tunnelID)
+	}
+	return newTunnelView(out.Tunnel), nil
+}
+
+// rotateTunnel rotates the access tokens of the client mode. A new destination token is sent to the destination of
+// the tunnel, unless another thing or other services are given.
+func rotateTunnel(ctx context.Context, client tunnelClient, tunnelID, clientMode, thingName string, services []string) (*rotateTunnelAccessTokenOutput, error) {
+	mode := strings.ToUpper(clientMode)
+	switch mode {
+	case "SOURCE", "DESTINATION", "ALL":
+	default:
+		return nil, fmt.Errorf("client mode %q is not source, destination or all", clientMode)
+	}
+
+	input := &rotateTunnelAccessTokenInput{TunnelID: tunnelID, ClientMode: mode}
+	if mode != "SOURCE" {
+		if thingName == "" || len(services) == 0 {
+			view, err := describeTunnel(ctx, client, tunnelID)
+			if err != nil {
+				return nil, err
+			}
+			if thingName == "" {
+				thingName = view.ThingName
+			}
+			if len(services) == 0 {
+				services = view.Services
+			}
+		}
+		input.DestinationConfig = &rotateDestinationConfig{ThingName: thingName, Services: services}
+	}
+	return client.RotateTunnelAccessToken(ctx, input)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeTunnelList(w io.Writer, format string, tunnels []tunnelSummaryView) error {
+	if format == "json" {
+		return writeJSON(w, tunnels)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TUNNEL ID\tSTATUS\tCREATED\tLAST UPDATED\tDESCRIPTION")
+	for _, t := range tunnels {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Status, formatTime(t.CreatedAt), formatTime(t.LastUpdatedAt), t.Description)
+	}
+	return tw.Flush()
+}
+
+func writeTunnel(w io.Writer, format string, t tunnelView) error {
+	if format == "json" {
+		return writeJSON(w, t)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, row := range [][2]string{
+		{"Tunnel ID", t.ID},
+		{"ARN", t.ARN},
+		{"Status", t.Status},
+		{"Description", t.Description},
+		{"Thing", t.ThingName},
+		{"Services", strings.Join(t.Services, ", ")},
+		{"Source", t.SourceConnection},
+		{"Destination", t.DestinationConnection},
+		{"Created", formatTime(t.CreatedAt)},
+		{"Last updated", formatTime(t.LastUpdatedAt)},
+		{"Lifetime", fmt.Sprintf("%dm", t.LifetimeMinutes)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", row[0], row[1])
+	}
+	return tw.Flush()
+}
+
+func writeRotation(w io.Writer, format string, out *rotateTunnelAccessTokenOutput) error {
+	if format == "json" {
+		return writeJSON(w, out)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Tunnel ARN:\t%s\n", out.TunnelArn)
+	if out.SourceAccessToken != "" {
+		fmt.Fprintf(tw, "Source access token:\t%s\n", out.SourceAccessToken)
+	}
+	if out.DestinationAccessToken != "" {
+		fmt.Fprintf(tw, "Destination access token:\t%s\n", out.DestinationAccessToken)
+	}
+	return tw.Flush()
+}
+
+func checkOutputFormat() error {
+	if outputFormat != "table" && outputFormat != "json" {
+		return fmt.Errorf("output format %q is not table or json", outputFormat)
+	}
+	return nil
+}
+
+// runTunnelsCommand runs a tunnels subcommand with a client of the default AWS configuration
+func runTunnelsCommand(run func(ctx context.Context, client tunnelClient) error) {
+	if err := checkOutputFormat(); err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := newTunnelClient(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(ctx, client); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var tunnelsCmd = &cobra.Command{
+	Use:   "tunnels",
+	Short: "Manage secure tunnels",
+	Long:  `List, describe, rotate the access tokens of and close AWS IoT secure tunnels`,
+}
+
+var listTunnelsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List secure tunnels",
+	Long:  `List the secure tunnels of the account, or of a thing`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runTunnelsCommand(func(ctx context.Context, client tunnelClient) error {
+			tunnels, err := listTunnels(ctx, client, tunnelsThingName, tunnelsStatus)
+			if err != nil {
+				return err
+			}
+			return writeTunnelList(os.Stdout, outputFormat, tunnels)
+		})
+	},
+}
+
+var describeTunnelCmd = &cobra.Command{
+	Use:   "describe <tunnel id>",
+	Short: "Describe a secure tunnel",
+	Long:  `Describe a secure tunnel, including the connection state of its source and destination`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runTunnelsCommand(func(ctx context.Context, client tunnelClient) error {
+			tunnel, err := describeTunnel(ctx, client, args[0])
+			if err != nil {
+				return err
+			}
+			return writeTunnel(os.Stdout, outputFormat, tunnel)
+		})
+	},
+}
+
+var rotateTunnelCmd = &cobra.Command{
+	Use:   "rotate <tunnel id>",
+	Short: "Rotate the access tokens of a secure tunnel",
+	Long: `Rotate the access tokens of a secure tunnel, disconnecting the clients of the old tokens. The new destination
+token is sent to the thing, the new source token is printed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runTunnelsCommand(func(ctx context.Context, client tunnelClient) error {
+			out, err := rotateTunnel(ctx, client, args[0], rotateClientMode, tunnelsThingName, rotateServices)
+			if err != nil {
+				return err
+			}
+			return writeRotation(os.Stdout, outputFormat, out)
+		})
+	},
+}
+
+var closeTunnelCmd = &cobra.Command{
+	Use:   "close <tunnel id>",
+	Short: "Close a secure tunnel",
+	Long:  `Close a secure tunnel, disconnecting its source and destination`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runTunnelsCommand(func(ctx context.Context, client tunnelClient) error {
+			_, err := client.CloseTunnel(ctx, &iotsecuretunneling.CloseTunnelInput{
+				TunnelId: aws.String(args[0]),
+				Delete:   deleteTunnel,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to close tunnel %s: %w", args[0], err)
+			}
+			log.Printf("Closed tunnel %s\n", args[0])
+			return nil
+		})
+	},
+}
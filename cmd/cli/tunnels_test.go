@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling"
+	"github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTunnelClient serves tunnels from memory, two per page
+type fakeTunnelClient struct {
+	tunnels []types.Tunnel
+	rotated []*rotateTunnelAccessTokenInput
+	closed  []string
+}
+
+func (c *fakeTunnelClient) OpenTunnel(ctx context.Context, params *iotsecuretunneling.OpenTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.OpenTunnelOutput, error) {
+	return &iotsecuretunneling.OpenTunnelOutput{TunnelId: aws.String("new")}, nil
+}
+
+func (c *fakeTunnelClient) ListTunnels(ctx context.Context, params *iotsecuretunneling.ListTunnelsInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.ListTunnelsOutput, error) {
+	var matching []types.Tunnel
+	for _, t := range c.tunnels {
+		if params.ThingName == nil || aws.ToString(t.DestinationConfig.ThingName) == *params.ThingName {
+			matching = append(matching, t)
+		}
+	}
+
+	start := 0
+	if params.NextToken != nil {
+		start = int((*params.NextToken)[0] - '0')
+	}
+	out := &iotsecuretunneling.ListTunnelsOutput{}
+	for i := start; i < len(matching) && i < start+2; i++ {
+		out.TunnelSummaries = append(out.TunnelSummaries, types.TunnelSummary{
+			TunnelId:  matching[i].TunnelId,
+			TunnelArn: matching[i].TunnelArn,
+			Status:    matching[i].Status,
+			CreatedAt: matching[i].CreatedAt,
+		})
+	}
+	if start+2 < len(matching) {
+		out.NextToken = aws.String(string(rune('0' + start + 2)))
+	}
+	return out, nil
+}
+
+func (c *fakeTunnelClient) DescribeTunnel(ctx context.Context, params *iotsecuretunneling.DescribeTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.DescribeTunnelOutput, error) {
+	for _, t := range c.tunnels {
+		if aws.ToString(t.TunnelId) == aws.ToString(params.TunnelId) {
+			t := t
+			return &iotsecuretunneling.DescribeTunnelOutput{Tunnel: &t}, nil
+		}
+	}
+	return &iotsecuretunneling.DescribeTunnelOutput{}, nil
+}
+
+func (c *fakeTunnelClient) CloseTunnel(ctx context.Context, params *iotsecuretunneling.CloseTunnelInput, optFns ...func(*iotsecuretunneling.Options)) (*iotsecuretunneling.CloseTunnelOutput, error) {
+	c.closed = append(c.closed, aws.ToString(params.TunnelId))
+	return &iotsecuretunneling.CloseTunnelOutput{}, nil
+}
+
+func (c *fakeTunnelClient) RotateTunnelAccessToken(ctx context.Context, params *rotateTunnelAccessTokenInput) (*rotateTunnelAccessTokenOutput, error) {
+	c.rotated = append(c.rotated, params)
+	return &rotateTunnelAccessTokenOutput{TunnelArn: "arn:" + params.TunnelID, SourceAccessToken: "source-token"}, nil
+}
+
+func (c *fakeTunnelClient) Region() string {
+	return "eu-west-1"
+}
+
+func newFakeTunnelClient() *fakeTunnelClient {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tunnel := func(id, thing string, status types.TunnelStatus) types.Tunnel {
+		return types.Tunnel{
+			TunnelId:                   aws.String(id),
+			TunnelArn:                  aws.String("arn:" + id),
+			Status:                     status,
+			CreatedAt:                  &created,
+			DestinationConfig:          &types.DestinationConfig{ThingName: aws.String(thing), Services: []string{"SSH", "HTTP"}},
+			DestinationConnectionState: &types.ConnectionState{Status: types.ConnectionStatusConnected},
+			SourceConnectionState:      &types.ConnectionState{Status: types.ConnectionStatusDisconnected},
+			TimeoutConfig:              &types.TimeoutConfig{MaxLifetimeTimeoutMinutes: 720},
+		}
+	}
+	return &fakeTunnelClient{tunnels: []types.Tunnel{
+		tunnel("t1", "gateway-1", types.TunnelStatusOpen),
+		tunnel("t2", "gateway-2", types.TunnelStatusClosed),
+		tunnel("t3", "gateway-1", types.TunnelStatusOpen),
+		tunnel("t4", "gateway-1", types.TunnelStatusClosed),
+	}}
+}
+
+func TestListTunnels(t *testing.T) {
+	client := newFakeTunnelClient()
+
+	tunnels, err := listTunnels(context.Background(), client, "", "")
+	assert.NoError(t, err, "tunnels listed without error")
+	assert.Len(t, tunnels, 4, "all pages listed")
+
+	tunnels, err = listTunnels(context.Background(), client, "gateway-1", "open")
+	assert.NoError(t, err)
+	assert.Len(t, tunnels, 2, "tunnels filtered by thing and status")
+	assert.Equal(t, "t1", tunnels[0].ID)
+	assert.Equal(t, "t3", tunnels[1].ID)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeTunnelList(buf, "table", tunnels))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3, "table has a header and a row per tunnel")
+	assert.True(t, strings.HasPrefix(lines[1], "t1 "), lines[1])
+	assert.Contains(t, lines[1], "2026-01-02T03:04:05Z")
+
+	buf.Reset()
+	assert.NoError(t, writeTunnelList(buf, "json", tunnels))
+	var decoded []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded), "json output is valid")
+	assert.Equal(t, "t3", decoded[1]["tunnelId"])
+}
+
+func TestDescribeTunnel(t *testing.T) {
+	client := newFakeTunnelClient()
+
+	tunnel, err := describeTunnel(context.Background(), client, "t2")
+	assert.NoError(t, err, "tunnel described without error")
+	assert.Equal(t, "gateway-2", tunnel.ThingName)
+	assert.Equal(t, "CONNECTED", tunnel.DestinationConnection)
+	assert.Equal(t, "DISCONNECTED", tunnel.SourceConnection)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeTunnel(buf, "table", tunnel))
+	assert.Contains(t, buf.String(), "Services:")
+	assert.Contains(t, buf.String(), "SSH, HTTP")
+	assert.Contains(t, buf.String(), "720m")
+
+	_, err = describeTunnel(context.Background(), client, "missing")
+	assert.Error(t, err, "unknown tunnel reported")
+}
+
+func TestRotateTunnel(t *testing.T) {
+	client := newFakeTunnelClient()
+
+	out, err := rotateTunnel(context.Background(), client, "t1", "all", "", nil)
+	assert.NoError(t, err, "tokens rotated without error")
+	assert.Equal(t, "source-token", out.SourceAccessToken)
+	assert.Equal(t, "ALL", client.rotated[0].ClientMode)
+	assert.Equal(t, &rotateDestinationConfig{ThingName: "gateway-1", Services: []string{"SSH", "HTTP"}}, client.rotated[0].DestinationConfig,
+		"destination token sent to the destination of the tunnel")
+
+	_, err = rotateTunnel(context.Background(), client, "t1", "source", "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, client.rotated[1].DestinationConfig, "source rotation has no destination")
+
+	_, err = rotateTunnel(context.Background(), client, "t1", "both", "", nil)
+	assert.Error(t, err, "unknown client mode rejected")
+}
+
+func TestAWSTunnelClient_RotateTunnelAccessToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "IoTSecuredTunneling.RotateTunnelAccessToken", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/iotsecuredtunneling/aws4_request", "signed for the service and region")
+
+		body, _ := ioutil.ReadAll(r.Body)
+		request := rotateTunnelAccessTokenInput{}
+		assert.NoError(t, json.Unmarshal(body, &request))
+		if request.TunnelID != "t1" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "tunnel not found"}`))
+			return
+		}
+		w.Write([]byte(`{"tunnelArn": "arn:t1", "sourceAccessToken": "source-token"}`))
+	}))
+	defer server.Close()
+
+	client := newAWSTunnelClient(aws.Config{
+		Region: "eu-west-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+		}),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: server.URL}, nil
+		}),
+	})
+	assert.Equal(t, "eu-west-1", client.Region())
+
+	out, err := client.RotateTunnelAccessToken(context.Background(), &rotateTunnelAccessTokenInput{TunnelID: "t1", ClientMode: "SOURCE"})
+	assert.NoError(t, err, "request sent to the configured endpoint")
+	assert.Equal(t, "arn:t1", out.TunnelArn)
+	assert.Equal(t, "source-token", out.SourceAccessToken)
+
+	_, err = client.RotateTunnelAccessToken(context.Background(), &rotateTunnelAccessTokenInput{TunnelID: "t9", ClientMode: "SOURCE"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ResourceNotFoundException")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/credentials"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
@@ -14,8 +16,12 @@ import (
 
 func init() {
 	rootCmd.AddCommand(thing.RegisterCmd)
+	rootCmd.AddCommand(thing.BootstrapCmd)
 	rootCmd.AddCommand(networking.GetMACAddressCmd)
+	rootCmd.AddCommand(identity.GetUniqueIDCmd)
 	rootCmd.AddCommand(tunnel.ListenForTunnelCmd)
+	rootCmd.AddCommand(credentials.CredentialProcessCmd)
+	rootCmd.AddCommand(credentials.ServeCredentialsCmd)
 }
 
 var rootCmd = &cobra.Command{
@@ -5,10 +5,22 @@ var (
 	Endpoint string
 	// ThingName is the AWS IoT Thing name for the current device
 	ThingName string
+	// Identity is the unique ID source the thing name is derived from when ThingName is empty
+	Identity = "eui64"
 	// PrivateKeyPath is the path to the device private key
 	PrivateKeyPath = "/certs/device.private.key"
 	// CertificatePath is the path to the device certificate
 	CertificatePath = "/certs/device.certificate.pem"
 	// RootCAPath is the path to the root CA certificate
 	RootCAPath = "/certs/ca.pem"
+	// Services are the tunnel services and the local addresses they are forwarded to as <service>=<host:port>
+	Services = []string{"SSH=localhost:22"}
+	// PolicyPath is the path to the JSON tunnel policy, every tunnel with mapped services is allowed if it is empty
+	PolicyPath string
+	// ApproveCommand is a shell command approving every tunnel by exiting with 0
+	ApproveCommand string
+	// AuditLogPath is the file the tunnel session records are appended to
+	AuditLogPath string
+	// AuditTopic is the MQTT topic the tunnel session records are published on
+	AuditTopic string
 )
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/cmd/listen4tunnel/cfg"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
-	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
 )
 
@@ -28,21 +31,59 @@ func main() {
 	}
 
 	if cfg.ThingName == "" {
-		uniqueID, _, err := networking.GetMACAddress()
+		if spec := os.Getenv("AWS_IOT_IDENTITY"); spec != "" {
+			cfg.Identity = spec
+		}
+		thingName, err := tunnel.ThingNameFromIdentity(cfg.Identity, "gateway-", nil)
 		if err != nil {
-			log.Fatalf("error getting MAC address: %v", err)
+			log.Fatalf("error getting thing name: %v", err)
 		}
-		cfg.ThingName = fmt.Sprintf("gateway-%sfffe%s", uniqueID[0:6], uniqueID[6:])
+		cfg.ThingName = thingName
 	}
 
+	if spec := os.Getenv("AWS_IOT_TUNNEL_SERVICES"); spec != "" {
+		cfg.Services = strings.Split(spec, ",")
+	}
+	services, err := tunnel.ParseServices(cfg.Services)
+	if err != nil {
+		log.Fatalf("error parsing tunnel services: %v", err)
+	}
+
+	for env, value := range map[string]*string{
+		"AWS_IOT_TUNNEL_POLICY":          &cfg.PolicyPath,
+		"AWS_IOT_TUNNEL_APPROVE_COMMAND": &cfg.ApproveCommand,
+		"AWS_IOT_TUNNEL_AUDIT_LOG":       &cfg.AuditLogPath,
+		"AWS_IOT_TUNNEL_AUDIT_TOPIC":     &cfg.AuditTopic,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+	policy, err := tunnel.NewPolicy(cfg.PolicyPath, cfg.ApproveCommand)
+	if err != nil {
+		log.Fatalf("error loading tunnel policy: %v", err)
+	}
+	manager := tunnel.NewSessionManager(services, tunnel.DefaultMaxSessions)
+	manager.Policy = policy
+	if cfg.AuditLogPath != "" {
+		manager.Audit = tunnel.NewFileAuditLog(cfg.AuditLogPath)
+	}
+	manager.AuditTopic = cfg.AuditTopic
+
 	log.Println("Endpoint:", cfg.Endpoint)
 	log.Println("PrivateKeyPath:", keypair.PrivateKeyPath)
 	log.Println("CertificatePath:", keypair.CertificatePath)
 	log.Println("CACertificatePath:", keypair.CACertificatePath)
 	log.Println("ThingName:", cfg.ThingName)
+	log.Println("Services:", strings.Join(cfg.Services, ", "))
+	log.Println("Policy:", cfg.PolicyPath)
+	log.Println("AuditLog:", cfg.AuditLogPath)
 
-	err := tunnel.ListenForTunnel(cfg.ThingName, keypair, cfg.Endpoint)
-	if err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = tunnel.ListenForTunnelWithManager(ctx, cfg.ThingName, keypair, cfg.Endpoint, manager)
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatalf("error listening for tunnel: %v", err)
 	}
 	log.Println("SHUTDOWN WITHOUT ERROR")
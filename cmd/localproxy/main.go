@@ -15,9 +15,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
 	"github.com/patrickjmcd/go-version"
@@ -32,6 +36,7 @@ var (
 	destinationApp  string
 	noSSLHostVerify bool
 	proxyScheme     string
+	serviceFlags    []string
 )
 
 func init() {
@@ -40,6 +45,7 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&region, "region", "", "Endpoint region. Exclusive flag with -proxy-endpoint")
 	rootCmd.PersistentFlags().IntVar(&sourcePort, "source-listen-port", 0, "Assigns source mode and sets the port to listen")
 	rootCmd.PersistentFlags().StringVar(&destinationApp, "destination-app", "", "Assigns destination mode and set the endpoint in address:port format")
+	rootCmd.PersistentFlags().StringArrayVar(&serviceFlags, "destination-service", nil, "Assigns destination mode and forwards a tunnel service to a local address as <service>=<host:port>, e.g. HTTP=localhost:80")
 	rootCmd.PersistentFlags().BoolVar(&noSSLHostVerify, "no-ssl-host-verify", false, "Turn off SSL host verification")
 	rootCmd.PersistentFlags().StringVar(&proxyScheme, "proxy-scheme", "wss", "Proxy server protocol scheme")
 }
@@ -59,8 +65,13 @@ var rootCmd = &cobra.Command{
 			log.Fatal("--proxy-endpoint or --region is required")
 		}
 
-		if sourcePort == 0 && destinationApp == "" {
-			log.Fatal("--source-listen-port or --destination-app is required")
+		if sourcePort == 0 && destinationApp == "" && len(serviceFlags) == 0 {
+			log.Fatal("--source-listen-port, --destination-app or --destination-service is required")
+		}
+
+		services, err := tunnel.ParseServices(serviceFlags)
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		params := tunnel.ProxyParams{
@@ -69,10 +80,15 @@ var rootCmd = &cobra.Command{
 			Region:          region,
 			SourcePort:      sourcePort,
 			DestinationApp:  destinationApp,
+			Services:        services,
 			NoSSLHostVerify: noSSLHostVerify,
+			ProxyScheme:     proxyScheme,
 		}
-		err := tunnel.StartLocalProxy(params)
-		if err != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		err = tunnel.StartLocalProxy(ctx, params)
+		if err != nil && !errors.Is(err, context.Canceled) {
 			log.Fatal(err)
 		}
 	},
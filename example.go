@@ -32,9 +32,10 @@ func example() {
 		log.Fatalf("error creating client: %v", err)
 	}
 
-	err = thing.ProvisionThing(client, keypair, endpoint, templateName, parameters, outputFilePath)
+	result, err := thing.ProvisionThing(client, keypair, endpoint, templateName, parameters, outputFilePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Registered thing %s, device configuration: %v", result.ThingName, result.DeviceConfiguration)
 
 }
@@ -6,16 +6,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/iot v1.23.2
 	github.com/aws/aws-sdk-go-v2/service/iotsecuretunneling v1.12.2
 	github.com/eclipse/paho.mqtt.golang v1.3.2
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/google/uuid v1.3.0
 	github.com/patrickjmcd/go-version v0.0.0-20220126201046-52be7ddbba40
 	github.com/seqsense/aws-iot-device-sdk-go/v5 v5.0.6
 	github.com/spf13/cobra v1.4.0
+	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/net v0.0.0-20220325170049-de3da57026de
+	google.golang.org/protobuf v1.28.0
 )
 
 require (
-	github.com/at-wat/mqtt-go v0.13.0 // indirect
-	github.com/aws/aws-sdk-go v1.43.27 // indirect
 	github.com/aws/aws-sdk-go-v2/credentials v1.11.1 // indirect
 	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.12.2 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.8 // indirect
@@ -28,12 +30,9 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
-	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/net v0.0.0-20220325170049-de3da57026de // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals Go values into message payloads and back
+type Codec interface {
+	// Marshal encodes v into a payload
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes the payload into v, which must be a pointer
+	Unmarshal(data []byte, v interface{}) error
+	// Name returns the name of the encoding, e.g. "json"
+	Name() string
+}
+
+var (
+	// JSON encodes values with encoding/json
+	JSON Codec = jsonCodec{}
+	// CBOR encodes values as RFC 8949 CBOR. Struct fields use the cbor tag, falling back to the json tag.
+	CBOR Codec = cborCodec{}
+	// Protobuf encodes values implementing proto.Message in the protobuf wire format
+	Protobuf Codec = protobufCodec{}
+)
+
+// ErrNotProtoMessage is returned by the Protobuf codec for values that do not implement proto.Message
+var ErrNotProtoMessage = errors.New("value does not implement proto.Message")
+
+// ByName returns the codec registered under the name: json, cbor or protobuf
+func ByName(name string) (Codec, error) {
+	for _, c := range []Codec{JSON, CBOR, Protobuf} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) Name() string                               { return "cbor" }
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+// NewHandler returns a function that decodes a payload with the codec and delivers the value to target. The target
+// must be a channel the values can be sent on (chan T) or a function taking a single value (func(T)). Pointer types
+// such as *T or protobuf messages are allocated before decoding.
+func NewHandler(c Codec, target interface{}) (func(data []byte) error, error) {
+	if c == nil {
+		return nil, errors.New("codec is required")
+	}
+
+	targetValue := reflect.ValueOf(target)
+	var valueType reflect.Type
+	var deliver func(v reflect.Value)
+
+	switch targetValue.Kind() {
+	case reflect.Chan:
+		if targetValue.Type().ChanDir()&reflect.SendDir == 0 {
+			return nil, fmt.Errorf("target channel %s is receive-only", targetValue.Type())
+		}
+		valueType = targetValue.Type().Elem()
+		deliver = func(v reflect.Value) { targetValue.Send(v) }
+	case reflect.Func:
+		if targetValue.Type().NumIn() != 1 || targetValue.Type().NumOut() != 0 {
+			return nil, fmt.Errorf("target function %s must take a single argument and return nothing", targetValue.Type())
+		}
+		valueType = targetValue.Type().In(0)
+		deliver = func(v reflect.Value) { targetValue.Call([]reflect.Value{v}) }
+	default:
+		return nil, fmt.Errorf("target must be a channel or a function, got %T", target)
+	}
+
+	return func(data []byte) error {
+		var value reflect.Value
+		if valueType.Kind() == reflect.Ptr {
+			value = reflect.New(valueType.Elem())
+			if err := c.Unmarshal(data, value.Interface()); err != nil {
+				return fmt.Errorf("failed to decode %s payload: %w", c.Name(), err)
+			}
+		} else {
+			ptr := reflect.New(valueType)
+			if err := c.Unmarshal(data, ptr.Interface()); err != nil {
+				return fmt.Errorf("failed to decode %s payload: %w", c.Name(), err)
+			}
+			value = ptr.Elem()
+		}
+		deliver(value)
+		return nil
+	}, nil
+}
@@ -0,0 +1,59 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type reading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.CBOR} {
+		data, err := c.Marshal(reading{Sensor: "temp", Value: 21.5})
+		assert.NoError(t, err, "%s marshaled without error", c.Name())
+
+		out := reading{}
+		assert.NoError(t, c.Unmarshal(data, &out), "%s unmarshaled without error", c.Name())
+		assert.Equal(t, reading{Sensor: "temp", Value: 21.5}, out)
+	}
+
+	data, err := codec.Protobuf.Marshal(wrapperspb.String("hello"))
+	assert.NoError(t, err, "protobuf marshaled without error")
+	out := &wrapperspb.StringValue{}
+	assert.NoError(t, codec.Protobuf.Unmarshal(data, out), "protobuf unmarshaled without error")
+	assert.Equal(t, "hello", out.GetValue())
+
+	_, err = codec.Protobuf.Marshal(reading{})
+	assert.ErrorIs(t, err, codec.ErrNotProtoMessage)
+}
+
+func TestNewHandler_Channel(t *testing.T) {
+	readings := make(chan reading, 1)
+	handle, err := codec.NewHandler(codec.JSON, readings)
+	assert.NoError(t, err, "handler created for a channel")
+
+	assert.NoError(t, handle([]byte(`{"sensor": "temp", "value": 1}`)))
+	assert.Equal(t, reading{Sensor: "temp", Value: 1}, <-readings)
+
+	assert.Error(t, handle([]byte(`not json`)), "decode errors are returned instead of delivered")
+	assert.Len(t, readings, 0)
+}
+
+func TestNewHandler_Func(t *testing.T) {
+	var got *wrapperspb.StringValue
+	handle, err := codec.NewHandler(codec.Protobuf, func(v *wrapperspb.StringValue) { got = v })
+	assert.NoError(t, err, "handler created for a function")
+
+	data, _ := codec.Protobuf.Marshal(wrapperspb.String("hello"))
+	assert.NoError(t, handle(data))
+	assert.Equal(t, "hello", got.GetValue())
+
+	_, err = codec.NewHandler(codec.JSON, "not a target")
+	assert.Error(t, err, "targets other than channels and functions are rejected")
+}
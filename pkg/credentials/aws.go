@@ -0,0 +1,57 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// AWSProviderSource is the Source of the credentials returned by AWSProvider
+const AWSProviderSource = "AWSIoTCredentialsProvider"
+
+// AWSProvider implements aws.CredentialsProvider of aws-sdk-go-v2 for the AWS IoT credentials provider, so the device
+// can call other AWS services with its X.509 identity:
+//
+//	cfg, err := config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(credentials.NewAWSCredentialsCache(service)))
+//
+// The returned credentials carry their expiry, so aws.CredentialsCache refreshes them when they expire.
+type AWSProvider struct {
+	fetcher Fetcher
+}
+
+// NewAWSProvider returns an aws.CredentialsProvider retrieving the credentials with the fetcher, e.g. a Service or a
+// CachingProvider
+func NewAWSProvider(fetcher Fetcher) *AWSProvider {
+	return &AWSProvider{fetcher: fetcher}
+}
+
+// Retrieve implements aws.CredentialsProvider
+func (p *AWSProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.fetcher.GetCredentialsWithContext(ctx)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to retrieve credentials from the AWS IoT credentials provider: %w", err)
+	}
+	expires, err := creds.ExpiresAt()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Source:          AWSProviderSource,
+		CanExpire:       true,
+		Expires:         expires,
+	}, nil
+}
+
+// NewAWSCredentialsCache wraps an AWSProvider in an aws.CredentialsCache, which refreshes the credentials
+// DefaultRefreshBefore before they expire unless the options set another ExpiryWindow
+func NewAWSCredentialsCache(fetcher Fetcher, optFns ...func(*aws.CredentialsCacheOptions)) *aws.CredentialsCache {
+	optFns = append([]func(*aws.CredentialsCacheOptions){func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = DefaultRefreshBefore
+	}}, optFns...)
+	return aws.NewCredentialsCache(NewAWSProvider(fetcher), optFns...)
+}
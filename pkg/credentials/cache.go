@@ -0,0 +1,252 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshBefore is how long before their expiry cached credentials are refreshed
+	DefaultRefreshBefore = 5 * time.Minute
+	// DefaultRefreshJitter is the maximum random time the background refresh is brought forward, so a fleet of
+	// devices does not refresh at the same moment
+	DefaultRefreshJitter = time.Minute
+
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 500 * time.Millisecond
+	maxBackoff            = 30 * time.Second
+)
+
+// Fetcher retrieves new credentials, e.g. Service
+type Fetcher interface {
+	GetCredentialsWithContext(ctx context.Context) (Output, error)
+}
+
+// CachingProviderOptions configures a CachingProvider. Zero values select the defaults.
+type CachingProviderOptions struct {
+	// RefreshBefore is how long before their expiry the credentials are refreshed
+	RefreshBefore time.Duration
+	// Jitter is the maximum random time the background refresh is brought forward
+	Jitter time.Duration
+	// MaxAttempts is the number of attempts per refresh for server errors and throttling
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for every further retry up to 30 seconds
+	InitialBackoff time.Duration
+}
+
+// CachingProvider caches the credentials until shortly before they expire. Concurrent callers needing a refresh share
+// a single request. Start refreshes the credentials in the background, so callers do not have to wait for a refresh.
+type CachingProvider struct {
+	fetcher Fetcher
+	opts    CachingProviderOptions
+
+	mu        sync.Mutex
+	creds     Output
+	expires   time.Time
+	refreshAt time.Time
+	inflight  *refreshCall
+	refreshed chan struct{}
+}
+
+// refreshCall is a refresh shared by all callers that need it while it is in flight
+type refreshCall struct {
+	done  chan struct{}
+	creds Output
+	err   error
+}
+
+// NewCachingProvider returns a provider caching the credentials retrieved by the fetcher
+func NewCachingProvider(fetcher Fetcher, opts CachingProviderOptions) *CachingProvider {
+	if opts.RefreshBefore <= 0 {
+		opts.RefreshBefore = DefaultRefreshBefore
+	}
+	if opts.Jitter < 0 {
+		opts.Jitter = 0
+	} else if opts.Jitter == 0 {
+		opts.Jitter = DefaultRefreshJitter
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+	return &CachingProvider{
+		fetcher:   fetcher,
+		opts:      opts,
+		refreshed: make(chan struct{}, 1),
+	}
+}
+
+// Credentials returns the cached credentials, refreshing them first if they expire within RefreshBefore. If the
+// refresh fails while the cached credentials are still valid, the cached credentials are returned.
+func (p *CachingProvider) Credentials(ctx context.Context) (Output, error) {
+	p.mu.Lock()
+	cached, expires, refreshAt := p.creds, p.expires, p.refreshAt
+	p.mu.Unlock()
+
+	if !expires.IsZero() && time.Now().Before(refreshAt) {
+		return cached, nil
+	}
+
+	creds, err := p.Refresh(ctx)
+	if err != nil && time.Now().Before(expires) {
+		return cached, nil
+	}
+	return creds, err
+}
+
+// GetCredentialsWithContext implements Fetcher with Credentials, so a CachingProvider can be shared with an AWSProvider
+func (p *CachingProvider) GetCredentialsWithContext(ctx context.Context) (Output, error) {
+	return p.Credentials(ctx)
+}
+
+// Expiration returns the expiry of the cached credentials, or the zero time if there are none
+func (p *CachingProvider) Expiration() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expires
+}
+
+// Refresh retrieves new credentials regardless of the cache. If a refresh is already in flight, its result is
+// returned instead of sending another request.
+func (p *CachingProvider) Refresh(ctx context.Context) (Output, error) {
+	p.mu.Lock()
+	call := p.inflight
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		p.inflight = call
+		p.mu.Unlock()
+
+		go p.refresh(call)
+	} else {
+		p.mu.Unlock()
+	}
+
+	select {
+	case <-call.done:
+		return call.creds, call.err
+	case <-ctx.Done():
+		return Output{}, ctx.Err()
+	}
+}
+
+// refresh performs the shared refresh call. It does not use the context of a caller, so a caller giving up does not
+// fail the refresh for the others.
+func (p *CachingProvider) refresh(call *refreshCall) {
+	creds, expires, err := p.fetch()
+
+	p.mu.Lock()
+	if err == nil {
+		p.creds = creds
+		p.expires = expires
+		p.refreshAt = expires.Add(-p.opts.RefreshBefore)
+		if halfway := time.Now().Add(time.Until(expires) / 2); p.refreshAt.Before(halfway) {
+			// credentials living shorter than twice RefreshBefore are refreshed halfway
+			p.refreshAt = halfway
+		}
+		select {
+		case p.refreshed <- struct{}{}:
+		default:
+		}
+	}
+	p.inflight = nil
+	p.mu.Unlock()
+
+	call.creds, call.err = creds, err
+	close(call.done)
+}
+
+// fetch retrieves the credentials, retrying server errors, throttling and failed requests with backoff
+func (p *CachingProvider) fetch() (Output, time.Time, error) {
+	backoff := p.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		creds, err := p.fetcher.GetCredentialsWithContext(ctx)
+		cancel()
+		if err == nil {
+			expires, err := creds.ExpiresAt()
+			if err != nil {
+				return Output{}, time.Time{}, err
+			}
+			return creds, expires, nil
+		}
+		if attempt >= p.opts.MaxAttempts || !retryable(err) {
+			return Output{}, time.Time{}, err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// retryable reports whether a failed request may succeed when it is sent again. Responses are only retried for
+// server errors and throttling.
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Start refreshes the credentials in the background, RefreshBefore plus a random jitter before they expire, until the
+// context is done. Credentials living shorter than twice RefreshBefore are refreshed halfway through their lifetime.
+// Failed refreshes are retried with backoff.
+func (p *CachingProvider) Start(ctx context.Context) {
+	go func() {
+		backoff := p.opts.InitialBackoff
+		for {
+			p.mu.Lock()
+			refreshAt := p.refreshAt
+			p.mu.Unlock()
+
+			wait := time.Duration(0)
+			if !refreshAt.IsZero() {
+				wait = time.Until(refreshAt) - jitter(p.opts.Jitter)
+			}
+
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-p.refreshed:
+					// a caller refreshed the credentials, wait for the new expiry
+					timer.Stop()
+					continue
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+
+			if _, err := p.Refresh(ctx); err != nil {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			backoff = p.opts.InitialBackoff
+		}
+	}()
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,105 @@
+package credentials
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFetcher returns the errors in order, then credentials valid for the lifetime
+type fakeFetcher struct {
+	calls    int32
+	errs     []error
+	lifetime time.Duration
+	delay    time.Duration
+}
+
+func (f *fakeFetcher) GetCredentialsWithContext(ctx context.Context) (Output, error) {
+	call := int(atomic.AddInt32(&f.calls, 1))
+	time.Sleep(f.delay)
+	if call <= len(f.errs) {
+		return Output{}, f.errs[call-1]
+	}
+	return Output{
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Expiration:      time.Now().Add(f.lifetime).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func TestCachingProvider_Cache(t *testing.T) {
+	fetcher := &fakeFetcher{lifetime: time.Hour, delay: 10 * time.Millisecond}
+	p := NewCachingProvider(fetcher, CachingProviderOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := p.Credentials(context.Background())
+			assert.NoError(t, err, "credentials retrieved without error")
+			assert.Equal(t, "key", creds.AccessKeyID)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, fetcher.calls, "concurrent callers share a single request")
+
+	_, err := p.Credentials(context.Background())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, fetcher.calls, "cached credentials are returned until they are about to expire")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), p.Expiration(), 2*time.Second)
+}
+
+func TestCachingProvider_Retry(t *testing.T) {
+	fetcher := &fakeFetcher{
+		lifetime: time.Hour,
+		errs:     []error{&StatusError{StatusCode: 503}, &StatusError{StatusCode: 429}},
+	}
+	p := NewCachingProvider(fetcher, CachingProviderOptions{InitialBackoff: time.Millisecond})
+	_, err := p.Credentials(context.Background())
+	assert.NoError(t, err, "server errors and throttling are retried")
+	assert.EqualValues(t, 3, fetcher.calls)
+
+	fetcher = &fakeFetcher{lifetime: time.Hour, errs: []error{&StatusError{StatusCode: 403}}}
+	p = NewCachingProvider(fetcher, CachingProviderOptions{InitialBackoff: time.Millisecond})
+	_, err = p.Credentials(context.Background())
+	assert.Error(t, err, "client errors are returned")
+	assert.EqualValues(t, 1, fetcher.calls, "client errors are not retried")
+}
+
+func TestCachingProvider_Start(t *testing.T) {
+	fetcher := &fakeFetcher{lifetime: 2 * time.Second}
+	p := NewCachingProvider(fetcher, CachingProviderOptions{RefreshBefore: time.Hour, Jitter: -1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&fetcher.calls) >= 2 }, 3*time.Second, 10*time.Millisecond,
+		"short lived credentials are refreshed in the background halfway through their lifetime")
+}
+
+func TestAWSProvider_Retrieve(t *testing.T) {
+	fetcher := &fakeFetcher{lifetime: time.Hour}
+	creds, err := NewAWSProvider(fetcher).Retrieve(context.Background())
+	assert.NoError(t, err, "credentials retrieved without error")
+	assert.Equal(t, "key", creds.AccessKeyID)
+	assert.True(t, creds.CanExpire, "credentials expire")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), creds.Expires, 2*time.Second)
+
+	cache := NewAWSCredentialsCache(fetcher)
+	for i := 0; i < 3; i++ {
+		_, err := cache.Retrieve(context.Background())
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, fetcher.calls, "cache reuses the credentials until they expire")
+
+	fetcher = &fakeFetcher{errs: []error{&StatusError{StatusCode: 403}}}
+	_, err = NewAWSProvider(fetcher).Retrieve(context.Background())
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr, "status of the failed request is kept")
+}
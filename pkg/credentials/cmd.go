@@ -0,0 +1,228 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	credentialsURL  string
+	certificateFlag string
+	privateKeyFlag  string
+	thingNameFlag   string
+	endpointFlag    string
+	roleAlias       string
+	rootCAFlag      string
+	proxyFlag       string
+	listenAddress   string
+	tokenFilePath   string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{CredentialProcessCmd, ServeCredentialsCmd} {
+		cmd.PersistentFlags().StringVarP(&credentialsURL, "credentials-url", "u", "", "The credentials provider URL: https://<credentials endpoint>/role-aliases/<role alias>/credentials, instead of --endpoint and --role-alias")
+		cmd.PersistentFlags().StringVarP(&endpointFlag, "endpoint", "e", "", "The AWS IoT credentials provider endpoint")
+		cmd.PersistentFlags().StringVar(&roleAlias, "role-alias", "", "The role alias to assume")
+		cmd.PersistentFlags().StringVarP(&rootCAFlag, "root-ca", "r", "", "The root CA path with --endpoint, defaults to the Amazon Root CA")
+		cmd.PersistentFlags().StringVar(&proxyFlag, "proxy", "", "The http, https or socks5 proxy URL with --endpoint")
+		cmd.PersistentFlags().StringVarP(&certificateFlag, "certificate", "c", "", "The certificate path")
+		cmd.PersistentFlags().StringVarP(&privateKeyFlag, "private-key", "k", "", "The private key path")
+		cmd.PersistentFlags().StringVarP(&thingNameFlag, "thing-name", "n", "", "The thing name")
+	}
+	ServeCredentialsCmd.PersistentFlags().StringVarP(&listenAddress, "listen", "l", "127.0.0.1:8181", "The loopback address to serve the credentials on")
+	ServeCredentialsCmd.PersistentFlags().StringVar(&tokenFilePath, "token-file", "", "Read the authorization token from this file, or write a generated token to it if it does not exist")
+}
+
+func checkCredentialsParameters() error {
+	if credentialsURL == "" && endpointFlag == "" {
+		return fmt.Errorf("endpoint and role-alias or credentials-url is required")
+	}
+	if credentialsURL != "" && endpointFlag != "" {
+		return fmt.Errorf("endpoint and credentials-url are mutually exclusive")
+	}
+	if certificateFlag == "" {
+		return fmt.Errorf("certificate is required")
+	}
+	if privateKeyFlag == "" {
+		return fmt.Errorf("private-key is required")
+	}
+	if thingNameFlag == "" {
+		return fmt.Errorf("thing-name is required")
+	}
+	return nil
+}
+
+// newServiceFromFlags returns the Service configured by the credentials flags
+func newServiceFromFlags() (Service, error) {
+	if err := checkCredentialsParameters(); err != nil {
+		return Service{}, err
+	}
+	if credentialsURL != "" {
+		return NewService(credentialsURL, certificateFlag, privateKeyFlag, thingNameFlag)
+	}
+
+	cfg := ServiceConfig{
+		Endpoint:  endpointFlag,
+		RoleAlias: roleAlias,
+		ThingName: thingNameFlag,
+		Proxy:     proxyFlag,
+	}
+	for _, file := range []struct {
+		path string
+		pem  *string
+	}{
+		{certificateFlag, &cfg.CertificatePEM},
+		{privateKeyFlag, &cfg.PrivateKeyPEM},
+		{rootCAFlag, &cfg.RootCAPEM},
+	} {
+		if file.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return Service{}, fmt.Errorf("failed to read %s: %w", file.path, err)
+		}
+		*file.pem = string(data)
+	}
+	return NewServiceFromConfig(cfg)
+}
+
+// authorizationToken returns the token of the token file, generating it if the file does not exist
+func authorizationToken() (string, error) {
+	if tokenFilePath == "" {
+		return GenerateToken()
+	}
+
+	data, err := ioutil.ReadFile(tokenFilePath)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read the token file: %w", err)
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(tokenFilePath, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("failed to write the token file: %w", err)
+	}
+	return token, nil
+}
+
+// checkLoopback rejects listen addresses other processes on the network could reach
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("listen address %s is not a loopback address", address)
+	}
+	return nil
+}
+
+// CredentialProcessCmd prints the credentials in the credential_process format of the AWS CLI and SDKs
+var CredentialProcessCmd = &cobra.Command{
+	Use:   "credential-process",
+	Short: "Prints AWS credentials for the AWS CLI credential_process setting",
+	Long: `Gets AWS credentials from the AWS IoT credentials provider with the device certificate and prints them in the
+credential_process format, e.g. in ~/.aws/config:
+
+[profile device]
+credential_process = aws-provision credential-process -e <endpoint> --role-alias <alias> -c <certificate> -k <private key> -n <thing name>`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		service, err := newServiceFromFlags()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		creds, err := service.GetCredentialsWithContext(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := json.NewEncoder(os.Stdout).Encode(NewProcessOutput(creds)); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// ServeCredentialsCmd serves auto-rotating credentials to other processes on the device
+var ServeCredentialsCmd = &cobra.Command{
+	Use:   "serve-credentials",
+	Short: "Serves AWS credentials to other processes on the device",
+	Long: `Serves AWS credentials from the AWS IoT credentials provider on a loopback address like the ECS container
+credentials endpoint. The credentials are refreshed in the background before they expire. Other processes use them
+by setting AWS_CONTAINER_CREDENTIALS_FULL_URI and AWS_CONTAINER_AUTHORIZATION_TOKEN. The token is read from
+--token-file, or generated and printed once to stdout when no token file is given.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		service, err := newServiceFromFlags()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkLoopback(listenAddress); err != nil {
+			log.Fatal(err)
+		}
+		token, err := authorizationToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		provider := NewCachingProvider(service, CachingProviderOptions{})
+		if _, err := provider.Credentials(ctx); err != nil {
+			log.Fatal(err)
+		}
+		provider.Start(ctx)
+
+		server, err := NewServer(provider, token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", listenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpServer := &http.Server{Handler: server}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			httpServer.Shutdown(shutdownCtx)
+		}()
+
+		log.Printf("AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s%s\n", listener.Addr(), ServerPath)
+		if tokenFilePath != "" {
+			log.Printf("AWS_CONTAINER_AUTHORIZATION_TOKEN is in %s\n", tokenFilePath)
+		} else {
+			// the generated token is printed once to stdout only, so it never ends up in the logs
+			fmt.Printf("AWS_CONTAINER_AUTHORIZATION_TOKEN=%s\n", token)
+		}
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	},
+}
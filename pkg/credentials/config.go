@@ -0,0 +1,130 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/mqtt"
+)
+
+// ServiceConfig configures a Service from its parts instead of a credentials URL
+type ServiceConfig struct {
+	// Endpoint is the credentials provider endpoint, e.g. from aws iot describe-endpoint --endpoint-type
+	// iot:CredentialProvider. It is a host name with an optional port, without scheme or path.
+	Endpoint string
+	// RoleAlias is the name of the role alias the device assumes
+	RoleAlias string
+	// ThingName is sent in the x-amzn-iot-thingname header
+	ThingName string
+	// CertificatePEM and PrivateKeyPEM are the device credentials
+	CertificatePEM string
+	PrivateKeyPEM  string
+	// RootCAPEM is the CA bundle the endpoint certificate is verified with, defaults to mqtt.RootPEM
+	RootCAPEM string
+	// Proxy is an optional http, https or socks5 proxy URL. Without it no proxy is used.
+	Proxy string
+}
+
+// URL returns the credentials URL of the endpoint and role alias
+func (c ServiceConfig) URL() string {
+	return fmt.Sprintf("https://%s/role-aliases/%s/credentials", c.Endpoint, neturl.PathEscape(c.RoleAlias))
+}
+
+func (c ServiceConfig) validate() error {
+	if c.Endpoint == "" {
+		return errors.New("credentials endpoint is required")
+	}
+	if strings.Contains(c.Endpoint, "://") || strings.ContainsAny(c.Endpoint, "/?#") {
+		return fmt.Errorf("credentials endpoint %q must be a host name without scheme or path", c.Endpoint)
+	}
+	if host, _, err := net.SplitHostPort(c.Endpoint); err == nil && host == "" {
+		return fmt.Errorf("credentials endpoint %q has no host name", c.Endpoint)
+	}
+	if c.RoleAlias == "" {
+		return errors.New("role alias is required")
+	}
+	if strings.Contains(c.RoleAlias, "/") {
+		return fmt.Errorf("role alias %q must not contain a slash", c.RoleAlias)
+	}
+	if c.ThingName == "" {
+		return errors.New("thing name is required")
+	}
+	if c.CertificatePEM == "" || c.PrivateKeyPEM == "" {
+		return errors.New("certificate and private key are required")
+	}
+	return nil
+}
+
+func (c ServiceConfig) proxy() (func(*http.Request) (*neturl.URL, error), error) {
+	if c.Proxy == "" {
+		return nil, nil
+	}
+	proxyURL, err := neturl.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy URL %q must use the http, https or socks5 scheme", c.Proxy)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", c.Proxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// NewServiceFromConfig validates the configuration and returns a new instance of the Service. The endpoint
+// certificate is verified with the configured CA bundle, or the Amazon Root CA like the MQTT connection.
+func NewServiceFromConfig(cfg ServiceConfig) (Service, error) {
+	if err := cfg.validate(); err != nil {
+		return Service{}, err
+	}
+
+	tlsCert, err := tls.X509KeyPair([]byte(cfg.CertificatePEM), []byte(cfg.PrivateKeyPEM))
+	if err != nil {
+		return Service{}, fmt.Errorf("failed to load the certificates: %w", err)
+	}
+
+	rootCAPEM := cfg.RootCAPEM
+	if rootCAPEM == "" {
+		rootCAPEM = mqtt.RootPEM
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM([]byte(rootCAPEM)) {
+		return Service{}, errors.New("no CA certificate found in the root CA PEM data")
+	}
+
+	proxy, err := cfg.proxy()
+	if err != nil {
+		return Service{}, err
+	}
+
+	return Service{
+		url:       cfg.URL(),
+		thingName: cfg.ThingName,
+		tlsCert:   tlsCert,
+		client: newHTTPClient(&tls.Config{
+			Certificates: []tls.Certificate{tlsCert},
+			RootCAs:      rootCAs,
+		}, proxy),
+	}, nil
+}
+
+// NewServiceFromStrings returns a new instance of the Service for the endpoint and role alias, with the device
+// credentials given as PEM strings and the Amazon Root CA
+func NewServiceFromStrings(cert, key, endpoint, roleAlias, thingName string) (Service, error) {
+	return NewServiceFromConfig(ServiceConfig{
+		Endpoint:       endpoint,
+		RoleAlias:      roleAlias,
+		ThingName:      thingName,
+		CertificatePEM: cert,
+		PrivateKeyPEM:  key,
+	})
+}
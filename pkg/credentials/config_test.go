@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedPEM returns a self-signed device certificate and its private key
+func selfSignedPEM(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestServiceConfig_Validate(t *testing.T) {
+	cert, key := selfSignedPEM(t)
+	valid := ServiceConfig{
+		Endpoint:       "abc.credentials.iot.eu-west-1.amazonaws.com",
+		RoleAlias:      "device-role",
+		ThingName:      "thing",
+		CertificatePEM: cert,
+		PrivateKeyPEM:  key,
+	}
+	assert.Equal(t, "https://abc.credentials.iot.eu-west-1.amazonaws.com/role-aliases/device-role/credentials", valid.URL())
+
+	_, err := NewServiceFromConfig(valid)
+	assert.NoError(t, err, "valid configuration is accepted")
+
+	for name, modify := range map[string]func(c *ServiceConfig){
+		"missing endpoint":    func(c *ServiceConfig) { c.Endpoint = "" },
+		"endpoint with URL":   func(c *ServiceConfig) { c.Endpoint = "https://" + c.Endpoint },
+		"endpoint with path":  func(c *ServiceConfig) { c.Endpoint += "/role-aliases" },
+		"missing role alias":  func(c *ServiceConfig) { c.RoleAlias = "" },
+		"role alias path":     func(c *ServiceConfig) { c.RoleAlias = "a/b" },
+		"missing thing name":  func(c *ServiceConfig) { c.ThingName = "" },
+		"invalid certificate": func(c *ServiceConfig) { c.CertificatePEM = "invalid" },
+		"invalid root CA":     func(c *ServiceConfig) { c.RootCAPEM = "invalid" },
+		"invalid proxy":       func(c *ServiceConfig) { c.Proxy = "ftp://proxy:21" },
+	} {
+		cfg := valid
+		modify(&cfg)
+		_, err := NewServiceFromConfig(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestNewServiceFromConfig_RootCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/role-aliases/device-role/credentials", r.URL.Path)
+		assert.Equal(t, "thing", r.Header.Get("x-amzn-iot-thingname"))
+		fmt.Fprint(w, `{"credentials": {"accessKeyId": "key", "secretAccessKey": "secret", "sessionToken": "token", "expiration": "2030-01-01T00:00:00Z"}}`)
+	}))
+	defer server.Close()
+
+	cert, key := selfSignedPEM(t)
+	cfg := ServiceConfig{
+		Endpoint:       strings.TrimPrefix(server.URL, "https://"),
+		RoleAlias:      "device-role",
+		ThingName:      "thing",
+		CertificatePEM: cert,
+		PrivateKeyPEM:  key,
+		RootCAPEM:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	}
+	s, err := NewServiceFromConfig(cfg)
+	assert.NoError(t, err, "service created without error")
+	out, err := s.GetCredentialsWithContext(context.Background())
+	assert.NoError(t, err, "endpoint certificate verified with the configured CA")
+	assert.Equal(t, "key", out.AccessKeyID)
+
+	cfg.RootCAPEM = ""
+	s, err = NewServiceFromConfig(cfg)
+	assert.NoError(t, err, "service created without error")
+	_, err = s.GetCredentialsWithContext(context.Background())
+	assert.Error(t, err, "endpoint certificate not signed by the Amazon Root CA is rejected")
+}
@@ -1,14 +1,18 @@
 package credentials
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"time"
 )
 
+const requestTimeout = 10 * time.Second
+
 // Service is dedicated to get the AWS credentials based on the device X509 certificates. The retrieved credentials
 // can be used to access any AWS Service.
 //
@@ -17,6 +21,7 @@ type Service struct {
 	url       string
 	thingName string
 	tlsCert   tls.Certificate
+	client    *http.Client
 }
 
 // Output the AWS credentials output data structure
@@ -27,6 +32,25 @@ type Output struct {
 	Expiration      string `json:"expiration"`
 }
 
+// ExpiresAt parses the Expiration of the credentials
+func (o Output) ExpiresAt() (time.Time, error) {
+	expiration, err := time.Parse(time.RFC3339, o.Expiration)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse the credentials expiration: %w", err)
+	}
+	return expiration, nil
+}
+
+// StatusError is returned when the credentials provider responds with a status other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("the request has failed with the status code: %d; message: %s", e.StatusCode, e.Message)
+}
+
 // NewService initializes the device certificates based on the provided paths and returns a new instance of the Service.
 //
 // The iotCredentialsURL parameter should satisfy this pattern:
@@ -43,22 +67,35 @@ func NewService(iotCredentialsURL, certPath, privateKeyPath, thingName string) (
 		url:       iotCredentialsURL,
 		thingName: thingName,
 		tlsCert:   tlsCert,
+		client:    newHTTPClient(&tls.Config{Certificates: []tls.Certificate{tlsCert}}, nil),
 	}, nil
 }
 
+func newHTTPClient(tlsConfig *tls.Config, proxy func(*http.Request) (*neturl.URL, error)) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           proxy,
+		},
+		Timeout: requestTimeout,
+	}
+}
+
 // GetCredentials performs the HTTPS request authorized by the device TLS certificates in order to get the AWS credentials.
 // Returns the Output object with the AWS credentials
 func (s Service) GetCredentials() (Output, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{s.tlsCert},
-			},
-		},
-		Timeout: time.Second * 10,
+	return s.GetCredentialsWithContext(context.Background())
+}
+
+// GetCredentialsWithContext is GetCredentials with a context to cancel the request. Responses other than 200 OK are
+// returned as a *StatusError.
+func (s Service) GetCredentialsWithContext(ctx context.Context) (Output, error) {
+	client := s.client
+	if client == nil {
+		client = newHTTPClient(&tls.Config{Certificates: []tls.Certificate{s.tlsCert}}, nil)
 	}
 
-	req, err := http.NewRequest("GET", s.url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
 	if err != nil {
 		return Output{}, fmt.Errorf("failed to create the credentials request: %v", err)
 	}
@@ -67,7 +104,7 @@ func (s Service) GetCredentials() (Output, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return Output{}, fmt.Errorf("failed to perform the GET credentials request: %v", err)
+		return Output{}, fmt.Errorf("failed to perform the GET credentials request: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -76,7 +113,7 @@ func (s Service) GetCredentials() (Output, error) {
 			return Output{}, fmt.Errorf("failed to parse the response body: %v", err)
 		}
 
-		return Output{}, fmt.Errorf("the request has failed with the status code: %d; message: %s", resp.StatusCode, string(body))
+		return Output{}, &StatusError{StatusCode: resp.StatusCode, Message: string(body)}
 	}
 
 	result := struct {
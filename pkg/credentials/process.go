@@ -0,0 +1,23 @@
+package credentials
+
+// ProcessOutput is the credential_process output format of the AWS CLI and SDKs
+//
+// More info here: https://docs.aws.amazon.com/cli/latest/userguide/cli-configure-sourcing-external.html
+type ProcessOutput struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// NewProcessOutput converts the credentials to the credential_process output format
+func NewProcessOutput(creds Output) ProcessOutput {
+	return ProcessOutput{
+		Version:         1,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expiration,
+	}
+}
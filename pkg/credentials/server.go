@@ -0,0 +1,78 @@
+package credentials
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ServerPath is the path the Server serves the credentials on
+const ServerPath = "/credentials"
+
+// ContainerOutput is the credentials format of the ECS container credentials endpoint
+type ContainerOutput struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+// Server serves the credentials like the ECS container credentials endpoint, so the AWS CLI and SDKs of other
+// processes can use them by setting AWS_CONTAINER_CREDENTIALS_FULL_URI to the URL of the server and
+// AWS_CONTAINER_AUTHORIZATION_TOKEN to the token. Requests without the token in the Authorization header are rejected.
+// Use a CachingProvider as the fetcher, so the credentials are rotated before they expire.
+type Server struct {
+	fetcher Fetcher
+	token   string
+}
+
+// NewServer returns a Server for the credentials of the fetcher, protected by the token
+func NewServer(fetcher Fetcher, token string) (*Server, error) {
+	if token == "" {
+		return nil, fmt.Errorf("the credentials server needs an authorization token")
+	}
+	return &Server{fetcher: fetcher, token: token}, nil
+}
+
+// GenerateToken returns a random authorization token for the Server
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the authorization token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != ServerPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, err := s.fetcher.GetCredentialsWithContext(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get credentials: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ContainerOutput{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+		Expiration:      creds.Expiration,
+	})
+}
@@ -0,0 +1,49 @@
+package credentials
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_ServeHTTP(t *testing.T) {
+	token, err := GenerateToken()
+	assert.NoError(t, err, "token generated without error")
+	server, err := NewServer(&fakeFetcher{lifetime: time.Hour}, token)
+	assert.NoError(t, err, "server created without error")
+
+	for _, tc := range []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"authorized", ServerPath, token, http.StatusOK},
+		{"without token", ServerPath, "", http.StatusUnauthorized},
+		{"wrong token", ServerPath, "wrong", http.StatusUnauthorized},
+		{"unknown path", "/", token, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(t, tc.status, rec.Code, tc.name)
+
+		if tc.status == http.StatusOK {
+			out := ContainerOutput{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out), tc.name)
+			assert.Equal(t, "key", out.AccessKeyID, tc.name)
+			assert.Equal(t, "secret", out.SecretAccessKey, tc.name)
+			assert.NotEmpty(t, out.Expiration, tc.name)
+		}
+	}
+
+	_, err = NewServer(&fakeFetcher{}, "")
+	assert.Error(t, err, "server without token is rejected")
+}
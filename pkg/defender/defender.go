@@ -0,0 +1,293 @@
+package defender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+)
+
+// Format is the encoding of the metrics reports
+type Format string
+
+const (
+	// FormatJSON publishes the reports as JSON with long metric names
+	FormatJSON Format = "json"
+	// FormatCBOR publishes the reports as CBOR with short metric names
+	FormatCBOR Format = "cbor"
+
+	// MinInterval is the shortest reporting interval accepted by Device Defender
+	MinInterval = 5 * time.Minute
+
+	reportVersion = "1.0"
+)
+
+// customMetricNamePattern matches the names AWS IoT accepts for custom metrics
+var customMetricNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_-]{1,128}$`)
+
+// Report is a Device Defender metrics report
+//
+// More info here: https://docs.aws.amazon.com/iot/latest/developerguide/detect-device-side-metrics.html
+type Report struct {
+	Header        Header                         `json:"header" cbor:"hed"`
+	Metrics       Metrics                        `json:"metrics" cbor:"met"`
+	CustomMetrics map[string][]CustomMetricValue `json:"custom_metrics,omitempty" cbor:"cmet,omitempty"`
+}
+
+// Header identifies a metrics report
+type Header struct {
+	ReportID int64  `json:"report_id" cbor:"rid"`
+	Version  string `json:"version" cbor:"v"`
+}
+
+// Metrics holds the network metrics of a report
+type Metrics struct {
+	ListeningTCPPorts *ListeningPorts `json:"listening_tcp_ports,omitempty" cbor:"tp,omitempty"`
+	ListeningUDPPorts *ListeningPorts `json:"listening_udp_ports,omitempty" cbor:"up,omitempty"`
+	NetworkStats      *NetworkStats   `json:"network_stats,omitempty" cbor:"ns,omitempty"`
+	TCPConnections    *TCPConnections `json:"tcp_connections,omitempty" cbor:"tc,omitempty"`
+}
+
+// ListeningPorts holds the ports the device listens on
+type ListeningPorts struct {
+	Ports []Port `json:"ports" cbor:"pts"`
+	Total int    `json:"total" cbor:"t"`
+}
+
+// Port is a listening port, the interface is empty for sockets bound to all interfaces
+type Port struct {
+	Port      int    `json:"port" cbor:"pt"`
+	Interface string `json:"interface,omitempty" cbor:"if,omitempty"`
+}
+
+// NetworkStats holds the traffic of all non-loopback interfaces since the previous report
+type NetworkStats struct {
+	BytesIn    uint64 `json:"bytes_in" cbor:"bi"`
+	BytesOut   uint64 `json:"bytes_out" cbor:"bo"`
+	PacketsIn  uint64 `json:"packets_in" cbor:"pi"`
+	PacketsOut uint64 `json:"packets_out" cbor:"po"`
+}
+
+// TCPConnections holds the TCP connection metrics
+type TCPConnections struct {
+	EstablishedConnections *EstablishedConnections `json:"established_connections" cbor:"ec"`
+}
+
+// EstablishedConnections holds the established TCP connections
+type EstablishedConnections struct {
+	Connections []Connection `json:"connections" cbor:"cs"`
+	Total       int          `json:"total" cbor:"t"`
+}
+
+// Connection is an established TCP connection
+type Connection struct {
+	RemoteAddr     string `json:"remote_addr" cbor:"rad"`
+	LocalPort      int    `json:"local_port,omitempty" cbor:"lp,omitempty"`
+	LocalInterface string `json:"local_interface,omitempty" cbor:"li,omitempty"`
+}
+
+// CustomMetricValue is the value of a custom metric, only the field matching the metric type must be set
+type CustomMetricValue struct {
+	Number     *float64  `json:"number,omitempty" cbor:"number,omitempty"`
+	NumberList []float64 `json:"number_list,omitempty" cbor:"number_list,omitempty"`
+	StringList []string  `json:"string_list,omitempty" cbor:"string_list,omitempty"`
+	IPList     []string  `json:"ip_list,omitempty" cbor:"ip_list,omitempty"`
+}
+
+// CustomMetricFunc returns the current value of a custom metric
+type CustomMetricFunc func() (CustomMetricValue, error)
+
+// Response is the accepted or rejected response to a metrics report
+type Response struct {
+	ThingName     string         `json:"thingName"`
+	ReportID      int64          `json:"reportId"`
+	Status        string         `json:"status"`
+	Timestamp     int64          `json:"timestamp"`
+	StatusDetails *StatusDetails `json:"statusDetails,omitempty"`
+}
+
+// StatusDetails explains why a metrics report was rejected
+type StatusDetails struct {
+	ErrorCode    string `json:"ErrorCode"`
+	ErrorMessage string `json:"ErrorMessage"`
+}
+
+// Config holds the options of a Client
+type Config struct {
+	// Format defaults to FormatJSON
+	Format Format
+	// Interval between reports in Run, defaults to MinInterval
+	Interval time.Duration
+	// OnAccepted is called for every accepted report
+	OnAccepted func(Response)
+	// OnRejected is called for every rejected report
+	OnRejected func(Response)
+	// OnError is called with errors that happen outside of a caller's request, e.g. in Run or decoding responses
+	OnError func(error)
+	// ProcNetPath is where the socket tables and interface counters are read from, defaults to /proc/net
+	ProcNetPath string
+}
+
+// Client publishes Device Defender metrics reports for a thing
+type Client struct {
+	thing  *thing.Thing
+	cfg    Config
+	codec  codec.Codec
+	topic  string
+	mu     sync.Mutex
+	custom map[string]CustomMetricFunc
+	last   *interfaceCounters
+	lastID int64
+}
+
+// NewClient returns a new instance of Client and subscribes for the report responses
+func NewClient(th *thing.Thing, cfg Config) (*Client, error) {
+	if cfg.Format == "" {
+		cfg.Format = FormatJSON
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = MinInterval
+	}
+	if cfg.Interval < MinInterval {
+		return nil, fmt.Errorf("report interval %s is shorter than the minimum of %s", cfg.Interval, MinInterval)
+	}
+	if cfg.ProcNetPath == "" {
+		cfg.ProcNetPath = "/proc/net"
+	}
+
+	c, err := codec.ByName(string(cfg.Format))
+	if err != nil || cfg.Format == "protobuf" {
+		return nil, fmt.Errorf("unsupported report format %q", cfg.Format)
+	}
+
+	client := &Client{
+		thing:  th,
+		cfg:    cfg,
+		codec:  c,
+		topic:  fmt.Sprintf("$aws/things/%s/defender/metrics/%s", th.Name(), cfg.Format),
+		custom: make(map[string]CustomMetricFunc),
+	}
+
+	onDecodeError := func(topic string, payload thing.Payload, err error) {
+		client.handleError(fmt.Errorf("failed to decode report response on %s: %w", topic, err))
+	}
+	if err := th.SubscribeForCustomTopicDecoded(client.topic+"/accepted", c, func(r Response) {
+		if cfg.OnAccepted != nil {
+			cfg.OnAccepted(r)
+		}
+	}, onDecodeError); err != nil {
+		return nil, err
+	}
+	if err := th.SubscribeForCustomTopicDecoded(client.topic+"/rejected", c, func(r Response) {
+		if cfg.OnRejected != nil {
+			cfg.OnRejected(r)
+		}
+	}, onDecodeError); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// RegisterCustomMetric adds a custom metric to every report. The metric must also be created in AWS IoT with
+// CreateCustomMetric.
+func (c *Client) RegisterCustomMetric(name string, collect CustomMetricFunc) error {
+	if !customMetricNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid custom metric name %q", name)
+	}
+	if collect == nil {
+		return errors.New("custom metric collector is required")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.custom[name] = collect
+	return nil
+}
+
+// Collect builds a metrics report from the current network state and custom metrics. Network stats are the difference
+// to the previous report, so the first report carries none.
+func (c *Client) Collect() (*Report, error) {
+	metrics, counters, err := collectNetworkMetrics(c.cfg.ProcNetPath, interfaceAddresses())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last != nil && counters.BytesIn >= c.last.BytesIn && counters.BytesOut >= c.last.BytesOut &&
+		counters.PacketsIn >= c.last.PacketsIn && counters.PacketsOut >= c.last.PacketsOut {
+		metrics.NetworkStats = &NetworkStats{
+			BytesIn:    counters.BytesIn - c.last.BytesIn,
+			BytesOut:   counters.BytesOut - c.last.BytesOut,
+			PacketsIn:  counters.PacketsIn - c.last.PacketsIn,
+			PacketsOut: counters.PacketsOut - c.last.PacketsOut,
+		}
+	}
+	c.last = &counters
+
+	// report ids must increase from one report to the next
+	reportID := time.Now().UnixNano() / int64(time.Millisecond)
+	if reportID <= c.lastID {
+		reportID = c.lastID + 1
+	}
+	c.lastID = reportID
+
+	report := &Report{
+		Header:  Header{ReportID: reportID, Version: reportVersion},
+		Metrics: metrics,
+	}
+
+	if len(c.custom) > 0 {
+		report.CustomMetrics = make(map[string][]CustomMetricValue, len(c.custom))
+		for name, collect := range c.custom {
+			value, err := collect()
+			if err != nil {
+				return nil, fmt.Errorf("failed to collect custom metric %s: %w", name, err)
+			}
+			report.CustomMetrics[name] = []CustomMetricValue{value}
+		}
+	}
+
+	return report, nil
+}
+
+// Publish collects and publishes a metrics report. The response is delivered to OnAccepted or OnRejected.
+func (c *Client) Publish() error {
+	report, err := c.Collect()
+	if err != nil {
+		return err
+	}
+	return c.thing.PublishValue(c.topic, report, c.codec)
+}
+
+// Run publishes a metrics report every interval until the context is cancelled. Failed reports are passed to
+// OnError and do not stop the loop.
+func (c *Client) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Publish(); err != nil {
+			c.handleError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) handleError(err error) {
+	if c.cfg.OnError != nil {
+		c.cfg.OnError(err)
+	}
+}
@@ -0,0 +1,248 @@
+package defender
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// socket states from include/net/tcp_states.h as they appear in /proc/net/{tcp,udp}
+const (
+	tcpEstablished = "01"
+	tcpListen      = "0A"
+	udpUnconnected = "07"
+)
+
+// socketEntry is a line of /proc/net/{tcp,tcp6,udp,udp6}
+type socketEntry struct {
+	LocalIP    net.IP
+	LocalPort  int
+	RemoteIP   net.IP
+	RemotePort int
+	State      string
+}
+
+// interfaceCounters holds the totals of the non-loopback interfaces from /proc/net/dev
+type interfaceCounters struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+// collectNetworkMetrics reads the socket tables and interface counters below procNet (usually /proc/net). The
+// interfaces map resolves local IP addresses to interface names.
+func collectNetworkMetrics(procNet string, interfaces map[string]string) (Metrics, interfaceCounters, error) {
+	metrics := Metrics{}
+
+	var tcp, udp []socketEntry
+	for _, name := range []string{"tcp", "tcp6"} {
+		entries, err := readSocketFile(filepath.Join(procNet, name))
+		if err != nil {
+			return Metrics{}, interfaceCounters{}, err
+		}
+		tcp = append(tcp, entries...)
+	}
+	for _, name := range []string{"udp", "udp6"} {
+		entries, err := readSocketFile(filepath.Join(procNet, name))
+		if err != nil {
+			return Metrics{}, interfaceCounters{}, err
+		}
+		udp = append(udp, entries...)
+	}
+
+	metrics.ListeningTCPPorts = listeningPorts(tcp, tcpListen, interfaces)
+	metrics.ListeningUDPPorts = listeningPorts(udp, udpUnconnected, interfaces)
+
+	established := &EstablishedConnections{Connections: []Connection{}}
+	for _, e := range tcp {
+		if e.State != tcpEstablished {
+			continue
+		}
+		established.Connections = append(established.Connections, Connection{
+			RemoteAddr:     net.JoinHostPort(e.RemoteIP.String(), strconv.Itoa(e.RemotePort)),
+			LocalPort:      e.LocalPort,
+			LocalInterface: interfaces[e.LocalIP.String()],
+		})
+	}
+	established.Total = len(established.Connections)
+	metrics.TCPConnections = &TCPConnections{EstablishedConnections: established}
+
+	f, err := os.Open(filepath.Join(procNet, "dev"))
+	if err != nil {
+		return Metrics{}, interfaceCounters{}, fmt.Errorf("failed to open interface counters: %w", err)
+	}
+	defer f.Close()
+
+	counters, err := parseInterfaceCounters(f)
+	if err != nil {
+		return Metrics{}, interfaceCounters{}, err
+	}
+	return metrics, counters, nil
+}
+
+// listeningPorts returns the ports of the sockets in the given state, skipping duplicates from dual-stack sockets
+func listeningPorts(entries []socketEntry, state string, interfaces map[string]string) *ListeningPorts {
+	ports := []Port{}
+	seen := map[Port]bool{}
+	for _, e := range entries {
+		if e.State != state {
+			continue
+		}
+		p := Port{Port: e.LocalPort, Interface: interfaces[e.LocalIP.String()]}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].Interface < ports[j].Interface
+	})
+	return &ListeningPorts{Ports: ports, Total: len(ports)}
+}
+
+// readSocketFile parses a socket table, a missing file (e.g. no IPv6 support) is treated as empty
+func readSocketFile(path string) ([]socketEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open socket table: %w", err)
+	}
+	defer f.Close()
+
+	entries, err := parseSocketTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// parseSocketTable parses the contents of /proc/net/{tcp,tcp6,udp,udp6}
+func parseSocketTable(r io.Reader) ([]socketEntry, error) {
+	entries := []socketEntry{}
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		if first {
+			// skip the header line
+			first = false
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		localIP, localPort, err := parseSocketAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		remoteIP, remotePort, err := parseSocketAddress(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, socketEntry{
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			State:      strings.ToUpper(fields[3]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// parseSocketAddress parses an "ADDRESS:PORT" pair where the address is hex encoded in 32 bit host-order (little
+// endian) words and the port is hex encoded in network order
+func parseSocketAddress(s string) (net.IP, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("malformed socket address %q", s)
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("malformed socket address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed socket port %q", s)
+	}
+	return ip, int(port), nil
+}
+
+// parseInterfaceCounters sums the receive and transmit counters of /proc/net/dev, leaving out the loopback interface
+func parseInterfaceCounters(r io.Reader) (interfaceCounters, error) {
+	counters := interfaceCounters{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			// header lines
+			continue
+		}
+		name := strings.TrimSpace(line[:colon])
+		if name == "lo" {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) < 10 {
+			return interfaceCounters{}, fmt.Errorf("malformed interface counters for %s", name)
+		}
+		values := make([]uint64, 10)
+		for _, i := range []int{0, 1, 8, 9} {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return interfaceCounters{}, fmt.Errorf("malformed interface counters for %s: %w", name, err)
+			}
+			values[i] = v
+		}
+		counters.BytesIn += values[0]
+		counters.PacketsIn += values[1]
+		counters.BytesOut += values[8]
+		counters.PacketsOut += values[9]
+	}
+	return counters, scanner.Err()
+}
+
+// interfaceAddresses maps the IP addresses of the local interfaces to the interface names
+func interfaceAddresses() map[string]string {
+	addresses := map[string]string{}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return addresses
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addresses[ipnet.IP.String()] = iface.Name
+			}
+		}
+	}
+	return addresses
+}
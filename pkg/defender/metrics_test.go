@@ -0,0 +1,39 @@
+package defender
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectNetworkMetrics(t *testing.T) {
+	interfaces := map[string]string{"10.0.0.10": "eth0", "127.0.0.1": "lo"}
+
+	metrics, counters, err := collectNetworkMetrics("./testdata/proc/net", interfaces)
+	assert.NoError(t, err, "network metrics collected without error")
+
+	assert.Equal(t, []Port{{Port: 22}, {Port: 3306, Interface: "lo"}}, metrics.ListeningTCPPorts.Ports,
+		"dual-stack listeners are reported once")
+	assert.Equal(t, 2, metrics.ListeningTCPPorts.Total)
+	assert.Equal(t, []Port{{Port: 68}}, metrics.ListeningUDPPorts.Ports)
+
+	assert.Equal(t, []Connection{{RemoteAddr: "10.0.0.2:54321", LocalPort: 22, LocalInterface: "eth0"}},
+		metrics.TCPConnections.EstablishedConnections.Connections)
+
+	assert.Equal(t, interfaceCounters{BytesIn: 1500, BytesOut: 2700, PacketsIn: 15, PacketsOut: 27}, counters,
+		"loopback traffic is left out")
+}
+
+func TestParseSocketAddress(t *testing.T) {
+	ip, port, err := parseSocketAddress("0100007F:1F90")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String())
+	assert.Equal(t, 8080, port)
+
+	ip, _, err = parseSocketAddress("0000000000000000FFFF00000100007F:0016")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String(), "IPv4-mapped IPv6 addresses are reported as IPv4")
+
+	_, _, err = parseSocketAddress("nonsense")
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package identity
+
+import (
+	"log"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
+	"github.com/spf13/cobra"
+)
+
+var (
+	spec   string
+	policy = networking.DefaultSelectionPolicy()
+)
+
+func init() {
+	GetUniqueIDCmd.PersistentFlags().StringVar(&spec, "identity", DefaultSpec, "The unique ID source: a comma separated fallback chain of mac[:<interface>], eui64[:<interface>], machine-id, dmi-serial, cpu-serial and file:<path>")
+	networking.AddSelectionPolicyFlags(GetUniqueIDCmd.PersistentFlags(), &policy)
+}
+
+// GetUniqueIDCmd gets the unique ID of the device
+var GetUniqueIDCmd = &cobra.Command{
+	Use:   "get-unique-id",
+	Short: "Gets the unique ID of the device",
+	Long:  `Gets the unique ID of the device used as UniqueId when provisioning and to name the thing`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		provider, err := ParseWithPolicy(spec, &policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uniqueID, err := provider.ID()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Unique ID: %s\n", uniqueID)
+		log.Printf("Identity: %s\n", provider.Name())
+	},
+}
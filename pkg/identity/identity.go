@@ -0,0 +1,296 @@
+package identity
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
+)
+
+const (
+	// DefaultSpec derives the unique ID from the MAC address like earlier releases did
+	DefaultSpec = "eui64"
+
+	defaultMachineIDPath = "/etc/machine-id"
+	dbusMachineIDPath    = "/var/lib/dbus/machine-id"
+	defaultDMISerialPath = "/sys/class/dmi/id/product_serial"
+	defaultCPUInfoPath   = "/proc/cpuinfo"
+)
+
+// ErrNotAvailable is returned by providers that cannot find an identifier on this device
+var ErrNotAvailable = errors.New("identifier not available")
+
+// placeholderSerials are values firmware vendors leave in the DMI serial instead of a real serial number
+var placeholderSerials = map[string]bool{
+	"":                       true,
+	"0":                      true,
+	"none":                   true,
+	"default string":         true,
+	"to be filled by o.e.m.": true,
+	"system serial number":   true,
+	"not specified":          true,
+	"0123456789":             true,
+}
+
+// Provider returns a stable identifier of the device
+type Provider interface {
+	ID() (string, error)
+	Name() string
+}
+
+// MAC uses the MAC address of an interface. Without an interface name the interface is chosen by the policy, which
+// defaults to networking.DefaultSelectionPolicy. With EUI64 set, "fffe" is inserted in the middle of the address.
+type MAC struct {
+	Interface string
+	EUI64     bool
+	Policy    *networking.SelectionPolicy
+}
+
+// ID implements Provider
+func (p MAC) ID() (string, error) {
+	var mac string
+	if p.Interface == "" {
+		policy := networking.DefaultSelectionPolicy()
+		if p.Policy != nil {
+			policy = *p.Policy
+		}
+		address, _, err := policy.Select()
+		if err != nil {
+			return "", err
+		}
+		mac = string(address)
+	} else {
+		address, err := networking.GetInterfaceMACAddress(p.Interface)
+		if err != nil {
+			return "", err
+		}
+		mac = string(address)
+	}
+
+	if p.EUI64 {
+		return EUI64(mac)
+	}
+	if err := networking.ValidateMACAddress(mac); err != nil {
+		return "", err
+	}
+	return mac, nil
+}
+
+// Name implements Provider
+func (p MAC) Name() string {
+	name := "mac"
+	if p.EUI64 {
+		name = "eui64"
+	}
+	if p.Interface != "" {
+		name += ":" + p.Interface
+	}
+	return name
+}
+
+// EUI64 turns a 48 bit MAC address of 12 hex digits without separators into the 64 bit identifier used as UniqueId
+func EUI64(mac string) (string, error) {
+	return networking.EUI64(mac)
+}
+
+// MachineID uses the systemd machine ID, falling back to the D-Bus machine ID without a path
+type MachineID struct {
+	Path string
+}
+
+// ID implements Provider
+func (p MachineID) ID() (string, error) {
+	if p.Path != "" {
+		return readID(p.Path)
+	}
+	id, err := readID(defaultMachineIDPath)
+	if errors.Is(err, ErrNotAvailable) {
+		return readID(dbusMachineIDPath)
+	}
+	return id, err
+}
+
+// Name implements Provider
+func (p MachineID) Name() string {
+	return "machine-id"
+}
+
+// DMISerial uses the product serial number from the DMI tables of the firmware. Reading it usually requires root.
+type DMISerial struct {
+	Path string
+}
+
+// ID implements Provider
+func (p DMISerial) ID() (string, error) {
+	path := p.Path
+	if path == "" {
+		path = defaultDMISerialPath
+	}
+	id, err := readID(path)
+	if err != nil {
+		return "", err
+	}
+	if placeholderSerials[strings.ToLower(id)] {
+		return "", fmt.Errorf("%s holds the placeholder %q: %w", path, id, ErrNotAvailable)
+	}
+	return id, nil
+}
+
+// Name implements Provider
+func (p DMISerial) Name() string {
+	return "dmi-serial"
+}
+
+// CPUSerial uses the Serial line of /proc/cpuinfo, which Raspberry Pi and other ARM boards fill with the SoC serial
+type CPUSerial struct {
+	Path string
+}
+
+// ID implements Provider
+func (p CPUSerial) ID() (string, error) {
+	path := p.Path
+	if path == "" {
+		path = defaultCPUInfoPath
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", path, ErrNotAvailable)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "Serial" {
+			continue
+		}
+		serial := strings.TrimSpace(value)
+		if strings.Trim(serial, "0") == "" {
+			return "", fmt.Errorf("%s has an empty serial: %w", path, ErrNotAvailable)
+		}
+		return serial, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return "", fmt.Errorf("%s has no serial: %w", path, ErrNotAvailable)
+}
+
+// Name implements Provider
+func (p CPUSerial) Name() string {
+	return "cpu-serial"
+}
+
+// File uses the trimmed content of a file, e.g. a serial number written during manufacturing
+type File struct {
+	Path string
+}
+
+// ID implements Provider
+func (p File) ID() (string, error) {
+	return readID(p.Path)
+}
+
+// Name implements Provider
+func (p File) Name() string {
+	return "file:" + p.Path
+}
+
+// Chain uses the first provider that returns an identifier
+type Chain []Provider
+
+// ID implements Provider
+func (c Chain) ID() (string, error) {
+	var errs []string
+	for _, p := range c {
+		id, err := p.ID()
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", p.Name(), err))
+	}
+	return "", fmt.Errorf("no identifier available (%s): %w", strings.Join(errs, "; "), ErrNotAvailable)
+}
+
+// Name implements Provider
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Parse returns the provider for a spec. A spec is a comma separated fallback chain of mac[:<interface>],
+// eui64[:<interface>], machine-id, dmi-serial, cpu-serial and file:<path>, e.g. "cpu-serial,machine-id".
+func Parse(spec string) (Provider, error) {
+	return ParseWithPolicy(spec, nil)
+}
+
+// ParseWithPolicy is Parse with the policy choosing the interface of mac and eui64 without an interface name. A nil
+// policy uses networking.DefaultSelectionPolicy.
+func ParseWithPolicy(spec string, policy *networking.SelectionPolicy) (Provider, error) {
+	var chain Chain
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		kind, arg, _ := cut(part, ":")
+
+		var p Provider
+		switch kind {
+		case "mac":
+			p = MAC{Interface: arg, Policy: policy}
+		case "eui64":
+			p = MAC{Interface: arg, EUI64: true, Policy: policy}
+		case "machine-id":
+			p = MachineID{Path: arg}
+		case "dmi-serial":
+			p = DMISerial{Path: arg}
+		case "cpu-serial":
+			p = CPUSerial{Path: arg}
+		case "file":
+			if arg == "" {
+				return nil, errors.New("file identity needs a path")
+			}
+			p = File{Path: arg}
+		default:
+			return nil, fmt.Errorf("unknown identity %q", part)
+		}
+		chain = append(chain, p)
+	}
+
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// readID reads the trimmed content of the file, reporting missing and empty files as ErrNotAvailable
+func readID(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", path, ErrNotAvailable)
+	}
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", fmt.Errorf("%s is empty: %w", path, ErrNotAvailable)
+	}
+	return id, nil
+}
+
+// cut splits s around the first separator
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
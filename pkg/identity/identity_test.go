@@ -0,0 +1,52 @@
+package identity_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviders(t *testing.T) {
+	id, err := identity.CPUSerial{Path: "testdata/cpuinfo"}.ID()
+	assert.NoError(t, err, "cpu serial read without error")
+	assert.Equal(t, "00000000a1b2c3d4", id)
+
+	id, err = identity.MachineID{Path: "testdata/machine-id"}.ID()
+	assert.NoError(t, err, "machine id read without error")
+	assert.Equal(t, "4c4c4544004e3510804bb4c04f4a4d32", id)
+
+	_, err = identity.DMISerial{Path: "testdata/product_serial"}.ID()
+	assert.True(t, errors.Is(err, identity.ErrNotAvailable), "placeholder serials are not used")
+
+	_, err = identity.File{Path: "testdata/missing"}.ID()
+	assert.True(t, errors.Is(err, identity.ErrNotAvailable), "missing files are not available")
+
+	id, err = identity.EUI64("001122334455")
+	assert.NoError(t, err)
+	assert.Equal(t, "001122fffe334455", id)
+	for _, mac := range []string{"", "0011", "00112233445566", "00112233445g", "00:11:22:33:44"} {
+		_, err = identity.EUI64(mac)
+		assert.Error(t, err, "invalid MAC address %q rejected", mac)
+	}
+}
+
+func TestParse(t *testing.T) {
+	provider, err := identity.Parse("dmi-serial:testdata/product_serial, file:testdata/missing, cpu-serial:testdata/cpuinfo")
+	assert.NoError(t, err, "spec parsed without error")
+	assert.Equal(t, "dmi-serial,file:testdata/missing,cpu-serial", provider.Name())
+
+	id, err := provider.ID()
+	assert.NoError(t, err, "the chain falls back to the first available identifier")
+	assert.Equal(t, "00000000a1b2c3d4", id)
+
+	provider, err = identity.Parse(identity.DefaultSpec)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.MAC{EUI64: true}, provider)
+
+	_, err = identity.Parse("serial-number")
+	assert.Error(t, err, "unknown identities are rejected")
+	_, err = identity.Parse("file:")
+	assert.Error(t, err, "file identities need a path")
+}
@@ -18,35 +18,42 @@ func MakeMQTTClient(keyPair models.KeyPair, awsEndpoint, clientID string) (mqtt.
 		return nil, fmt.Errorf("failed to load the certificates: %v", err)
 	}
 
-	certs := x509.NewCertPool()
-
-	caPem, err := ioutil.ReadFile(keyPair.CACertificatePath)
+	certs, err := LoadCertPool(keyPair.CACertificatePath)
 	if err != nil {
 		return nil, err
 	}
 
-	certs.AppendCertsFromPEM(caPem)
-
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		RootCAs:      certs,
 	}
 
+	c := mqtt.NewClient(NewClientOptions(awsEndpoint, clientID, tlsConfig))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return c, nil
+}
+
+// LoadCertPool returns a pool of the CA certificates in the PEM file
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	caPem, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	awsServerURL := fmt.Sprintf("ssl://%s:8883", awsEndpoint)
+	certs := x509.NewCertPool()
+	certs.AppendCertsFromPEM(caPem)
+	return certs, nil
+}
 
+// NewClientOptions returns the options of the MQTT clients connecting to the AWS IoT endpoint with the TLS config,
+// which holds the device certificate and the root CA
+func NewClientOptions(awsEndpoint, clientID string, tlsConfig *tls.Config) *mqtt.ClientOptions {
 	mqttOpts := mqtt.NewClientOptions()
-	mqttOpts.AddBroker(awsServerURL)
+	mqttOpts.AddBroker(fmt.Sprintf("ssl://%s:8883", awsEndpoint))
 	mqttOpts.SetMaxReconnectInterval(1 * time.Second)
 	mqttOpts.SetClientID(clientID)
 	mqttOpts.SetTLSConfig(tlsConfig)
-
-	c := mqtt.NewClient(mqttOpts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
-	}
-	return c, nil
+	return mqttOpts
 }
@@ -4,8 +4,26 @@ import (
 	"log"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+var policy = DefaultSelectionPolicy()
+
+func init() {
+	AddSelectionPolicyFlags(GetMACAddressCmd.PersistentFlags(), &policy)
+}
+
+// AddSelectionPolicyFlags adds the flags of the interface selection policy to the flag set, defaulting to the current
+// values of the policy
+func AddSelectionPolicyFlags(flags *pflag.FlagSet, policy *SelectionPolicy) {
+	flags.StringSliceVar(&policy.Allow, "interface-allow", policy.Allow, "Only select interfaces matching these name patterns for the MAC address")
+	flags.StringSliceVar(&policy.Deny, "interface-deny", policy.Deny, "Never select interfaces matching these name patterns for the MAC address")
+	flags.StringSliceVar(&policy.Prefer, "interface-prefer", policy.Prefer, "Select these interfaces first for the MAC address, in order")
+	flags.BoolVar(&policy.PreferPhysical, "prefer-physical", policy.PreferPhysical, "Ignore virtual, bridge and veth interfaces unless no other interface is left")
+	flags.BoolVar(&policy.RequireIPv4, "require-ipv4", policy.RequireIPv4, "Only select interfaces with an IPv4 address")
+	flags.StringVar(&policy.PinFile, "interface-pin-file", policy.PinFile, "Persist the first selected interface in this file and always use it afterwards")
+}
+
 // GetMACAddressCmd gets the MAC address of the device
 var GetMACAddressCmd = &cobra.Command{
 	Use:   "get-mac-address",
@@ -13,11 +31,14 @@ var GetMACAddressCmd = &cobra.Command{
 	Long:  `Gets the MAC address of the device`,
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		macAddress, interfaceName, err := GetMACAddress()
+		macAddress, interfaceName, err := policy.Select()
+		if err != nil {
+			log.Fatal(err)
+		}
+		uniqueID, err := EUI64(string(macAddress))
 		if err != nil {
 			log.Fatal(err)
 		}
-		uniqueID := macAddress[:6] + "fffe" + macAddress[6:]
 		log.Printf("MAC Address: %s\n", macAddress)
 		log.Printf("Unique ID: %s\n", uniqueID)
 		log.Printf("Interface Name: %s\n", interfaceName)
@@ -1,87 +1,260 @@
 package networking
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
 type macAddress string
 type interfaceName string
 
+// virtualInterfacePatterns match the names of bridges, container and VPN interfaces when sysfs is not available
+var virtualInterfacePatterns = []string{
+	"lo", "docker*", "br-*", "br[0-9]*", "virbr*", "veth*", "vnet*", "vmnet*", "cni*", "flannel*", "cali*", "weave*",
+	"tun*", "tap*", "wg*", "zt*", "tailscale*", "dummy*", "bond*", "team*",
+}
+
+// Interface is a network interface considered by a SelectionPolicy
+type Interface struct {
+	Name         string
+	HardwareAddr net.HardwareAddr
+	HasIPv4      bool
+	// Physical is false for virtual, bridge and veth interfaces
+	Physical bool
+}
+
+// SelectionPolicy picks the interface whose MAC address identifies the device
+type SelectionPolicy struct {
+	// Allow holds interface name patterns, see path.Match. Without patterns all interfaces are allowed.
+	Allow []string
+	// Deny holds interface name patterns that are never selected
+	Deny []string
+	// Prefer holds interface names that are selected first, in order
+	Prefer []string
+	// PreferPhysical ignores virtual, bridge and veth interfaces unless no physical interface is left
+	PreferPhysical bool
+	// RequireIPv4 only selects interfaces with an IPv4 address
+	RequireIPv4 bool
+	// PinFile persists the first selection. Once it exists, its interface and MAC address are returned without looking
+	// at the interfaces again, so the identity of the device never drifts.
+	PinFile string
+}
+
+// pin is the content of SelectionPolicy.PinFile
+type pin struct {
+	Interface  string `json:"interface"`
+	MACAddress string `json:"macAddress"`
+}
+
+// DefaultSelectionPolicy returns the policy used by GetMACAddress: eth0 if present, otherwise the first physical
+// interface with an IPv4 address sorted by name. Bridges, container and VPN interfaces such as docker0 come and go and
+// carry random MAC addresses, so they are only selected when no physical interface has an IPv4 address.
+func DefaultSelectionPolicy() SelectionPolicy {
+	return SelectionPolicy{
+		Prefer:         []string{"eth0"},
+		PreferPhysical: true,
+		RequireIPv4:    true,
+	}
+}
+
 // GetMACAddress returns the MAC address of the current machine.
 func GetMACAddress() (macAddress, interfaceName, error) {
+	return DefaultSelectionPolicy().Select()
+}
 
-	//----------------------
-	// Get the local machine IP address
-	// https://www.socketloop.com/tutorials/golang-how-do-I-get-the-local-ip-non-loopback-address
-	//----------------------
+// Select returns the MAC address and name of the interface chosen by the policy
+func (p SelectionPolicy) Select() (macAddress, interfaceName, error) {
+	if p.PinFile != "" {
+		data, err := ioutil.ReadFile(p.PinFile)
+		if err == nil {
+			pinned := pin{}
+			if err := json.Unmarshal(data, &pinned); err != nil {
+				return "", "", fmt.Errorf("error reading interface pin: %v", err)
+			}
+			if err := ValidateMACAddress(pinned.MACAddress); err != nil {
+				return "", "", fmt.Errorf("error reading interface pin %s: %v", p.PinFile, err)
+			}
+			return macAddress(pinned.MACAddress), interfaceName(pinned.Interface), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", fmt.Errorf("error reading interface pin: %v", err)
+		}
+	}
 
-	addrs, err := net.InterfaceAddrs()
+	interfaces, err := Interfaces()
+	if err != nil {
+		return "", "", err
+	}
+	chosen, err := p.Choose(interfaces)
 	if err != nil {
-		return "", "", fmt.Errorf("error getting local IP address: %v", err)
+		return "", "", err
 	}
+	mac := strings.Replace(chosen.HardwareAddr.String(), ":", "", -1)
 
-	var currentIP, currentNetworkHardwareName, eth0IP string
+	if p.PinFile != "" {
+		if err := writePin(p.PinFile, pin{Interface: chosen.Name, MACAddress: mac}); err != nil {
+			return "", "", err
+		}
+	}
+	return macAddress(mac), interfaceName(chosen.Name), nil
+}
 
-	ipv4Addresses := []string{}
-	for _, address := range addrs {
-		// check the address type and if it is not a loopback the display it
-		// = GET LOCAL IP ADDRESS
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				currentIP = ipnet.IP.String()
-				ipv4Addresses = append(ipv4Addresses, currentIP)
-			}
+// Choose returns the interface the policy selects from the given interfaces. Interfaces without a 6 byte MAC address,
+// such as tunnels or InfiniBand interfaces, are never selected. The choice only depends on the interface names and properties, not on their order.
+func (p SelectionPolicy) Choose(interfaces []Interface) (Interface, error) {
+	var candidates []Interface
+	for _, iface := range interfaces {
+		if len(iface.HardwareAddr) != 6 || (p.RequireIPv4 && !iface.HasIPv4) {
+			continue
 		}
+		if len(p.Allow) > 0 && !matchAny(p.Allow, iface.Name) {
+			continue
+		}
+		if matchAny(p.Deny, iface.Name) {
+			continue
+		}
+		candidates = append(candidates, iface)
 	}
 
-	interfacesWithIPv4Addresses := []string{}
-	// get all the system's or local machine's network interfaces
-	interfaces, _ := net.Interfaces()
-	for _, interf := range interfaces {
-		for _, ip := range ipv4Addresses {
-			if addrs, err := interf.Addrs(); err == nil {
-				for _, addr := range addrs {
-					// only interested in the name with current IP address
-					if strings.Contains(addr.String(), ip) {
-						currentNetworkHardwareName = interf.Name
-						interfacesWithIPv4Addresses = append(interfacesWithIPv4Addresses, currentNetworkHardwareName)
-						if currentNetworkHardwareName == "eth0" {
-							eth0IP = ip
-						}
-					}
-				}
+	if p.PreferPhysical {
+		var physical []Interface
+		for _, iface := range candidates {
+			if iface.Physical {
+				physical = append(physical, iface)
 			}
 		}
+		if len(physical) > 0 {
+			candidates = physical
+		}
 	}
 
-	if len(interfacesWithIPv4Addresses) == 0 {
-		return "", "", fmt.Errorf("no ipv4 network interface found")
+	if len(candidates) == 0 {
+		if p.RequireIPv4 {
+			return Interface{}, fmt.Errorf("no ipv4 network interface found")
+		}
+		return Interface{}, fmt.Errorf("no network interface found")
 	}
 
-	if eth0IP != "" {
-		// default to using eth0 if it's present
-		currentNetworkHardwareName = "eth0"
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri, rj := p.preferRank(candidates[i].Name), p.preferRank(candidates[j].Name)
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0], nil
+}
+
+// preferRank returns the position of the name in Prefer, or len(Prefer) for names that are not preferred
+func (p SelectionPolicy) preferRank(name string) int {
+	for i, preferred := range p.Prefer {
+		if preferred == name {
+			return i
+		}
 	}
+	return len(p.Prefer)
+}
 
-	// extract the hardware information base on the interface name
-	// capture above
-	netInterface, err := net.InterfaceByName(currentNetworkHardwareName)
+// Interfaces returns the network interfaces of the machine except loopback interfaces
+func Interfaces() ([]Interface, error) {
+	netInterfaces, err := net.Interfaces()
 	if err != nil {
-		return "", "", fmt.Errorf("error getting interface by name: %v", err)
+		return nil, fmt.Errorf("error getting network interfaces: %v", err)
 	}
 
-	name := netInterface.Name
-	niHardwareAddr := netInterface.HardwareAddr
+	var interfaces []Interface
+	for _, netInterface := range netInterfaces {
+		if netInterface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		iface := Interface{
+			Name:         netInterface.Name,
+			HardwareAddr: netInterface.HardwareAddr,
+			Physical:     isPhysical(netInterface.Name),
+		}
+		if addrs, err := netInterface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					iface.HasIPv4 = true
+				}
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// isPhysical reports whether the interface is backed by a device. On Linux, physical interfaces have a device link in
+// sysfs, elsewhere the name is matched against well known virtual interface names.
+func isPhysical(name string) bool {
+	if _, err := os.Stat("/sys/class/net"); err == nil {
+		_, err := os.Stat(filepath.Join("/sys/class/net", name, "device"))
+		return err == nil
+	}
+	return !matchAny(virtualInterfacePatterns, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
 
-	// verify if the MAC address can be parsed properly
-	hwAddr, err := net.ParseMAC(niHardwareAddr.String())
+func writePin(pinFile string, p pin) error {
+	data, err := json.MarshalIndent(p, "", "  ")
 	if err != nil {
-		return "", "", fmt.Errorf("error parsing MAC address: %v", err)
+		return fmt.Errorf("error marshalling interface pin: %v", err)
+	}
+	tmp := pinFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing interface pin: %v", err)
 	}
-	macString := strings.Replace(hwAddr.String(), ":", "", -1)
+	if err := os.Rename(tmp, pinFile); err != nil {
+		return fmt.Errorf("error writing interface pin: %v", err)
+	}
+	return nil
+}
 
-	return macAddress(macString), interfaceName(name), nil
+// ValidateMACAddress checks that the MAC address is 48 bits written as 12 hex digits without separators
+func ValidateMACAddress(mac string) error {
+	if len(mac) != 12 {
+		return fmt.Errorf("unexpected MAC address %q", mac)
+	}
+	if _, err := hex.DecodeString(mac); err != nil {
+		return fmt.Errorf("unexpected MAC address %q", mac)
+	}
+	return nil
+}
+
+// EUI64 turns a MAC address of 12 hex digits into the 64 bit identifier used as UniqueId by inserting "fffe" in the
+// middle
+func EUI64(mac string) (string, error) {
+	if err := ValidateMACAddress(mac); err != nil {
+		return "", err
+	}
+	return mac[:6] + "fffe" + mac[6:], nil
+}
 
+// GetInterfaceMACAddress returns the MAC address of the named interface
+func GetInterfaceMACAddress(name string) (macAddress, error) {
+	netInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("error getting interface by name: %v", err)
+	}
+	if len(netInterface.HardwareAddr) == 0 {
+		return "", fmt.Errorf("interface %s has no MAC address", name)
+	}
+	return macAddress(strings.Replace(netInterface.HardwareAddr.String(), ":", "", -1)), nil
 }
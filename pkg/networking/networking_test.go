@@ -0,0 +1,89 @@
+package networking_test
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
+	"github.com/stretchr/testify/assert"
+)
+
+func mac(s string) net.HardwareAddr {
+	hw, _ := net.ParseMAC(s)
+	return hw
+}
+
+var interfaces = []networking.Interface{
+	{Name: "wlan0", HardwareAddr: mac("b8:27:eb:00:00:02"), HasIPv4: true, Physical: true},
+	{Name: "docker0", HardwareAddr: mac("02:42:ac:00:00:01"), HasIPv4: true},
+	{Name: "veth1a2b3c", HardwareAddr: mac("02:42:ac:00:00:02")},
+	{Name: "usb0", HardwareAddr: mac("b8:27:eb:00:00:03"), Physical: true},
+	{Name: "eth0", HardwareAddr: mac("b8:27:eb:00:00:01"), Physical: true},
+	{Name: "tun0", HasIPv4: true},
+	{Name: "ib0", HardwareAddr: mac("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"), HasIPv4: true, Physical: true},
+}
+
+func TestSelectionPolicy_Choose(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   networking.SelectionPolicy
+		expected string
+	}{
+		{"default policy", networking.DefaultSelectionPolicy(), "wlan0"},
+		{"without physical preference", networking.SelectionPolicy{RequireIPv4: true}, "docker0"},
+		{"prefer physical", networking.SelectionPolicy{PreferPhysical: true, RequireIPv4: true}, "wlan0"},
+		{"without ipv4 requirement", networking.SelectionPolicy{PreferPhysical: true}, "eth0"},
+		{"preferred names", networking.SelectionPolicy{Prefer: []string{"usb0", "eth0"}}, "usb0"},
+		{"allow patterns", networking.SelectionPolicy{Allow: []string{"wlan*", "usb*"}}, "usb0"},
+		{"deny patterns", networking.SelectionPolicy{Deny: []string{"docker*", "e*"}}, "usb0"},
+	} {
+		chosen, err := tc.policy.Choose(interfaces)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, chosen.Name, tc.name)
+
+		// the choice does not depend on the order the interfaces are listed in
+		reversed := make([]networking.Interface, len(interfaces))
+		for i, iface := range interfaces {
+			reversed[len(interfaces)-1-i] = iface
+		}
+		chosen, err = tc.policy.Choose(reversed)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, chosen.Name, "%s in reverse order", tc.name)
+	}
+
+	_, err := networking.SelectionPolicy{Allow: []string{"tun*"}}.Choose(interfaces)
+	assert.Error(t, err, "interfaces without hardware address are never selected")
+
+	_, err = networking.SelectionPolicy{Allow: []string{"ib*"}}.Choose(interfaces)
+	assert.Error(t, err, "interfaces without a 6 byte MAC address are never selected")
+}
+
+func TestSelectionPolicy_Pin(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "interface.json")
+	assert.NoError(t, ioutil.WriteFile(pinFile, []byte(`{"interface": "eth9", "macAddress": "b827eb000009"}`), 0644))
+
+	macAddress, interfaceName, err := networking.SelectionPolicy{PinFile: pinFile}.Select()
+	assert.NoError(t, err, "pinned interface returned without error")
+	assert.EqualValues(t, "b827eb000009", macAddress)
+	assert.EqualValues(t, "eth9", interfaceName)
+}
+
+func TestSelectionPolicy_InvalidPin(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "interface.json")
+	for _, content := range []string{`{"interface": "eth9", "macAddress": "b827"}`, `{"interface": "eth9", "macAddress": "not a mac!!!"}`} {
+		assert.NoError(t, ioutil.WriteFile(pinFile, []byte(content), 0644))
+		_, _, err := networking.SelectionPolicy{PinFile: pinFile}.Select()
+		assert.Error(t, err, "invalid pinned MAC address rejected: %s", content)
+	}
+}
+
+func TestEUI64(t *testing.T) {
+	id, err := networking.EUI64("b827eb000001")
+	assert.NoError(t, err)
+	assert.Equal(t, "b827ebfffe000001", id)
+
+	_, err = networking.EUI64("b827")
+	assert.Error(t, err, "short MAC address rejected")
+}
@@ -0,0 +1,193 @@
+package parameters
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
+)
+
+// Builder merges provisioning template parameters from several sources. Sources are applied in the order the methods
+// are called, so a later source overrides the values of earlier ones.
+type Builder struct {
+	values  map[string]string
+	sources map[string]string
+}
+
+// NewBuilder returns an empty Builder
+func NewBuilder() *Builder {
+	return &Builder{
+		values:  map[string]string{},
+		sources: map[string]string{},
+	}
+}
+
+// Set sets a single parameter, recording where it came from
+func (b *Builder) Set(key, value, source string) {
+	b.values[key] = value
+	b.sources[key] = source
+}
+
+// FromFile reads a JSON object of parameters. Numbers and booleans are converted to strings.
+func (b *Builder) FromFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading parameters file: %v", err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("error unmarshalling parameters file: %v", err)
+	}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			b.Set(key, v, path)
+		case float64, bool:
+			b.Set(key, fmt.Sprint(v), path)
+		default:
+			return fmt.Errorf("parameter %s in %s is not a string, number or boolean", key, path)
+		}
+	}
+	return nil
+}
+
+// FromFlags parses parameters given as key=value
+func (b *Builder) FromFlags(flags []string) error {
+	for _, flag := range flags {
+		i := strings.Index(flag, "=")
+		if i <= 0 {
+			return fmt.Errorf("parameter %q is not in the key=value format", flag)
+		}
+		b.Set(flag[:i], flag[i+1:], "flag")
+	}
+	return nil
+}
+
+// FromEnv reads the environment variables starting with the prefix, e.g. with the prefix "AWS_IOT_PARAM_" the
+// variable AWS_IOT_PARAM_SerialNumber sets the parameter SerialNumber
+func (b *Builder) FromEnv(prefix string) {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, prefix) {
+			continue
+		}
+		i := strings.Index(env, "=")
+		if key := env[len(prefix):i]; key != "" {
+			b.Set(key, env[i+1:], "env "+env[:i])
+		}
+	}
+}
+
+// FromIdentity sets the parameter to the identifier of the provider
+func (b *Builder) FromIdentity(key string, provider identity.Provider) error {
+	id, err := provider.ID()
+	if err != nil {
+		return fmt.Errorf("error getting %s from %s: %v", key, provider.Name(), err)
+	}
+	b.Set(key, id, "identity "+provider.Name())
+	return nil
+}
+
+// Has reports whether the parameter was set by any source
+func (b *Builder) Has(key string) bool {
+	_, ok := b.values[key]
+	return ok
+}
+
+// Source returns where the parameter was last set from
+func (b *Builder) Source(key string) string {
+	return b.sources[key]
+}
+
+// Build returns a copy of the merged parameters
+func (b *Builder) Build() map[string]string {
+	params := make(map[string]string, len(b.values))
+	for key, value := range b.values {
+		params[key] = value
+	}
+	return params
+}
+
+// TemplateParameter is a parameter declared by a provisioning template
+type TemplateParameter struct {
+	Type    string      `json:"Type"`
+	Default interface{} `json:"Default,omitempty"`
+}
+
+// Template is the local copy of a provisioning template body. Only the declared parameters are used.
+type Template struct {
+	Parameters map[string]TemplateParameter `json:"Parameters"`
+}
+
+// ParseTemplate parses a provisioning template body
+func ParseTemplate(data []byte) (*Template, error) {
+	t := &Template{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("error unmarshalling provisioning template: %v", err)
+	}
+	return t, nil
+}
+
+// LoadTemplate reads a provisioning template body from a file
+func LoadTemplate(path string) (*Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading provisioning template: %v", err)
+	}
+	return ParseTemplate(data)
+}
+
+// Declares reports whether the template declares the parameter
+func (t *Template) Declares(name string) bool {
+	_, ok := t.Parameters[name]
+	return ok
+}
+
+// ValidationError lists the parameters that do not match the template
+type ValidationError struct {
+	// Missing are declared parameters without default that were not given
+	Missing []string
+	// Extra are given parameters the template does not declare
+	Extra []string
+}
+
+func (e *ValidationError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Extra) > 0 {
+		problems = append(problems, "not declared by the template "+strings.Join(e.Extra, ", "))
+	}
+	return "invalid provisioning parameters: " + strings.Join(problems, "; ")
+}
+
+// Validate checks the parameters against the declared template parameters. Pseudo parameters starting with "AWS::"
+// are filled in by AWS IoT and never have to be given.
+func (t *Template) Validate(params map[string]string) error {
+	e := &ValidationError{}
+	for name, declared := range t.Parameters {
+		if strings.HasPrefix(name, "AWS::") || declared.Default != nil {
+			continue
+		}
+		if _, ok := params[name]; !ok {
+			e.Missing = append(e.Missing, name)
+		}
+	}
+	for name := range params {
+		if _, ok := t.Parameters[name]; !ok {
+			e.Extra = append(e.Extra, name)
+		}
+	}
+
+	if len(e.Missing) == 0 && len(e.Extra) == 0 {
+		return nil
+	}
+	sort.Strings(e.Missing)
+	sort.Strings(e.Extra)
+	return e
+}
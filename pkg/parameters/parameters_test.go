@@ -0,0 +1,53 @@
+package parameters_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/parameters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	os.Setenv("TEST_PARAM_SerialNumber", "SN-2")
+	defer os.Unsetenv("TEST_PARAM_SerialNumber")
+
+	builder := parameters.NewBuilder()
+	assert.NoError(t, builder.FromIdentity("UniqueId", identity.File{Path: "testdata/unique-id"}))
+	assert.NoError(t, builder.FromFile("testdata/parameters.json"), "parameters file read without error")
+	builder.FromEnv("TEST_PARAM_")
+	assert.NoError(t, builder.FromFlags([]string{"Location=lab=2"}))
+
+	params := builder.Build()
+	assert.Equal(t, "SN-2", params["SerialNumber"], "the environment overrides the file")
+	assert.Equal(t, "7", params["Batch"], "numbers are converted to strings")
+	assert.Equal(t, "lab=2", params["Location"], "flag values may contain =")
+	assert.Equal(t, "env TEST_PARAM_SerialNumber", builder.Source("SerialNumber"))
+	assert.Equal(t, "b827ebfffe000001", params["UniqueId"])
+	assert.Equal(t, "identity file:testdata/unique-id", builder.Source("UniqueId"))
+
+	assert.True(t, builder.Has("Batch"))
+	assert.False(t, builder.Has("Site"))
+
+	assert.Error(t, builder.FromFlags([]string{"Location"}), "flags without = are rejected")
+	assert.Error(t, builder.FromIdentity("UniqueId", identity.File{Path: "testdata/missing"}))
+}
+
+func TestTemplate_Validate(t *testing.T) {
+	template, err := parameters.LoadTemplate("testdata/template.json")
+	assert.NoError(t, err, "template loaded without error")
+
+	assert.NoError(t, template.Validate(map[string]string{"UniqueId": "1", "SerialNumber": "SN-1"}),
+		"parameters with a default and pseudo parameters are optional")
+
+	err = template.Validate(map[string]string{"UniqueId": "1", "Batch": "7", "Site": "north"})
+	var validationErr *parameters.ValidationError
+	assert.True(t, errors.As(err, &validationErr), "invalid parameters are reported as a ValidationError")
+	assert.Equal(t, []string{"SerialNumber"}, validationErr.Missing)
+	assert.Equal(t, []string{"Batch", "Site"}, validationErr.Extra)
+
+	assert.True(t, template.Declares("UniqueId"))
+	assert.False(t, template.Declares("Site"))
+}
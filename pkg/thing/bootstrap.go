@@ -0,0 +1,108 @@
+package thing
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/mqtt"
+)
+
+// BootstrapConfig holds everything needed for the first boot of a device
+type BootstrapConfig struct {
+	Endpoint string
+	// ClaimKeyPair is the claim certificate used for fleet provisioning. It is never modified, so a failed bootstrap
+	// can be retried with it. Its CA certificate is trusted by both the claim and the device connection.
+	ClaimKeyPair models.KeyPair
+	// ClientID is used for the claim connection, defaults to a random UUID
+	ClientID string
+	// Provisioner configures the provisioning run. Its Client is set by Bootstrap.
+	Provisioner Provisioner
+}
+
+// Bootstrap runs the first boot flow of a device: it connects with the claim certificate, provisions the device,
+// disconnects and connects again as the registered thing with the new certificate. The new connection trusts the CA
+// certificate of the claim key pair. The returned thing uses the new connection.
+//
+// If the thing was provisioned by an earlier run, the claim connection is skipped and the stored credentials are used
+// straight away.
+func Bootstrap(ctx context.Context, cfg BootstrapConfig) (*Thing, *ProvisionResult, error) {
+	if cfg.Provisioner.Store == nil {
+		return nil, nil, errors.New("bootstrap needs a credential store")
+	}
+
+	rootCAs, err := mqtt.LoadCertPool(cfg.ClaimKeyPair.CACertificatePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the CA certificate: %w", err)
+	}
+
+	p := cfg.Provisioner
+	state, err := p.loadState()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := state.result()
+	if state.Step != StepRegistered {
+		result, err = provisionWithClaim(ctx, cfg, rootCAs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cert, key, err := p.Store.Load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load device credentials: %w", err)
+	}
+	tlsCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load device credentials: %w", err)
+	}
+	client, err := connect(cfg.Endpoint, result.ThingName, &tls.Config{Certificates: []tls.Certificate{tlsCert}, RootCAs: rootCAs})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect as %s: %w", result.ThingName, err)
+	}
+	th := &Thing{client: client, thingName: result.ThingName}
+	if !client.IsConnectionOpen() {
+		th.Disconnect()
+		return nil, nil, fmt.Errorf("connection as %s is not open", result.ThingName)
+	}
+
+	return th, result, nil
+}
+
+// provisionWithClaim provisions the device over a connection made with the claim certificate
+func provisionWithClaim(ctx context.Context, cfg BootstrapConfig, rootCAs *x509.CertPool) (*ProvisionResult, error) {
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = uuid.New().String()
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(cfg.ClaimKeyPair.CertificatePath, cfg.ClaimKeyPair.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the claim certificate: %w", err)
+	}
+	client, err := connect(cfg.Endpoint, clientID, &tls.Config{Certificates: []tls.Certificate{tlsCert}, RootCAs: rootCAs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect with the claim certificate: %w", err)
+	}
+	defer client.Disconnect(250)
+
+	p := cfg.Provisioner
+	p.Client = client
+	return p.Run(ctx)
+}
+
+// connect returns a client connected to the AWS IoT endpoint
+func connect(endpoint, clientID string, tlsConfig *tls.Config) (paho.Client, error) {
+	client := newClient(mqtt.NewClientOptions(endpoint, clientID, tlsConfig))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
@@ -0,0 +1,145 @@
+package thing_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedKeyPair returns a self-signed certificate and its private key
+func selfSignedKeyPair(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// bootstrapBroker creates a fakeClient for every connection, provisioning the device certificate to claim connections
+type bootstrapBroker struct {
+	mu      sync.Mutex
+	clients []*fakeClient
+	certs   thing.CreateKeysAndCertificateAccepted
+}
+
+func (b *bootstrapBroker) newClient(o *paho.ClientOptions) paho.Client {
+	c := newFakeClient(func(topic string, payload []byte) (string, []byte) {
+		switch topic {
+		case createTopic:
+			response, _ := json.Marshal(b.certs)
+			return "/accepted", response
+		case "$aws/provisioning-templates/template/provision/json":
+			return "/accepted", []byte(`{"thingName": "thing-1"}`)
+		}
+		return "", nil
+	})
+	c.options = o
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients = append(b.clients, c)
+	return c
+}
+
+func TestBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	claimCert, claimKey := selfSignedKeyPair(t, "claim")
+	caCert, _ := selfSignedKeyPair(t, "private CA")
+	claim := models.KeyPair{
+		CertificatePath:   filepath.Join(dir, "claim.certificate.pem"),
+		PrivateKeyPath:    filepath.Join(dir, "claim.private.key"),
+		CACertificatePath: filepath.Join(dir, "ca.pem"),
+	}
+	assert.NoError(t, ioutil.WriteFile(claim.CertificatePath, claimCert, 0600))
+	assert.NoError(t, ioutil.WriteFile(claim.PrivateKeyPath, claimKey, 0600))
+	assert.NoError(t, ioutil.WriteFile(claim.CACertificatePath, caCert, 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "device"), 0700))
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caCert)
+
+	deviceCert, deviceKey := selfSignedKeyPair(t, "thing-1")
+	broker := &bootstrapBroker{certs: thing.CreateKeysAndCertificateAccepted{
+		CertificateID:             "cert-1",
+		CertificatePem:            string(deviceCert),
+		PrivateKey:                string(deviceKey),
+		CertificateOwnershipToken: "token-1",
+	}}
+	thing.SetNewClient(t, broker.newClient)
+
+	cfg := thing.BootstrapConfig{
+		Endpoint:     "example.iot.eu-west-1.amazonaws.com",
+		ClaimKeyPair: claim,
+		ClientID:     "claim-1",
+		Provisioner: thing.Provisioner{
+			TemplateName: "template",
+			Store:        thing.NewFileCredentialStore(filepath.Join(dir, "device")),
+			StatePath:    filepath.Join(dir, "device", thing.DefaultProvisioningStateFile),
+		},
+	}
+
+	// the first boot provisions the device over the claim connection and hands over to the device connection
+	th, result, err := thing.Bootstrap(context.Background(), cfg)
+	if !assert.NoError(t, err, "bootstrapped without error") {
+		return
+	}
+	assert.Equal(t, "thing-1", th.Name())
+	assert.Equal(t, "cert-1", result.CertificateID)
+	if assert.Len(t, broker.clients, 2, "a claim and a device connection") {
+		claimClient, deviceClient := broker.clients[0], broker.clients[1]
+		claimOptions, deviceOptions := claimClient.OptionsReader(), deviceClient.OptionsReader()
+
+		assert.Equal(t, "claim-1", claimOptions.ClientID())
+		assert.Equal(t, 1, claimClient.publishedTo(createTopic))
+		assert.False(t, claimClient.IsConnectionOpen(), "the claim connection is closed")
+
+		assert.Equal(t, "thing-1", deviceOptions.ClientID(), "the device connects as the registered thing")
+		assert.True(t, deviceClient.IsConnectionOpen())
+		assert.Equal(t, "example.iot.eu-west-1.amazonaws.com", deviceOptions.Servers()[0].Hostname())
+
+		block, _ := pem.Decode(deviceCert)
+		assert.Equal(t, block.Bytes, deviceOptions.TLSConfig().Certificates[0].Certificate[0], "the device connects with the new certificate")
+		assert.True(t, rootCAs.Equal(claimOptions.TLSConfig().RootCAs), "the claim connection trusts the configured CA")
+		assert.True(t, rootCAs.Equal(deviceOptions.TLSConfig().RootCAs), "the device connection trusts the configured CA")
+	}
+
+	// the next boot resumes from the state file and connects as the thing straight away
+	broker.clients = nil
+	th, result, err = thing.Bootstrap(context.Background(), cfg)
+	if !assert.NoError(t, err, "bootstrap resumed without error") {
+		return
+	}
+	assert.Equal(t, "thing-1", th.Name())
+	assert.Equal(t, "cert-1", result.CertificateID)
+	if assert.Len(t, broker.clients, 1, "no claim connection") {
+		deviceOptions := broker.clients[0].OptionsReader()
+		assert.Equal(t, "thing-1", deviceOptions.ClientID())
+		assert.Equal(t, 0, broker.clients[0].publishedTo("$aws/"), "nothing is provisioned again")
+		assert.True(t, rootCAs.Equal(deviceOptions.TLSConfig().RootCAs))
+	}
+}
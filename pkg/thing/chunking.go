@@ -0,0 +1,285 @@
+package thing
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxChunkSize is the largest chunk of payload data that fits a single message once wrapped in an envelope
+	MaxChunkSize = (MaxPayloadSize - 1024) / 4 * 3
+
+	// MaxReassembledSize is the largest payload, before and after decompression, that is chunked or reassembled
+	MaxReassembledSize = 16 * 1024 * 1024
+	// MaxChunkCount is the largest number of chunks a payload is split into
+	MaxChunkCount = 1024
+	// MaxPendingPayloads is the number of incomplete payloads a Reassembler keeps, the oldest one is dropped beyond
+	MaxPendingPayloads = 64
+
+	// DefaultReassemblyTimeout is how long an incomplete chunked payload is kept before it is dropped
+	DefaultReassemblyTimeout = time.Minute
+
+	// envelopeType marks the messages wrapped in a payload envelope
+	envelopeType = "aws-iot-device-sdk-go/chunk/1"
+	encodingGzip = "gzip"
+)
+
+// PublishOptions controls the optional encoding of custom topic payloads
+type PublishOptions struct {
+	// Compress gzips the payload before publishing it
+	Compress bool
+	// ChunkSize splits the (compressed) payload into chunks of at most ChunkSize bytes. Zero disables chunking.
+	ChunkSize int
+}
+
+// payloadEnvelope wraps a chunk of an encoded payload
+type payloadEnvelope struct {
+	Type     string `json:"$envelope"`
+	ID       string `json:"id"`
+	Index    int    `json:"index"`
+	Count    int    `json:"count"`
+	Encoding string `json:"encoding,omitempty"`
+	Data     []byte `json:"data"`
+}
+
+// PublishToCustomTopicWithOptions publishes the payload to the custom topic, compressing and chunking it as requested.
+// Every message is wrapped in an envelope, so the subscriber has to use SubscribeForCustomTopicReassembled or a
+// Reassembler to get the original payload back. Payloads larger than MaxReassembledSize or split into more than
+// MaxChunkCount chunks are rejected.
+func (t *Thing) PublishToCustomTopicWithOptions(payload Payload, topic string, opts PublishOptions) error {
+	envelopes, err := encodePayload(payload, opts)
+	if err != nil {
+		return err
+	}
+
+	qos := t.publishQoS()
+	for _, envelope := range envelopes {
+		msg, err := json.Marshal(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload envelope: %w", err)
+		}
+		if err := validatePayloadSize(msg); err != nil {
+			return err
+		}
+		if err := t.publish(TelemetryTraffic, topic, qos, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscribeForCustomTopicReassembled subscribes for the custom topic and returns the channel with the payloads
+// reassembled from the messages published with PublishToCustomTopicWithOptions. Messages that are not wrapped in an
+// envelope are passed through unchanged, malformed chunks are dropped.
+func (t *Thing) SubscribeForCustomTopicReassembled(topic string) (chan Payload, error) {
+	payloadChan := make(chan Payload)
+	reassembler := NewReassembler(DefaultReassemblyTimeout)
+
+	if token := t.subscribe(
+		topic,
+		0,
+		func(client paho.Client, msg paho.Message) {
+			payload, complete, err := reassembler.Add(msg.Payload())
+			if err != nil || !complete {
+				return
+			}
+			payloadChan <- payload
+		},
+	); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return payloadChan, nil
+}
+
+func encodePayload(payload Payload, opts PublishOptions) ([]payloadEnvelope, error) {
+	if opts.ChunkSize < 0 || opts.ChunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size must be between 0 and %d bytes", MaxChunkSize)
+	}
+
+	if len(payload) > MaxReassembledSize {
+		return nil, &PayloadTooLargeError{Section: "payload", Size: len(payload), Limit: MaxReassembledSize}
+	}
+
+	data := []byte(payload)
+	encoding := ""
+	if opts.Compress {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress payload: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress payload: %w", err)
+		}
+		data = buf.Bytes()
+		encoding = encodingGzip
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = len(data)
+	}
+
+	count := 1
+	if chunkSize > 0 {
+		count = (len(data) + chunkSize - 1) / chunkSize
+	}
+	if count == 0 {
+		count = 1
+	}
+	if count > MaxChunkCount {
+		return nil, fmt.Errorf("payload of %d bytes needs %d chunks, more than %d", len(data), count, MaxChunkCount)
+	}
+
+	id := uuid.New().String()
+	envelopes := make([]payloadEnvelope, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		envelopes = append(envelopes, payloadEnvelope{
+			Type:     envelopeType,
+			ID:       id,
+			Index:    i,
+			Count:    count,
+			Encoding: encoding,
+			Data:     data[start:end],
+		})
+	}
+	return envelopes, nil
+}
+
+// Reassembler rebuilds payloads published with PublishToCustomTopicWithOptions from their chunks
+type Reassembler struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	pending map[string]*pendingPayload
+}
+
+type pendingPayload struct {
+	chunks   [][]byte
+	seen     []bool
+	received int
+	size     int
+	encoding string
+	started  time.Time
+}
+
+// NewReassembler returns a new instance of Reassembler. Incomplete payloads older than timeout are dropped, as is the
+// oldest one when more than MaxPendingPayloads are incomplete.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		pending: make(map[string]*pendingPayload),
+	}
+}
+
+// Add consumes a received message. It returns the reassembled payload and true once the last chunk of a payload has
+// been added. Messages that are not wrapped in an envelope are returned as they are. Chunks of payloads exceeding
+// MaxChunkCount or MaxReassembledSize are rejected.
+func (r *Reassembler) Add(msg []byte) (Payload, bool, error) {
+	envelope := payloadEnvelope{}
+	if err := json.Unmarshal(msg, &envelope); err != nil || envelope.Type != envelopeType {
+		return msg, true, nil
+	}
+	if envelope.ID == "" || envelope.Count <= 0 || envelope.Count > MaxChunkCount {
+		return nil, false, fmt.Errorf("chunk count %d is out of range 1 to %d", envelope.Count, MaxChunkCount)
+	}
+	if envelope.Index < 0 || envelope.Index >= envelope.Count {
+		return nil, false, fmt.Errorf("chunk index %d is out of range for %d chunks", envelope.Index, envelope.Count)
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	r.evict(now)
+
+	p, ok := r.pending[envelope.ID]
+	if !ok {
+		r.dropOldest()
+		p = &pendingPayload{
+			chunks:   make([][]byte, envelope.Count),
+			seen:     make([]bool, envelope.Count),
+			encoding: envelope.Encoding,
+			started:  now,
+		}
+		r.pending[envelope.ID] = p
+	}
+	if len(p.chunks) != envelope.Count {
+		r.mu.Unlock()
+		return nil, false, fmt.Errorf("chunk count %d does not match %d", envelope.Count, len(p.chunks))
+	}
+	if !p.seen[envelope.Index] {
+		if p.size+len(envelope.Data) > MaxReassembledSize {
+			delete(r.pending, envelope.ID)
+			r.mu.Unlock()
+			return nil, false, &PayloadTooLargeError{Section: "reassembled payload", Size: p.size + len(envelope.Data), Limit: MaxReassembledSize}
+		}
+		p.chunks[envelope.Index] = envelope.Data
+		p.seen[envelope.Index] = true
+		p.received++
+		p.size += len(envelope.Data)
+	}
+	if p.received < len(p.chunks) {
+		r.mu.Unlock()
+		return nil, false, nil
+	}
+	delete(r.pending, envelope.ID)
+	r.mu.Unlock()
+
+	data := bytes.Join(p.chunks, nil)
+	switch p.encoding {
+	case "":
+		return data, true, nil
+	case encodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decompress payload: %w", err)
+		}
+		defer zr.Close()
+		decompressed, err := ioutil.ReadAll(io.LimitReader(zr, MaxReassembledSize+1))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decompress payload: %w", err)
+		}
+		if len(decompressed) > MaxReassembledSize {
+			return nil, false, &PayloadTooLargeError{Section: "decompressed payload", Size: len(decompressed), Limit: MaxReassembledSize}
+		}
+		return decompressed, true, nil
+	default:
+		return nil, false, errors.New("unsupported payload encoding " + p.encoding)
+	}
+}
+
+// evict drops the timed out payloads
+func (r *Reassembler) evict(now time.Time) {
+	for id, p := range r.pending {
+		if r.timeout > 0 && now.Sub(p.started) > r.timeout {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// dropOldest drops the oldest payloads beyond MaxPendingPayloads, leaving room for a new one
+func (r *Reassembler) dropOldest() {
+	for len(r.pending) >= MaxPendingPayloads {
+		oldest := ""
+		for id, p := range r.pending {
+			if oldest == "" || p.started.Before(r.pending[oldest].started) {
+				oldest = id
+			}
+		}
+		delete(r.pending, oldest)
+	}
+}
@@ -1,15 +1,23 @@
 package thing
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/google/uuid"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/mqtt"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/parameters"
 	"github.com/spf13/cobra"
 )
 
@@ -23,18 +31,48 @@ var (
 	outputFilePath        string
 	parameterJSONFilePath string
 	clientID              string
-	parameters            map[string]string
+	parameterFlags        []string
+	parameterEnvPrefix    string
+	templateFilePath      string
+	useCSR                bool
+	csrOptions            CSROptions
+	keyAlgorithm          string
+	encryptionKeyFilePath string
+	stateFilePath         string
+	maxAttempts           int
+	identitySpec          string
+	interfacePolicy       = networking.DefaultSelectionPolicy()
+	payloadFormat         string
 )
 
 func init() {
-	RegisterCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", "", "The AWS IoT endpoint")
-	RegisterCmd.PersistentFlags().StringVarP(&templateName, "template", "t", "", "The template to use")
-	RegisterCmd.PersistentFlags().StringVarP(&privateKeyPath, "private-key", "k", "", "The private key path")
-	RegisterCmd.PersistentFlags().StringVarP(&certificatePath, "certificate", "c", "", "The certificate path")
-	RegisterCmd.PersistentFlags().StringVarP(&rootCAPath, "root-ca", "r", "", "The root CA path")
-	RegisterCmd.PersistentFlags().StringVarP(&outputFilePath, "output", "o", ".", "The output file path")
-	RegisterCmd.PersistentFlags().StringVarP(&parameterJSONFilePath, "parameters", "p", "", "The parameters file path")
-	RegisterCmd.PersistentFlags().StringVarP(&clientID, "client-id", "i", "", "The client ID")
+	for _, cmd := range []*cobra.Command{RegisterCmd, BootstrapCmd} {
+		cmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", "", "The AWS IoT endpoint")
+		cmd.PersistentFlags().StringVarP(&templateName, "template", "t", "", "The template to use")
+		cmd.PersistentFlags().StringVarP(&privateKeyPath, "private-key", "k", "", "The private key path")
+		cmd.PersistentFlags().StringVarP(&certificatePath, "certificate", "c", "", "The certificate path")
+		cmd.PersistentFlags().StringVarP(&rootCAPath, "root-ca", "r", "", "The root CA path")
+		cmd.PersistentFlags().StringVarP(&outputFilePath, "output", "o", ".", "The output file path")
+		cmd.PersistentFlags().StringVarP(&parameterJSONFilePath, "parameters", "p", "", "The parameters file path")
+		cmd.PersistentFlags().StringArrayVar(&parameterFlags, "parameter", nil, "A template parameter as key=value, overrides the parameters file and environment")
+		cmd.PersistentFlags().StringVar(&parameterEnvPrefix, "parameter-env-prefix", "", "Read template parameters from environment variables with this prefix, e.g. AWS_IOT_PARAM_")
+		cmd.PersistentFlags().StringVar(&templateFilePath, "template-file", "", "A local copy of the provisioning template body to validate the parameters against before contacting AWS")
+		cmd.PersistentFlags().StringVarP(&clientID, "client-id", "i", "", "The client ID")
+		cmd.PersistentFlags().StringVar(&encryptionKeyFilePath, "encryption-key-file", "", "Encrypt the private key at rest with the hex encoded AES-256 key in this file")
+		cmd.PersistentFlags().StringVar(&stateFilePath, "state-file", "", "The provisioning state file used to resume an interrupted registration, defaults to provisioning-state.json in the output path")
+		cmd.PersistentFlags().StringVar(&identitySpec, "identity", identity.DefaultSpec, "The UniqueId source: a comma separated fallback chain of mac[:<interface>], eui64[:<interface>], machine-id, dmi-serial, cpu-serial and file:<path>")
+		networking.AddSelectionPolicyFlags(cmd.PersistentFlags(), &interfacePolicy)
+		cmd.PersistentFlags().StringVar(&payloadFormat, "payload-format", string(PayloadFormatJSON), "The payload format of the provisioning topics: json or cbor")
+		cmd.PersistentFlags().IntVar(&maxAttempts, "max-attempts", 3, "The number of attempts per provisioning request")
+		cmd.PersistentFlags().BoolVar(&useCSR, "csr", false, "Generate the private key locally and request the certificate with a CSR")
+		cmd.PersistentFlags().StringVar(&keyAlgorithm, "key-algorithm", string(KeyAlgorithmECDSAP256), "The key algorithm for --csr: ecdsa-p256 or rsa-2048")
+		cmd.PersistentFlags().StringVar(&csrOptions.CommonName, "csr-common-name", "", "The CSR subject common name, defaults to the UniqueId")
+		cmd.PersistentFlags().StringVar(&csrOptions.Organization, "csr-organization", "", "The CSR subject organization")
+		cmd.PersistentFlags().StringVar(&csrOptions.OrganizationalUnit, "csr-organizational-unit", "", "The CSR subject organizational unit")
+		cmd.PersistentFlags().StringVar(&csrOptions.Country, "csr-country", "", "The CSR subject country")
+		cmd.PersistentFlags().StringVar(&csrOptions.Province, "csr-province", "", "The CSR subject state or province")
+		cmd.PersistentFlags().StringVar(&csrOptions.Locality, "csr-locality", "", "The CSR subject locality")
+	}
 }
 
 func checkRegisterParameters() error {
@@ -53,23 +91,110 @@ func checkRegisterParameters() error {
 	if rootCAPath == "" {
 		return fmt.Errorf("root-ca is required")
 	}
-	if parameterJSONFilePath != "" {
-		file, err := ioutil.ReadFile(parameterJSONFilePath)
+	if _, err := PayloadFormat(payloadFormat).codec(); err != nil {
+		return err
+	}
+
+	if clientID == "" {
+		clientID = uuid.New().String()
+	}
+
+	return nil
+}
+
+// credentialStore returns the store the register command writes the provisioned credentials to
+func credentialStore() (CredentialStore, error) {
+	if encryptionKeyFilePath == "" {
+		return NewFileCredentialStore(outputFilePath), nil
+	}
+
+	encodedKey, err := ioutil.ReadFile(encryptionKeyFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key file: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(encodedKey)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encryption key: %v", err)
+	}
+	return NewEncryptedFileCredentialStore(outputFilePath, key)
+}
+
+// provisioningParameters merges the template parameters from the parameters file, the environment and the flags, in
+// this order, and validates them against the template file if one is given. The UniqueId is only taken from the
+// identity when no other source sets it and the template, if given, declares it.
+func provisioningParameters() (map[string]string, error) {
+	var template *parameters.Template
+	if templateFilePath != "" {
+		t, err := parameters.LoadTemplate(templateFilePath)
 		if err != nil {
-			log.Fatalf("error reading parameters file: %v", err)
+			return nil, err
 		}
+		template = t
+	}
 
-		err = json.Unmarshal(file, &parameters)
+	builder := parameters.NewBuilder()
+	if parameterJSONFilePath != "" {
+		if err := builder.FromFile(parameterJSONFilePath); err != nil {
+			return nil, err
+		}
+	}
+	if parameterEnvPrefix != "" {
+		builder.FromEnv(parameterEnvPrefix)
+	}
+	if err := builder.FromFlags(parameterFlags); err != nil {
+		return nil, err
+	}
+
+	if !builder.Has("UniqueId") && (template == nil || template.Declares("UniqueId")) {
+		provider, err := identity.ParseWithPolicy(identitySpec, &interfacePolicy)
 		if err != nil {
-			log.Fatalf("error unmarshalling parameters file: %v", err)
+			return nil, err
+		}
+		if err := builder.FromIdentity("UniqueId", provider); err != nil {
+			return nil, err
 		}
 	}
+	params := builder.Build()
 
-	if clientID == "" {
-		clientID = uuid.New().String()
+	if template != nil {
+		if err := template.Validate(params); err != nil {
+			return nil, err
+		}
 	}
+	return params, nil
+}
 
-	return nil
+// newProvisioner returns the provisioner configured by the register flags, without a client
+func newProvisioner() (*Provisioner, error) {
+	params, err := provisioningParameters()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := credentialStore()
+	if err != nil {
+		return nil, err
+	}
+
+	provisioner := &Provisioner{
+		TemplateName:  templateName,
+		Parameters:    params,
+		Store:         store,
+		StatePath:     stateFilePath,
+		MaxAttempts:   maxAttempts,
+		PayloadFormat: PayloadFormat(payloadFormat),
+	}
+	if provisioner.StatePath == "" {
+		provisioner.StatePath = filepath.Join(outputFilePath, DefaultProvisioningStateFile)
+	}
+	if useCSR {
+		csrOptions.KeyAlgorithm = KeyAlgorithm(keyAlgorithm)
+		if csrOptions.CommonName == "" {
+			csrOptions.CommonName = params["UniqueId"]
+		}
+		provisioner.CSR = &csrOptions
+	}
+	return provisioner, nil
 }
 
 // RegisterCmd registers a new thing
@@ -83,13 +208,6 @@ var RegisterCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		macAddress, _, err := networking.GetMACAddress()
-		if err != nil {
-			log.Fatal(err)
-		}
-		uniqueID := macAddress[:6] + "fffe" + macAddress[6:]
-		parameters["UniqueId"] = string(uniqueID)
-
 		keypair := models.KeyPair{
 			PrivateKeyPath:    privateKeyPath,
 			CertificatePath:   certificatePath,
@@ -101,9 +219,64 @@ var RegisterCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		err = ProvisionThing(client, keypair, endpoint, templateName, parameters, outputFilePath)
+		provisioner, err := newProvisioner()
+		if err != nil {
+			log.Fatal(err)
+		}
+		provisioner.Client = client
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		result, err := provisioner.Run(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Registered thing %s with certificate %s\n", result.ThingName, result.CertificateID)
+		for key, value := range result.DeviceConfiguration {
+			log.Printf("Device configuration %s: %s\n", key, value)
+		}
+	},
+}
+
+// BootstrapCmd runs the first boot flow of a device
+var BootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "Provisions the device and connects with the new certificate",
+	Long:  `Connects with the claim certificate, registers a new thing and verifies that the device can connect as the registered thing with the new certificate. The claim certificate is left in place, so a failed bootstrap can be retried.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkRegisterParameters(); err != nil {
+			log.Fatal(err)
+		}
+
+		provisioner, err := newProvisioner()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		th, result, err := Bootstrap(ctx, BootstrapConfig{
+			Endpoint: endpoint,
+			ClaimKeyPair: models.KeyPair{
+				PrivateKeyPath:    privateKeyPath,
+				CertificatePath:   certificatePath,
+				CACertificatePath: rootCAPath,
+			},
+			ClientID:    clientID,
+			Provisioner: *provisioner,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer th.Disconnect()
+
+		log.Printf("Connected as thing %s with certificate %s\n", result.ThingName, result.CertificateID)
+		for key, value := range result.DeviceConfiguration {
+			log.Printf("Device configuration %s: %s\n", key, value)
+		}
 	},
 }
@@ -0,0 +1,141 @@
+package thing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// KeyAlgorithm selects the type of the locally generated private key
+type KeyAlgorithm string
+
+const (
+	// KeyAlgorithmECDSAP256 generates an ECDSA key on the NIST P-256 curve
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	// KeyAlgorithmRSA2048 generates a 2048 bit RSA key
+	KeyAlgorithmRSA2048 KeyAlgorithm = "rsa-2048"
+)
+
+// CSROptions holds the key algorithm and subject of the certificate signing request
+type CSROptions struct {
+	// KeyAlgorithm defaults to KeyAlgorithmECDSAP256
+	KeyAlgorithm       KeyAlgorithm
+	CommonName         string
+	Organization       string
+	OrganizationalUnit string
+	Country            string
+	Province           string
+	Locality           string
+}
+
+// CreateCertificateFromCsrRequest holds the values needed to make a request to create a certificate from a CSR.
+type CreateCertificateFromCsrRequest struct {
+	CertificateSigningRequest string `json:"certificateSigningRequest"`
+}
+
+// CreateCertificateFromCsrAccepted holds the data from an accepted request to create a certificate from a CSR.
+type CreateCertificateFromCsrAccepted struct {
+	CertificateID             string `json:"certificateId"`
+	CertificatePem            string `json:"certificatePem"`
+	CertificateOwnershipToken string `json:"certificateOwnershipToken"`
+}
+
+// GenerateKeyAndCSR generates a private key and a certificate signing request for it. Both are returned PEM encoded.
+func GenerateKeyAndCSR(opts CSROptions) (keyPEM []byte, csrPEM []byte, err error) {
+	var key crypto.Signer
+	var keyBlock *pem.Block
+
+	switch opts.KeyAlgorithm {
+	case KeyAlgorithmECDSAP256, "":
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal ECDSA key: %w", err)
+		}
+		key = ecKey
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case KeyAlgorithmRSA2048:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		key = rsaKey
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %q", opts.KeyAlgorithm)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:         opts.CommonName,
+			Organization:       nonEmpty(opts.Organization),
+			OrganizationalUnit: nonEmpty(opts.OrganizationalUnit),
+			Country:            nonEmpty(opts.Country),
+			Province:           nonEmpty(opts.Province),
+			Locality:           nonEmpty(opts.Locality),
+		},
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate signing request: %w", err)
+	}
+
+	return pem.EncodeToMemory(keyBlock), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), nil
+}
+
+// createCertificateFromCsr requests a certificate for the CSR from AWS IoT
+func createCertificateFromCsr(ctx context.Context, c mqtt.Client, format PayloadFormat, csrPEM []byte) (CreateCertificateFromCsrAccepted, error) {
+	cd, err := format.codec()
+	if err != nil {
+		return CreateCertificateFromCsrAccepted{}, err
+	}
+
+	request, err := cd.Marshal(CreateCertificateFromCsrRequest{CertificateSigningRequest: string(csrPEM)})
+	if err != nil {
+		return CreateCertificateFromCsrAccepted{}, fmt.Errorf("failed to marshal create certificate from csr request: %v", err)
+	}
+
+	accepted, err := mqttRequest(ctx, c, format.topic("$aws/certificates/create-from-csr"), cd, request)
+	if err != nil {
+		return CreateCertificateFromCsrAccepted{}, err
+	}
+
+	createAccepted := CreateCertificateFromCsrAccepted{}
+	if err := cd.Unmarshal(accepted, &createAccepted); err != nil {
+		return CreateCertificateFromCsrAccepted{}, fmt.Errorf("failed to unmarshal create from csr accepted: %w", err)
+	}
+	return createAccepted, nil
+}
+
+// ProvisionThingWithCSR provisions the device like ProvisionThingWithStore, but generates the private key locally and
+// only sends a certificate signing request to AWS IoT, so the private key never leaves the device.
+func ProvisionThingWithCSR(c mqtt.Client, templateName string, thingParameters map[string]string, store CredentialStore, opts CSROptions) (*ProvisionResult, error) {
+	p := &Provisioner{
+		Client:       c,
+		TemplateName: templateName,
+		Parameters:   thingParameters,
+		Store:        store,
+		CSR:          &opts,
+	}
+	return p.Run(context.Background())
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
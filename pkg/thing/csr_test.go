@@ -0,0 +1,36 @@
+package thing_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateKeyAndCSR(t *testing.T) {
+	for _, algorithm := range []thing.KeyAlgorithm{thing.KeyAlgorithmECDSAP256, thing.KeyAlgorithmRSA2048} {
+		keyPEM, csrPEM, err := thing.GenerateKeyAndCSR(thing.CSROptions{
+			KeyAlgorithm: algorithm,
+			CommonName:   "device-1",
+			Organization: "Example",
+		})
+		assert.NoError(t, err, "%s key and csr generated without error", algorithm)
+
+		keyBlock, _ := pem.Decode(keyPEM)
+		assert.NotNil(t, keyBlock, "%s key is PEM encoded", algorithm)
+
+		csrBlock, _ := pem.Decode(csrPEM)
+		assert.NotNil(t, csrBlock, "%s csr is PEM encoded", algorithm)
+
+		csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+		assert.NoError(t, err, "%s csr parsed without error", algorithm)
+		assert.NoError(t, csr.CheckSignature(), "%s csr is signed by the generated key", algorithm)
+		assert.Equal(t, "device-1", csr.Subject.CommonName)
+		assert.Equal(t, []string{"Example"}, csr.Subject.Organization)
+	}
+
+	_, _, err := thing.GenerateKeyAndCSR(thing.CSROptions{KeyAlgorithm: "dsa"})
+	assert.Error(t, err, "unsupported key algorithms are rejected")
+}
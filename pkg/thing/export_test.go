@@ -0,0 +1,19 @@
+package thing
+
+import (
+	"testing"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SetNewClient replaces the constructor of the MQTT clients connected by Reconnect and Bootstrap until the test ends
+func SetNewClient(t *testing.T, f func(o *paho.ClientOptions) paho.Client) {
+	previous := newClient
+	newClient = f
+	t.Cleanup(func() { newClient = previous })
+}
+
+// NewThingWithClient returns a thing using the already connected client
+func NewThingWithClient(client paho.Client, thingName ThingName) *Thing {
+	return &Thing{client: client, thingName: thingName}
+}
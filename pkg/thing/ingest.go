@@ -0,0 +1,54 @@
+package thing
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// basicIngestPrefix is the reserved topic prefix that delivers messages straight to an IoT rule
+	basicIngestPrefix = "$aws/rules"
+
+	// maxTopicLength is the largest topic accepted by AWS IoT Core
+	maxTopicLength = 256
+)
+
+// ruleNamePattern matches the names AWS IoT accepts for topic rules
+var ruleNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{1,128}$`)
+
+// PublishToRule publishes an async message to the IoT rule through Basic Ingest, bypassing the message broker. The
+// message is published to "$aws/rules/<ruleName>/<subtopic>"; the subtopic is optional and is what the rule's topic()
+// functions see. It goes through the same size checks, rate limiting and QoS as PublishToCustomTopic.
+//
+// More info here: https://docs.aws.amazon.com/iot/latest/developerguide/iot-basic-ingest.html
+func (t *Thing) PublishToRule(ruleName, subtopic string, payload Payload) error {
+	topic, err := ruleTopic(ruleName, subtopic)
+	if err != nil {
+		return err
+	}
+	return t.PublishToCustomTopic(payload, topic)
+}
+
+// ruleTopic validates the rule name and subtopic and returns the Basic Ingest topic
+func ruleTopic(ruleName, subtopic string) (string, error) {
+	if !ruleNamePattern.MatchString(ruleName) {
+		return "", fmt.Errorf("invalid rule name %q: must be 1-128 letters, digits or underscores", ruleName)
+	}
+	if strings.ContainsAny(subtopic, "+#") {
+		return "", fmt.Errorf("invalid subtopic %q: wildcards are not allowed when publishing", subtopic)
+	}
+	if strings.HasPrefix(subtopic, "$") {
+		return "", fmt.Errorf("invalid subtopic %q: must not start with $", subtopic)
+	}
+
+	topic := path.Join(basicIngestPrefix, ruleName)
+	if subtopic != "" {
+		topic += "/" + strings.TrimPrefix(subtopic, "/")
+	}
+	if len(topic) > maxTopicLength {
+		return "", fmt.Errorf("topic %q exceeds %d bytes", topic, maxTopicLength)
+	}
+	return topic, nil
+}
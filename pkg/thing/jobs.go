@@ -1,6 +1,7 @@
 package thing
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -11,7 +12,7 @@ import (
 func (t *Thing) ListenForJobs() (chan Payload, error) {
 	// return t.SubscribeForCustomTopic(fmt.Sprintf("$aws/things/%s/jobs/notify", t.thingName))
 	jobsChan := make(chan Payload)
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/notify", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -20,7 +21,7 @@ func (t *Thing) ListenForJobs() (chan Payload, error) {
 	); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/notify-next", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -29,7 +30,7 @@ func (t *Thing) ListenForJobs() (chan Payload, error) {
 	); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/get/accepted", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -38,7 +39,7 @@ func (t *Thing) ListenForJobs() (chan Payload, error) {
 	); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/get/rejected", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -60,7 +61,7 @@ func (t *Thing) GetNextJob() (Payload, error) {
 		fmt.Sprintf("$aws/things/%s/jobs/next-notify", t.thingName),
 	)
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/next", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -70,7 +71,7 @@ func (t *Thing) GetNextJob() (Payload, error) {
 		return nil, token.Error()
 	}
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/jobs/next-notify", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -80,13 +81,13 @@ func (t *Thing) GetNextJob() (Payload, error) {
 		return nil, token.Error()
 	}
 
-	if token := t.client.Publish(
+	if err := t.publish(
+		JobsTraffic,
 		fmt.Sprintf("$aws/things/%s/jobs/get", t.thingName),
 		0,
-		false,
 		[]byte(fmt.Sprintf("{%s: %s, %s: %s}", "clientToken", t.thingName, "jobId", "$next")),
-	); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	); err != nil {
+		return nil, err
 	}
 
 	for {
@@ -113,3 +114,27 @@ func (t *Thing) UnsubscribeFromJobs() error {
 	err = t.unsubscribe(fmt.Sprintf("$aws/things/%s/jobs/get/rejected", t.thingName))
 	return err
 }
+
+// JobExecutionStatus is the status of a job execution reported with UpdateJobExecution
+type JobExecutionStatus string
+
+const (
+	// JobInProgress reports the job execution as being worked on
+	JobInProgress JobExecutionStatus = "IN_PROGRESS"
+	// JobSucceeded reports the job execution as completed successfully
+	JobSucceeded JobExecutionStatus = "SUCCEEDED"
+	// JobFailed reports the job execution as failed
+	JobFailed JobExecutionStatus = "FAILED"
+)
+
+// UpdateJobExecution publishes an async update of the job execution status with optional status details
+func (t *Thing) UpdateJobExecution(jobID string, status JobExecutionStatus, details map[string]string) error {
+	payload, err := json.Marshal(struct {
+		Status        JobExecutionStatus `json:"status"`
+		StatusDetails map[string]string  `json:"statusDetails,omitempty"`
+	}{status, details})
+	if err != nil {
+		return fmt.Errorf("failed to marshal job execution update: %w", err)
+	}
+	return t.publish(JobsTraffic, fmt.Sprintf("$aws/things/%s/jobs/%s/update", t.thingName, jobID), 1, payload)
+}
@@ -0,0 +1,107 @@
+package thing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// AWS IoT Core payload limits
+// https://docs.aws.amazon.com/general/latest/gr/iot-core.html
+const (
+	// MaxPayloadSize is the largest message payload accepted by the message broker
+	MaxPayloadSize = 128 * 1024
+	// MaxShadowStateSize is the largest desired or reported section accepted in a device shadow document
+	MaxShadowStateSize = 8 * 1024
+)
+
+// PayloadTooLargeError is returned when a payload exceeds an AWS IoT Core size limit
+type PayloadTooLargeError struct {
+	// Section names the part of the payload that is too large
+	Section string
+	Size    int
+	Limit   int
+}
+
+// Error implements the error interface
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("%s is %d bytes, exceeding the limit of %d bytes", e.Section, e.Size, e.Limit)
+}
+
+// InvalidJSONError is returned when a payload that must be JSON is not well-formed
+type InvalidJSONError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (e *InvalidJSONError) Error() string {
+	return fmt.Sprintf("payload is not valid JSON: %v", e.Err)
+}
+
+// Unwrap returns the underlying JSON syntax error
+func (e *InvalidJSONError) Unwrap() error {
+	return e.Err
+}
+
+// validatePayloadSize checks the payload against the message broker size limit
+func validatePayloadSize(payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return &PayloadTooLargeError{Section: "payload", Size: len(payload), Limit: MaxPayloadSize}
+	}
+	return nil
+}
+
+// validateShadow checks that the shadow is well-formed JSON and that its state sections fit the shadow limits. The
+// state is looked up at the top level for shadow updates and under previous and current for shadow documents.
+func validateShadow(shadow []byte) error {
+	if err := validatePayloadSize(shadow); err != nil {
+		return err
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(shadow, &doc); err != nil {
+		return &InvalidJSONError{Err: err}
+	}
+
+	if err := validateShadowState("state", doc["state"]); err != nil {
+		return err
+	}
+	for _, name := range []string{"previous", "current"} {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(doc[name], &nested); err != nil {
+			continue
+		}
+		if err := validateShadowState(name+".state", nested["state"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateShadowState checks the size of the desired and reported sections of a shadow state. Whitespace does not
+// count towards the limit. A state that is not an object is left for AWS to reject.
+func validateShadowState(name string, state json.RawMessage) error {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(state, &sections); err != nil {
+		return nil
+	}
+
+	for _, section := range []string{"desired", "reported"} {
+		raw, ok := sections[section]
+		if !ok {
+			continue
+		}
+		compacted := &bytes.Buffer{}
+		if err := json.Compact(compacted, raw); err != nil {
+			return &InvalidJSONError{Err: err}
+		}
+		if compacted.Len() > MaxShadowStateSize {
+			return &PayloadTooLargeError{
+				Section: fmt.Sprintf("shadow %s.%s", name, section),
+				Size:    compacted.Len(),
+				Limit:   MaxShadowStateSize,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package thing_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThing_UpdateThingShadowTooLarge(t *testing.T) {
+	// the payload is validated before the client is used, so the thing needs no connection
+	th := &thing.Thing{}
+
+	shadow := fmt.Sprintf(`{"state": {"reported": {"value": "%s"}}}`, strings.Repeat("x", thing.MaxShadowStateSize))
+	err := th.UpdateThingShadow(thing.Shadow(shadow))
+	var sizeErr *thing.PayloadTooLargeError
+	assert.ErrorAs(t, err, &sizeErr, "oversized reported state is rejected before publishing")
+	assert.Equal(t, thing.MaxShadowStateSize, sizeErr.Limit)
+
+	shadow = fmt.Sprintf(`{"state": {"desired": {"value": "%s"}}}`, strings.Repeat("x", thing.MaxPayloadSize))
+	err = th.UpdateThingShadowDocument(thing.Shadow(shadow))
+	assert.ErrorAs(t, err, &sizeErr, "oversized payload is rejected before publishing")
+	assert.Equal(t, thing.MaxPayloadSize, sizeErr.Limit)
+
+	err = th.PublishToCustomTopic(thing.Payload(strings.Repeat("x", thing.MaxPayloadSize+1)), "topic")
+	assert.ErrorAs(t, err, &sizeErr, "oversized custom topic payload is rejected before publishing")
+}
+
+func TestThing_UpdateThingShadowInvalidJSON(t *testing.T) {
+	th := &thing.Thing{}
+
+	err := th.UpdateThingShadow(thing.Shadow(`{"state": {"reported": `))
+	var jsonErr *thing.InvalidJSONError
+	assert.ErrorAs(t, err, &jsonErr, "malformed shadow is rejected before publishing")
+}
+
+func TestReassembler_PassThrough(t *testing.T) {
+	r := thing.NewReassembler(thing.DefaultReassemblyTimeout)
+
+	payload, complete, err := r.Add([]byte(`{"value": 1}`))
+	assert.NoError(t, err)
+	assert.True(t, complete, "plain payloads are complete")
+	assert.Equal(t, thing.Payload(`{"value": 1}`), payload)
+
+	payload, complete, err = r.Add([]byte(`{"id": "x", "count": 4000000000, "index": 0}`))
+	assert.NoError(t, err)
+	assert.True(t, complete, "payloads without the envelope marker are not chunks")
+	assert.Equal(t, thing.Payload(`{"id": "x", "count": 4000000000, "index": 0}`), payload)
+}
+
+func TestReassembler_Chunks(t *testing.T) {
+	r := thing.NewReassembler(thing.DefaultReassemblyTimeout)
+
+	chunks := []string{"hello ", "chunked ", "world"}
+	var payload thing.Payload
+	for i := len(chunks) - 1; i >= 0; i-- {
+		msg, err := json.Marshal(map[string]interface{}{
+			"$envelope": "aws-iot-device-sdk-go/chunk/1",
+			"id":        "abc",
+			"index":     i,
+			"count":     len(chunks),
+			"data":      []byte(chunks[i]),
+		})
+		assert.NoError(t, err)
+
+		var complete bool
+		payload, complete, err = r.Add(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, i == 0, complete, "the payload is complete once every chunk arrived")
+	}
+	assert.True(t, bytes.Equal([]byte("hello chunked world"), payload))
+}
+
+func TestReassembler_Limits(t *testing.T) {
+	r := thing.NewReassembler(thing.DefaultReassemblyTimeout)
+
+	_, complete, err := r.Add([]byte(`{"$envelope": "aws-iot-device-sdk-go/chunk/1", "id": "x", "count": 4000000000, "index": 0}`))
+	assert.Error(t, err, "chunk count beyond MaxChunkCount rejected")
+	assert.False(t, complete)
+
+	chunk := func(id string, index int, data []byte) []byte {
+		msg, err := json.Marshal(map[string]interface{}{
+			"$envelope": "aws-iot-device-sdk-go/chunk/1",
+			"id":        id,
+			"index":     index,
+			"count":     thing.MaxChunkCount,
+			"data":      data,
+		})
+		assert.NoError(t, err)
+		return msg
+	}
+
+	data := make([]byte, thing.MaxChunkSize)
+	var sizeErr *thing.PayloadTooLargeError
+	err = nil
+	for i := 0; i < thing.MaxChunkCount && err == nil; i++ {
+		_, _, err = r.Add(chunk("big", i, data))
+	}
+	assert.ErrorAs(t, err, &sizeErr, "reassembled payload beyond MaxReassembledSize rejected")
+
+	for i := 0; i <= thing.MaxPendingPayloads; i++ {
+		_, _, err := r.Add(chunk(fmt.Sprint(i), 0, []byte("x")))
+		assert.NoError(t, err, "oldest incomplete payload dropped instead of growing without bound")
+	}
+}
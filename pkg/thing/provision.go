@@ -1,13 +1,12 @@
 package thing
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"path/filepath"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
 )
 
@@ -25,13 +24,34 @@ type CreateKeysAndCertificateAccepted struct {
 // AWSMQTTErrorCh holds the bytes of a CreateKeysAndCertificateRejected message.
 type AWSMQTTErrorCh []byte
 
-// AWSMQTTError holds the data from a rejected request
+// AWSMQTTError holds the data from a rejected request. Rejected provisioning requests are returned as *AWSMQTTError,
+// use errors.As to branch on the status or error code.
 type AWSMQTTError struct {
 	StatusCode   int    `json:"statusCode"`
 	ErrorCode    string `json:"errorCode"`
 	ErrorMessage string `json:"errorMessage"`
 }
 
+func (e *AWSMQTTError) Error() string {
+	return fmt.Sprintf("request rejected with status %d (%s): %s", e.StatusCode, e.ErrorCode, e.ErrorMessage)
+}
+
+// NoResponseError is returned when a request was published but no response arrived before the context was done. AWS
+// IoT may still have processed the request.
+type NoResponseError struct {
+	Topic string
+	Err   error
+}
+
+func (e *NoResponseError) Error() string {
+	return fmt.Sprintf("no response on %s: %v", e.Topic, e.Err)
+}
+
+// Unwrap returns the context error
+func (e *NoResponseError) Unwrap() error {
+	return e.Err
+}
+
 // RegisterThingRequest holds the values needed to make a request to register a new thing.
 type RegisterThingRequest struct {
 	TemplateName              string            `json:"-"`
@@ -48,159 +68,173 @@ type RegisterThingResponse struct {
 // RegisterThingAcceptedCh holds the bytes of a RegisterThingAccepted message.
 type RegisterThingAcceptedCh []byte
 
-func registerThing(c mqtt.Client, templateName string, certificateOwnershipToken string, parameters map[string]string) error {
-	req := RegisterThingRequest{
-		TemplateName:              templateName,
-		CertificateOwnershipToken: certificateOwnershipToken,
-		Parameters:                parameters,
-	}
-
-	reqJSON, err := json.Marshal(req)
-	if err != nil {
-		return fmt.Errorf("failed to marshal register thing request: %v", err)
-	}
-
-	if token := c.Publish(
-		fmt.Sprintf("$aws/provisioning-templates/%s/provision/json", templateName),
-		0,
-		false,
-		[]byte(reqJSON),
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
-	return nil
+// ProvisionResult describes a provisioned thing
+type ProvisionResult struct {
+	ThingName           string            `json:"thingName"`
+	DeviceConfiguration map[string]string `json:"deviceConfiguration,omitempty"`
+	CertificateID       string            `json:"certificateId"`
+	// CertificateARN is only known if the provisioning template returns it as the certificateArn device configuration
+	CertificateARN string `json:"certificateArn,omitempty"`
+	// Paths are the files the credentials were written to, empty for stores that do not write files
+	Paths CredentialPaths `json:"paths"`
 }
 
-func writeCertificateFiles(certs CreateKeysAndCertificateAccepted, outputFilePath string) error {
+// PayloadFormat selects the JSON or CBOR variant of the fleet provisioning topics
+type PayloadFormat string
 
-	if err := ioutil.WriteFile(outputFilePath+"/device.certificate.pem", []byte(certs.CertificatePem), 0644); err != nil {
-		return fmt.Errorf("failed to write device.cert.pem: %v", err)
-	}
+const (
+	// PayloadFormatJSON uses the /json topics
+	PayloadFormatJSON PayloadFormat = "json"
+	// PayloadFormatCBOR uses the /cbor topics, which have smaller payloads for constrained links
+	PayloadFormatCBOR PayloadFormat = "cbor"
+)
 
-	if err := ioutil.WriteFile(outputFilePath+"/device.private.key", []byte(certs.PrivateKey), 0644); err != nil {
-		return fmt.Errorf("failed to write device.private.key: %v", err)
+// codec returns the codec of the payload format, defaulting to JSON
+func (f PayloadFormat) codec() (codec.Codec, error) {
+	switch f {
+	case PayloadFormatJSON, "":
+		return codec.JSON, nil
+	case PayloadFormatCBOR:
+		return codec.CBOR, nil
 	}
+	return nil, fmt.Errorf("unsupported payload format %q", f)
+}
 
-	certJSON, err := json.MarshalIndent(certs, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal certs: %v", err)
-	}
-	if err := ioutil.WriteFile(outputFilePath+"/cert.json", certJSON, 0644); err != nil {
-		return fmt.Errorf("failed to write cert.json: %v", err)
+// topic returns the provisioning topic for the payload format
+func (f PayloadFormat) topic(prefix string) string {
+	if f == "" {
+		f = PayloadFormatJSON
 	}
-
-	return nil
+	return prefix + "/" + string(f)
 }
 
-// ProvisionThing creates a new set of certificates for the device
-func ProvisionThing(c mqtt.Client, keyPair models.KeyPair, awsEndpoint, templateName string, thingParameters map[string]string, certificateOutputPath string) error {
-	// make some channels for the data we need
-	createErrorChan := make(chan AWSMQTTErrorCh)
-	createAcceptedChan := make(chan CreateKeysAndCertificateAcceptedCh)
-	registerErrorChan := make(chan AWSMQTTErrorCh)
-	registerAcceptedChan := make(chan RegisterThingAcceptedCh)
+// mqttRequest subscribes to the accepted and rejected topics of an AWS MQTT API, publishes the request to the topic
+// and waits for the response until the context is done. The payload of an accepted response is returned, a rejected
+// response is decoded with the codec and returned as an *AWSMQTTError. Without a response a *NoResponseError is
+// returned.
+func mqttRequest(ctx context.Context, c mqtt.Client, topic string, decoder codec.Codec, request []byte) ([]byte, error) {
+	acceptedChan := make(chan []byte, 1)
+	rejectedChan := make(chan []byte, 1)
+
+	defer c.Unsubscribe(topic+"/accepted", topic+"/rejected").Wait()
 
-	// Subscribe to CreateKeysAndCertificate Accepted topic
 	if token := c.Subscribe(
-		fmt.Sprintf("$aws/certificates/create/json/accepted"),
+		topic+"/accepted",
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
-			createAcceptedChan <- msg.Payload()
+			select {
+			case acceptedChan <- msg.Payload():
+			default:
+			}
 		},
 	); token.Wait() && token.Error() != nil {
-		return token.Error()
+		return nil, token.Error()
 	}
 
-	// Subscribe to CreateKeysAndCertificate Rejected topic
 	if token := c.Subscribe(
-		fmt.Sprintf("$aws/certificates/create/json/rejected"),
+		topic+"/rejected",
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
-			createErrorChan <- msg.Payload()
+			select {
+			case rejectedChan <- msg.Payload():
+			default:
+			}
 		},
 	); token.Wait() && token.Error() != nil {
-		return token.Error()
+		return nil, token.Error()
 	}
 
-	// Subscribe to RegisterThing Accepted topic
-	if token := c.Subscribe(
-		fmt.Sprintf("$aws/provisioning-templates/%s/provision/json/accepted", templateName),
-		0, func(client mqtt.Client, msg mqtt.Message) {
-			registerAcceptedChan <- msg.Payload()
-		},
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	if token := c.Publish(topic, 0, false, request); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
 	}
 
-	// Subscribe to RegisterThing Rejected topic
-	if token := c.Subscribe(
-		fmt.Sprintf("$aws/provisioning-templates/%s/provision/json/rejected", templateName),
-		0, func(client mqtt.Client, msg mqtt.Message) {
-			registerErrorChan <- msg.Payload()
-		},
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	select {
+	case accepted := <-acceptedChan:
+		return accepted, nil
+	case rejected := <-rejectedChan:
+		rejectedError := &AWSMQTTError{}
+		if err := decoder.Unmarshal(rejected, rejectedError); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rejected response: %w", err)
+		}
+		return nil, rejectedError
+	case <-ctx.Done():
+		return nil, &NoResponseError{Topic: topic, Err: ctx.Err()}
 	}
+}
 
-	// Publish to CreateKeysAndCertificate topic
-	if token := c.Publish(
-		fmt.Sprintf("$aws/certificates/create/json"),
-		0,
-		false,
-		[]byte("{}"),
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+// createKeysAndCertificate requests a new key and certificate from AWS IoT
+func createKeysAndCertificate(ctx context.Context, c mqtt.Client, format PayloadFormat) (CreateKeysAndCertificateAccepted, error) {
+	cd, err := format.codec()
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, err
+	}
+	request, err := cd.Marshal(map[string]string{})
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to marshal create request: %v", err)
 	}
 
-	for {
-		select {
-		case accepted, ok := <-createAcceptedChan:
-			if !ok {
-				return errors.New("failed to read from create accepted channel")
-			}
-			createAccepted := CreateKeysAndCertificateAccepted{}
-			if err := json.Unmarshal(accepted, &createAccepted); err != nil {
-				return fmt.Errorf("failed to unmarshal create accepted: %w", err)
-			}
-			if createAccepted.CertificateOwnershipToken == "" {
-				return errors.New("certificate ownership token is empty")
-			}
-			err := writeCertificateFiles(createAccepted, certificateOutputPath)
-			if err != nil {
-				return fmt.Errorf("failed to write certificate files: %w", err)
-			}
-			err = registerThing(c, templateName, createAccepted.CertificateOwnershipToken, thingParameters)
-			if err != nil {
-				return fmt.Errorf("failed to register thing: %w", err)
-			}
-		case err, ok := <-createErrorChan:
-			if !ok {
-				return errors.New("failed to read from create error channel")
-			}
-			createError := AWSMQTTError{}
-			if err := json.Unmarshal(err, &createError); err != nil {
-				return fmt.Errorf("failed to unmarshal create error: %w", err)
-			}
-			return fmt.Errorf(createError.ErrorMessage)
-		case accepted, ok := <-registerAcceptedChan:
-			if !ok {
-				return errors.New("failed to read from register accepted channel")
-			}
-			registerAccepted := RegisterThingResponse{}
-			if err := json.Unmarshal(accepted, &registerAccepted); err != nil {
-				return fmt.Errorf("failed to unmarshal register accepted: %w", err)
-			}
-			log.Printf("Registered thing: %s\n", registerAccepted.ThingName)
-			return nil
-		case err, ok := <-registerErrorChan:
-			if !ok {
-				return errors.New("failed to read from register error channel")
-			}
-			registerError := AWSMQTTError{}
-			if err := json.Unmarshal(err, &registerError); err != nil {
-				return fmt.Errorf("failed to unmarshal create error: %w", err)
-			}
-			return fmt.Errorf(registerError.ErrorMessage)
-		}
+	accepted, err := mqttRequest(ctx, c, format.topic("$aws/certificates/create"), cd, request)
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, err
+	}
+
+	createAccepted := CreateKeysAndCertificateAccepted{}
+	if err := cd.Unmarshal(accepted, &createAccepted); err != nil {
+		return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to unmarshal create accepted: %w", err)
+	}
+	return createAccepted, nil
+}
+
+func registerThing(ctx context.Context, c mqtt.Client, format PayloadFormat, templateName string, certificateOwnershipToken string, parameters map[string]string) (RegisterThingResponse, error) {
+	cd, err := format.codec()
+	if err != nil {
+		return RegisterThingResponse{}, err
+	}
+
+	req := RegisterThingRequest{
+		TemplateName:              templateName,
+		CertificateOwnershipToken: certificateOwnershipToken,
+		Parameters:                parameters,
+	}
+
+	request, err := cd.Marshal(req)
+	if err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to marshal register thing request: %v", err)
+	}
+
+	accepted, err := mqttRequest(ctx, c, format.topic(fmt.Sprintf("$aws/provisioning-templates/%s/provision", templateName)), cd, request)
+	if err != nil {
+		return RegisterThingResponse{}, err
+	}
+
+	registerAccepted := RegisterThingResponse{}
+	if err := cd.Unmarshal(accepted, &registerAccepted); err != nil {
+		return RegisterThingResponse{}, fmt.Errorf("failed to unmarshal register accepted: %w", err)
+	}
+	return registerAccepted, nil
+}
+
+// ProvisionThing creates a new set of certificates for the device and writes them to certificateOutputPath. The
+// progress is kept in certificateOutputPath as well, so rerunning it after a failure resumes the provisioning instead
+// of creating another certificate.
+func ProvisionThing(c mqtt.Client, keyPair models.KeyPair, awsEndpoint, templateName string, thingParameters map[string]string, certificateOutputPath string) (*ProvisionResult, error) {
+	p := &Provisioner{
+		Client:       c,
+		TemplateName: templateName,
+		Parameters:   thingParameters,
+		Store:        NewFileCredentialStore(certificateOutputPath),
+		StatePath:    filepath.Join(certificateOutputPath, DefaultProvisioningStateFile),
+	}
+	return p.Run(context.Background())
+}
+
+// ProvisionThingWithStore creates a new set of certificates for the device and saves them to the credential store
+func ProvisionThingWithStore(c mqtt.Client, templateName string, thingParameters map[string]string, store CredentialStore) (*ProvisionResult, error) {
+	p := &Provisioner{
+		Client:       c,
+		TemplateName: templateName,
+		Parameters:   thingParameters,
+		Store:        store,
 	}
+	return p.Run(context.Background())
 }
@@ -0,0 +1,315 @@
+package thing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// DefaultProvisioningStateFile is the file name ProvisionThing keeps its progress in
+	DefaultProvisioningStateFile = "provisioning-state.json"
+
+	defaultProvisioningAttempts = 3
+	defaultProvisioningBackoff  = time.Second
+	maxProvisioningBackoff      = 30 * time.Second
+	defaultResponseTimeout      = 30 * time.Second
+	provisioningStateFileMode   = 0600
+)
+
+// ProvisioningStep is the last completed step of a provisioning run
+type ProvisioningStep string
+
+const (
+	// StepNone means provisioning has not started or was reset after a terminal failure
+	StepNone ProvisioningStep = ""
+	// StepCertificateCreated means the certificate was created and saved, but the thing is not registered yet
+	StepCertificateCreated ProvisioningStep = "certificate-created"
+	// StepRegistered means the thing was registered with the certificate
+	StepRegistered ProvisioningStep = "registered"
+)
+
+// ProvisioningState is persisted between provisioning runs so an interrupted run can be resumed
+type ProvisioningState struct {
+	Step                      ProvisioningStep  `json:"step"`
+	CertificateID             string            `json:"certificateId,omitempty"`
+	CertificateOwnershipToken string            `json:"certificateOwnershipToken,omitempty"`
+	ThingName                 string            `json:"thingName,omitempty"`
+	DeviceConfiguration       map[string]string `json:"deviceConfiguration,omitempty"`
+	Paths                     CredentialPaths   `json:"paths"`
+	UpdatedAt                 time.Time         `json:"updatedAt"`
+}
+
+// Provisioner runs fleet provisioning as a resumable state machine. The certificate id and ownership token are
+// persisted once the certificate is saved, so a run that is interrupted before RegisterThing completes resumes at
+// RegisterThing instead of creating another certificate.
+//
+// On a terminal failure, i.e. a RegisterThing request rejected with a client error, the saved credentials and the
+// state are removed so the next run starts over. The certificate created in AWS IoT cannot be deleted with the claim
+// credentials and stays inactive.
+type Provisioner struct {
+	Client       mqtt.Client
+	TemplateName string
+	Parameters   map[string]string
+	Store        CredentialStore
+	// StatePath is the file the progress is persisted in. Without it an interrupted run cannot be resumed.
+	StatePath string
+	// CSR generates the private key locally and requests the certificate with a CSR when set
+	CSR *CSROptions
+	// PayloadFormat selects the JSON or CBOR provisioning topics, defaults to JSON
+	PayloadFormat PayloadFormat
+	// MaxAttempts is the number of attempts per request, defaults to 3
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for every further retry up to 30 seconds. Defaults
+	// to one second.
+	InitialBackoff time.Duration
+	// ResponseTimeout is how long to wait for the response to a request, defaults to 30 seconds
+	ResponseTimeout time.Duration
+}
+
+// Run provisions the thing, resuming a previous run if the state says so. If the thing was already registered it
+// returns the result of that run straight away.
+func (p *Provisioner) Run(ctx context.Context) (*ProvisionResult, error) {
+	if p.Client == nil || p.Store == nil {
+		return nil, errors.New("provisioner needs a client and a credential store")
+	}
+
+	state, err := p.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	var cleanup func() error
+	switch state.Step {
+	case StepRegistered:
+		return state.result(), nil
+	case StepCertificateCreated:
+		if _, _, err := p.Store.Load(); err != nil {
+			// the credentials of the certificate are gone, start over
+			state = ProvisioningState{}
+			break
+		}
+		cleanup = p.Store.Delete
+	}
+
+	if state.Step == StepNone {
+		certs, err := p.createCertificate(ctx)
+		var noResponse *NoResponseError
+		if errors.As(err, &noResponse) {
+			return nil, fmt.Errorf("failed to create certificate, AWS IoT may have created an inactive certificate that has to be cleaned up: %w", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate: %w", err)
+		}
+		if certs.CertificateOwnershipToken == "" {
+			return nil, errors.New("certificate ownership token is empty")
+		}
+
+		saved, err := p.Store.Save(certs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write certificate files: %w", err)
+		}
+		cleanup = saved.Rollback
+
+		state = ProvisioningState{
+			Step:                      StepCertificateCreated,
+			CertificateID:             certs.CertificateID,
+			CertificateOwnershipToken: certs.CertificateOwnershipToken,
+			Paths:                     saved.CredentialPaths,
+		}
+		if err := p.saveState(state); err != nil {
+			_ = cleanup()
+			return nil, err
+		}
+	}
+
+	var registered RegisterThingResponse
+	err = p.retry(ctx, retryable, func(ctx context.Context) error {
+		var err error
+		registered, err = registerThing(ctx, p.Client, p.PayloadFormat, p.TemplateName, state.CertificateOwnershipToken, p.Parameters)
+		return err
+	})
+	if err != nil {
+		// keep the state around to resume later, unless the failure is terminal or there is nothing to resume from
+		if p.StatePath != "" && (ctx.Err() != nil || retryable(err)) {
+			return nil, fmt.Errorf("failed to register thing, provisioning can be resumed: %w", err)
+		}
+		if cleanupErr := p.reset(cleanup); cleanupErr != nil {
+			return nil, fmt.Errorf("failed to register thing: %w (cleaning up: %v)", err, cleanupErr)
+		}
+		return nil, fmt.Errorf("failed to register thing: %w", err)
+	}
+
+	state = ProvisioningState{
+		Step:                StepRegistered,
+		CertificateID:       state.CertificateID,
+		ThingName:           registered.ThingName,
+		DeviceConfiguration: registered.DeviceConfiguration,
+		Paths:               state.Paths,
+	}
+	if err := p.saveState(state); err != nil {
+		return nil, err
+	}
+	return state.result(), nil
+}
+
+func (s ProvisioningState) result() *ProvisionResult {
+	return &ProvisionResult{
+		ThingName:           s.ThingName,
+		DeviceConfiguration: s.DeviceConfiguration,
+		CertificateID:       s.CertificateID,
+		CertificateARN:      s.DeviceConfiguration["certificateArn"],
+		Paths:               s.Paths,
+	}
+}
+
+// createCertificate creates the certificate with CreateKeysAndCertificate or, with CSR options, with a locally
+// generated key and CreateCertificateFromCsr. Only rejections for server errors and throttling are retried: after a
+// request without a response AWS IoT may already have created a certificate, and another request would leave it
+// orphaned.
+func (p *Provisioner) createCertificate(ctx context.Context) (CreateKeysAndCertificateAccepted, error) {
+	var certs CreateKeysAndCertificateAccepted
+
+	if p.CSR == nil {
+		err := p.retry(ctx, retryableCreate, func(ctx context.Context) error {
+			var err error
+			certs, err = createKeysAndCertificate(ctx, p.Client, p.PayloadFormat)
+			return err
+		})
+		return certs, err
+	}
+
+	keyPEM, csrPEM, err := GenerateKeyAndCSR(*p.CSR)
+	if err != nil {
+		return certs, err
+	}
+	err = p.retry(ctx, retryableCreate, func(ctx context.Context) error {
+		accepted, err := createCertificateFromCsr(ctx, p.Client, p.PayloadFormat, csrPEM)
+		if err != nil {
+			return err
+		}
+		certs = CreateKeysAndCertificateAccepted{
+			CertificateID:             accepted.CertificateID,
+			CertificatePem:            accepted.CertificatePem,
+			PrivateKey:                string(keyPEM),
+			CertificateOwnershipToken: accepted.CertificateOwnershipToken,
+		}
+		return nil
+	})
+	return certs, err
+}
+
+// retry runs the request until it succeeds, fails with an error that is not retryable, runs out of attempts or the
+// context is done. Every attempt gets its own response timeout.
+func (p *Provisioner) retry(ctx context.Context, retryable func(error) bool, request func(ctx context.Context) error) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultProvisioningAttempts
+	}
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultProvisioningBackoff
+	}
+	timeout := p.ResponseTimeout
+	if timeout <= 0 {
+		timeout = defaultResponseTimeout
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := request(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > maxProvisioningBackoff {
+			backoff = maxProvisioningBackoff
+		}
+	}
+}
+
+// retryable reports whether the request may succeed when it is sent again. Rejections are only retried for server
+// errors and throttling.
+func retryable(err error) bool {
+	var rejected *AWSMQTTError
+	if errors.As(err, &rejected) {
+		return rejected.StatusCode >= 500 || rejected.StatusCode == 429
+	}
+	return true
+}
+
+// retryableCreate reports whether a certificate request may be sent again without orphaning a certificate created by
+// the previous one, which is only certain for rejections
+func retryableCreate(err error) bool {
+	var noResponse *NoResponseError
+	if errors.As(err, &noResponse) {
+		return false
+	}
+	return retryable(err)
+}
+
+// reset cleans up the saved credentials and the state after a terminal failure
+func (p *Provisioner) reset(cleanup func() error) error {
+	var err error
+	if cleanup != nil {
+		err = cleanup()
+	}
+	if p.StatePath != "" {
+		if removeErr := os.Remove(p.StatePath); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+func (p *Provisioner) loadState() (ProvisioningState, error) {
+	state := ProvisioningState{}
+	if p.StatePath == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(p.StatePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read provisioning state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to unmarshal provisioning state: %w", err)
+	}
+	return state, nil
+}
+
+func (p *Provisioner) saveState(state ProvisioningState) error {
+	if p.StatePath == "" {
+		return nil
+	}
+
+	state.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal provisioning state: %w", err)
+	}
+	if err := writeFileAtomic(p.StatePath, data, provisioningStateFileMode); err != nil {
+		return fmt.Errorf("failed to write provisioning state: %w", err)
+	}
+	return syncDir(filepath.Dir(p.StatePath))
+}
@@ -0,0 +1,305 @@
+package thing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeToken is an already completed paho.Token
+type fakeToken struct {
+	err error
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Done() <-chan struct{}          { done := make(chan struct{}); close(done); return done }
+func (t fakeToken) Error() error                   { return t.err }
+
+// fakeMessage is a paho.Message delivered by fakeClient
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeClient answers publishes with the response returned by respond. The response is delivered to the subscribers
+// of the publish topic with the returned suffix, e.g. "/accepted". An empty suffix means no response.
+type fakeClient struct {
+	paho.Client
+	mu          sync.Mutex
+	subscribers map[string]paho.MessageHandler
+	published   []string
+	respond     func(topic string, payload []byte) (suffix string, response []byte)
+	// options are the options the client was created with, returned by OptionsReader
+	options *paho.ClientOptions
+	// connectErr and subscribeErr fail Connect and Subscribe
+	connectErr   error
+	subscribeErr error
+	connects     int
+	connected    bool
+}
+
+func newFakeClient(respond func(topic string, payload []byte) (string, []byte)) *fakeClient {
+	return &fakeClient{subscribers: map[string]paho.MessageHandler{}, respond: respond, options: paho.NewClientOptions()}
+}
+
+func (c *fakeClient) Connect() paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connects++
+	c.connected = c.connectErr == nil
+	return fakeToken{err: c.connectErr}
+}
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) OptionsReader() paho.ClientOptionsReader {
+	return paho.NewClient(c.options).OptionsReader()
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribeErr != nil {
+		return fakeToken{err: c.subscribeErr}
+	}
+	c.subscribers[topic] = callback
+	return fakeToken{}
+}
+
+func (c *fakeClient) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.subscribers[topic]
+	return ok
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subscribers, topic)
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	c.published = append(c.published, topic)
+	c.mu.Unlock()
+
+	suffix, response := c.respond(topic, payload.([]byte))
+	if suffix == "" {
+		return fakeToken{}
+	}
+
+	c.mu.Lock()
+	handler := c.subscribers[topic+suffix]
+	c.mu.Unlock()
+	if handler != nil {
+		handler(c, fakeMessage{topic: topic + suffix, payload: response})
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) publishedTo(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, topic := range c.published {
+		if strings.HasPrefix(topic, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+const createTopic = "$aws/certificates/create/json"
+
+func fleetProvisioningResponder(registerSuffix string, registerResponse string) func(string, []byte) (string, []byte) {
+	return func(topic string, payload []byte) (string, []byte) {
+		switch topic {
+		case createTopic:
+			return "/accepted", []byte(`{"certificateId": "cert-1", "certificatePem": "CERT", "privateKey": "KEY", "certificateOwnershipToken": "token-1"}`)
+		case "$aws/provisioning-templates/template/provision/json":
+			return registerSuffix, []byte(registerResponse)
+		}
+		return "", nil
+	}
+}
+
+func TestProvisioner_ResumesAtRegisterThing(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, thing.DefaultProvisioningStateFile)
+
+	// the first run never hears back from RegisterThing
+	client := newFakeClient(fleetProvisioningResponder("", ""))
+	p := &thing.Provisioner{
+		Client:          client,
+		TemplateName:    "template",
+		Store:           thing.NewFileCredentialStore(dir),
+		StatePath:       statePath,
+		MaxAttempts:     2,
+		InitialBackoff:  time.Millisecond,
+		ResponseTimeout: 10 * time.Millisecond,
+	}
+	_, err := p.Run(context.Background())
+	assert.Error(t, err, "provisioning fails without a RegisterThing response")
+	assert.Equal(t, 2, client.publishedTo("$aws/provisioning-templates/"), "RegisterThing was retried")
+
+	state := thing.ProvisioningState{}
+	data, err := ioutil.ReadFile(statePath)
+	assert.NoError(t, err, "the state is kept for resuming")
+	assert.NoError(t, json.Unmarshal(data, &state))
+	assert.Equal(t, thing.StepCertificateCreated, state.Step)
+	assert.Equal(t, "token-1", state.CertificateOwnershipToken)
+
+	// the second run resumes without creating another certificate
+	p.Client = newFakeClient(fleetProvisioningResponder("/accepted", `{"thingName": "thing-1", "deviceConfiguration": {"Fleet": "north"}}`))
+	result, err := p.Run(context.Background())
+	assert.NoError(t, err, "provisioning resumed without error")
+	assert.Equal(t, "thing-1", result.ThingName)
+	assert.Equal(t, "cert-1", result.CertificateID)
+	assert.Equal(t, map[string]string{"Fleet": "north"}, result.DeviceConfiguration)
+	assert.Equal(t, filepath.Join(dir, "cert.json"), result.Paths.MetadataPath)
+	assert.Equal(t, 0, p.Client.(*fakeClient).publishedTo(createTopic), "no second certificate was created")
+
+	state = thing.ProvisioningState{}
+	data, err = ioutil.ReadFile(statePath)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &state))
+	assert.Equal(t, thing.StepRegistered, state.Step)
+	assert.Equal(t, "thing-1", state.ThingName)
+	assert.Empty(t, state.CertificateOwnershipToken, "the ownership token is dropped once used")
+}
+
+func TestProvisioner_CleansUpOnTerminalFailure(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, thing.DefaultProvisioningStateFile)
+
+	client := newFakeClient(fleetProvisioningResponder("/rejected",
+		`{"statusCode": 400, "errorCode": "InvalidParameters", "errorMessage": "missing SerialNumber"}`))
+	p := &thing.Provisioner{
+		Client:       client,
+		TemplateName: "template",
+		Store:        thing.NewFileCredentialStore(dir),
+		StatePath:    statePath,
+	}
+	_, err := p.Run(context.Background())
+	assert.Error(t, err, "provisioning fails when RegisterThing is rejected")
+	assert.Equal(t, 1, client.publishedTo("$aws/provisioning-templates/"), "client errors are not retried")
+
+	var rejected *thing.AWSMQTTError
+	assert.True(t, errors.As(err, &rejected), "the rejection is returned as a typed error")
+	assert.Equal(t, 400, rejected.StatusCode)
+	assert.Equal(t, "InvalidParameters", rejected.ErrorCode)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0, "credentials and state are removed")
+	_, err = os.Stat(statePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProvisioner_CreateCertificateRetries(t *testing.T) {
+	// the first CreateKeysAndCertificate is throttled, the next one accepted
+	creates := 0
+	client := newFakeClient(func(topic string, payload []byte) (string, []byte) {
+		if topic == createTopic {
+			creates++
+			if creates == 1 {
+				return "/rejected", []byte(`{"statusCode": 429, "errorCode": "Throttling", "errorMessage": "slow down"}`)
+			}
+		}
+		return fleetProvisioningResponder("/accepted", `{"thingName": "thing-1"}`)(topic, payload)
+	})
+	p := &thing.Provisioner{
+		Client:         client,
+		TemplateName:   "template",
+		Store:          thing.NewFileCredentialStore(t.TempDir()),
+		InitialBackoff: time.Millisecond,
+	}
+	_, err := p.Run(context.Background())
+	assert.NoError(t, err, "throttled certificate request retried")
+	assert.Equal(t, 2, client.publishedTo(createTopic))
+
+	// CreateKeysAndCertificate never answers
+	client = newFakeClient(func(topic string, payload []byte) (string, []byte) { return "", nil })
+	p = &thing.Provisioner{
+		Client:          client,
+		TemplateName:    "template",
+		Store:           thing.NewFileCredentialStore(t.TempDir()),
+		InitialBackoff:  time.Millisecond,
+		ResponseTimeout: 10 * time.Millisecond,
+	}
+	_, err = p.Run(context.Background())
+	var noResponse *thing.NoResponseError
+	assert.True(t, errors.As(err, &noResponse), "missing response returned as a typed error")
+	assert.Equal(t, 1, client.publishedTo(createTopic), "certificate request without a response is not repeated")
+}
+
+func TestProvisioner_CBOR(t *testing.T) {
+	dir := t.TempDir()
+
+	client := newFakeClient(func(topic string, payload []byte) (string, []byte) {
+		switch topic {
+		case "$aws/certificates/create/cbor":
+			response, _ := codec.CBOR.Marshal(thing.CreateKeysAndCertificateAccepted{
+				CertificateID:             "cert-1",
+				CertificatePem:            "CERT",
+				PrivateKey:                "KEY",
+				CertificateOwnershipToken: "token-1",
+			})
+			return "/accepted", response
+		case "$aws/provisioning-templates/template/provision/cbor":
+			request := thing.RegisterThingRequest{}
+			assert.NoError(t, codec.CBOR.Unmarshal(payload, &request), "the request is CBOR encoded")
+			assert.Equal(t, "token-1", request.CertificateOwnershipToken)
+
+			response, _ := codec.CBOR.Marshal(thing.RegisterThingResponse{ThingName: "thing-1"})
+			return "/accepted", response
+		}
+		return "", nil
+	})
+	p := &thing.Provisioner{
+		Client:        client,
+		TemplateName:  "template",
+		Parameters:    map[string]string{"UniqueId": "1"},
+		Store:         thing.NewFileCredentialStore(dir),
+		PayloadFormat: thing.PayloadFormatCBOR,
+	}
+	result, err := p.Run(context.Background())
+	assert.NoError(t, err, "provisioned over the CBOR topics without error")
+	assert.Equal(t, "thing-1", result.ThingName)
+	assert.Equal(t, 0, client.publishedTo("$aws/certificates/create/json"), "the JSON topics are not used")
+}
@@ -0,0 +1,232 @@
+package thing
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// TrafficClass identifies the budget a publish is charged against
+type TrafficClass int
+
+const (
+	// TelemetryTraffic covers publishes to custom topics
+	TelemetryTraffic TrafficClass = iota
+	// ShadowTraffic covers requests to the device shadow topics
+	ShadowTraffic
+	// JobsTraffic covers requests to the IoT Core Jobs topics
+	JobsTraffic
+)
+
+// String returns the name of the traffic class
+func (c TrafficClass) String() string {
+	switch c {
+	case TelemetryTraffic:
+		return "telemetry"
+	case ShadowTraffic:
+		return "shadow"
+	case JobsTraffic:
+		return "jobs"
+	default:
+		return "unknown"
+	}
+}
+
+// ThrottleMode decides what happens to a publish that exceeds the budget
+type ThrottleMode int
+
+const (
+	// ThrottleBlock delays the publish until the budget allows it
+	ThrottleBlock ThrottleMode = iota
+	// ThrottleShed drops the publish and returns ErrThrottled
+	ThrottleShed
+)
+
+// AWS IoT Core quotas the default rate limiter configuration is based on.
+// https://docs.aws.amazon.com/general/latest/gr/iot-core.html
+const (
+	// DefaultPublishesPerSecond is the per-connection publish quota
+	DefaultPublishesPerSecond = 100
+	// DefaultBytesPerSecond is the per-connection throughput quota
+	DefaultBytesPerSecond = 512 * 1024
+	// DefaultShadowRequestsPerSecond is the per-thing device shadow request quota
+	DefaultShadowRequestsPerSecond = 20
+	// DefaultJobsRequestsPerSecond is a conservative per-thing budget for the Jobs topics
+	DefaultJobsRequestsPerSecond = 10
+)
+
+// ErrThrottled is returned when a publish is shed by the rate limiter
+var ErrThrottled = errors.New("publish throttled by the client-side rate limit")
+
+// RateLimiterConfig holds the budgets enforced by a RateLimiter. A zero rate disables the corresponding budget.
+type RateLimiterConfig struct {
+	// PublishesPerSecond is shared by all traffic classes
+	PublishesPerSecond float64
+	// BytesPerSecond is shared by all traffic classes
+	BytesPerSecond float64
+	// ClassRates holds the publishes per second allowed for each traffic class
+	ClassRates map[TrafficClass]float64
+	// Mode selects between blocking and shedding publishes over budget
+	Mode ThrottleMode
+}
+
+// DefaultRateLimiterConfig returns a blocking configuration matching the AWS IoT Core quotas
+func DefaultRateLimiterConfig() RateLimiterConfig {
+	return RateLimiterConfig{
+		PublishesPerSecond: DefaultPublishesPerSecond,
+		BytesPerSecond:     DefaultBytesPerSecond,
+		ClassRates: map[TrafficClass]float64{
+			ShadowTraffic: DefaultShadowRequestsPerSecond,
+			JobsTraffic:   DefaultJobsRequestsPerSecond,
+		},
+		Mode: ThrottleBlock,
+	}
+}
+
+// ThrottleStats holds the rate limiter counters of a traffic class
+type ThrottleStats struct {
+	// Allowed is the number of publishes let through, including the delayed ones
+	Allowed uint64
+	// Delayed is the number of publishes that had to wait for the budget
+	Delayed uint64
+	// Shed is the number of publishes dropped with ErrThrottled
+	Shed uint64
+	// TotalDelay is the accumulated time publishes spent waiting
+	TotalDelay time.Duration
+}
+
+// RateLimiter is a token-bucket limiter for the publishes of a single MQTT connection
+type RateLimiter struct {
+	mu        sync.Mutex
+	mode      ThrottleMode
+	publishes *tokenBucket
+	bytes     *tokenBucket
+	classes   map[TrafficClass]*tokenBucket
+	stats     map[TrafficClass]*ThrottleStats
+}
+
+// NewRateLimiter returns a new instance of RateLimiter
+func NewRateLimiter(cfg RateLimiterConfig) *RateLimiter {
+	now := time.Now()
+	l := &RateLimiter{
+		mode:      cfg.Mode,
+		publishes: newTokenBucket(cfg.PublishesPerSecond, now),
+		bytes:     newTokenBucket(cfg.BytesPerSecond, now),
+		classes:   make(map[TrafficClass]*tokenBucket),
+		stats:     make(map[TrafficClass]*ThrottleStats),
+	}
+	for class, rate := range cfg.ClassRates {
+		l.classes[class] = newTokenBucket(rate, now)
+	}
+	return l
+}
+
+// Wait charges a publish of the given size against the budgets. In blocking mode it sleeps until the publish fits the
+// budgets, in shedding mode it returns ErrThrottled instead. A nil RateLimiter allows everything.
+func (l *RateLimiter) Wait(class TrafficClass, size int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	stats, ok := l.stats[class]
+	if !ok {
+		stats = &ThrottleStats{}
+		l.stats[class] = stats
+	}
+
+	now := time.Now()
+	type charge struct {
+		bucket *tokenBucket
+		n      float64
+	}
+	charges := []charge{{l.publishes, 1}, {l.bytes, float64(size)}, {l.classes[class], 1}}
+
+	var delay time.Duration
+	for _, c := range charges {
+		if c.bucket == nil {
+			continue
+		}
+		c.bucket.advance(now)
+		if d := c.bucket.delay(c.n); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > 0 && l.mode == ThrottleShed {
+		stats.Shed++
+		l.mu.Unlock()
+		return ErrThrottled
+	}
+
+	for _, c := range charges {
+		if c.bucket != nil {
+			c.bucket.tokens -= c.n
+		}
+	}
+	stats.Allowed++
+	if delay > 0 {
+		stats.Delayed++
+		stats.TotalDelay += delay
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the throttle counters per traffic class
+func (l *RateLimiter) Stats() map[TrafficClass]ThrottleStats {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make(map[TrafficClass]ThrottleStats, len(l.stats))
+	for class, s := range l.stats {
+		stats[class] = *s
+	}
+	return stats
+}
+
+// tokenBucket refills at rate tokens per second up to one second worth of tokens. The token count goes negative when
+// blocking publishes reserve tokens ahead of time.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) advance(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// delay returns how long to wait until n tokens are available. Requests larger than the bucket only need a full bucket.
+func (b *tokenBucket) delay(n float64) time.Duration {
+	if n > b.rate {
+		n = b.rate
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,69 @@
+package thing_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Shed(t *testing.T) {
+	limiter := thing.NewRateLimiter(thing.RateLimiterConfig{
+		PublishesPerSecond: 100,
+		ClassRates:         map[thing.TrafficClass]float64{thing.ShadowTraffic: 2},
+		Mode:               thing.ThrottleShed,
+	})
+
+	assert.NoError(t, limiter.Wait(thing.ShadowTraffic, 10), "first shadow publish is allowed")
+	assert.NoError(t, limiter.Wait(thing.ShadowTraffic, 10), "second shadow publish is allowed")
+	assert.ErrorIs(t, limiter.Wait(thing.ShadowTraffic, 10), thing.ErrThrottled, "third shadow publish is shed")
+	assert.NoError(t, limiter.Wait(thing.TelemetryTraffic, 10), "telemetry has its own budget")
+
+	stats := limiter.Stats()
+	assert.Equal(t, uint64(2), stats[thing.ShadowTraffic].Allowed)
+	assert.Equal(t, uint64(1), stats[thing.ShadowTraffic].Shed)
+	assert.Equal(t, uint64(1), stats[thing.TelemetryTraffic].Allowed)
+}
+
+func TestRateLimiter_Block(t *testing.T) {
+	limiter := thing.NewRateLimiter(thing.RateLimiterConfig{
+		BytesPerSecond: 1000,
+		Mode:           thing.ThrottleBlock,
+	})
+
+	start := time.Now()
+	assert.NoError(t, limiter.Wait(thing.TelemetryTraffic, 1000), "a full bucket is allowed immediately")
+	assert.NoError(t, limiter.Wait(thing.TelemetryTraffic, 100), "the next publish waits for the budget")
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond, "the publish was delayed")
+
+	stats := limiter.Stats()[thing.TelemetryTraffic]
+	assert.Equal(t, uint64(2), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Delayed)
+	assert.Equal(t, uint64(0), stats.Shed)
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var limiter *thing.RateLimiter
+	assert.NoError(t, limiter.Wait(thing.JobsTraffic, 1), "a nil limiter allows everything")
+	assert.Nil(t, limiter.Stats())
+}
+
+func TestThing_SetRateLimiterConcurrently(t *testing.T) {
+	th := &thing.Thing{}
+	limiter := thing.NewRateLimiter(thing.RateLimiterConfig{PublishesPerSecond: 100})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			th.SetRateLimiter(limiter)
+			assert.NoError(t, th.SetPublishQoS(byte(i%2)))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		th.ThrottleStats()
+	}
+	<-done
+	assert.NotNil(t, th.ThrottleStats(), "rate limiter set while the thing is in use")
+}
@@ -0,0 +1,297 @@
+package thing
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
+)
+
+const (
+	// DefaultRenewBefore is how long before its expiry CertificateRotator replaces the certificate
+	DefaultRenewBefore = 30 * 24 * time.Hour
+	// DefaultRotationCheckInterval is how often CertificateRotator.Run checks the certificate expiry
+	DefaultRotationCheckInterval = 12 * time.Hour
+)
+
+// CertificateExpiry returns the end of the validity period of the first certificate in the PEM data
+func CertificateExpiry(certPEM []byte) (time.Time, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate found in PEM data")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return cert.NotAfter, nil
+	}
+}
+
+// RotationSource obtains a new certificate over the current connection of the thing
+type RotationSource interface {
+	NewCertificate(ctx context.Context, c paho.Client) (CreateKeysAndCertificateAccepted, error)
+}
+
+// CSRRotationSource generates a new private key locally and requests the certificate with CreateCertificateFromCsr.
+// The new certificate is inactive until it is registered, so with a template name the certificate is registered with
+// RegisterThing, which activates it and attaches it to the thing. The policy of the current certificate has to allow
+// both requests.
+type CSRRotationSource struct {
+	CSR          CSROptions
+	TemplateName string
+	Parameters   map[string]string
+	// PayloadFormat selects the JSON or CBOR provisioning topics, defaults to JSON
+	PayloadFormat PayloadFormat
+}
+
+// NewCertificate implements RotationSource
+func (s *CSRRotationSource) NewCertificate(ctx context.Context, c paho.Client) (CreateKeysAndCertificateAccepted, error) {
+	keyPEM, csrPEM, err := GenerateKeyAndCSR(s.CSR)
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, err
+	}
+
+	accepted, err := createCertificateFromCsr(ctx, c, s.PayloadFormat, csrPEM)
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	if s.TemplateName != "" {
+		if _, err := registerThing(ctx, c, s.PayloadFormat, s.TemplateName, accepted.CertificateOwnershipToken, s.Parameters); err != nil {
+			return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to register certificate: %w", err)
+		}
+	}
+
+	return CreateKeysAndCertificateAccepted{
+		CertificateID:             accepted.CertificateID,
+		CertificatePem:            accepted.CertificatePem,
+		PrivateKey:                string(keyPEM),
+		CertificateOwnershipToken: accepted.CertificateOwnershipToken,
+	}, nil
+}
+
+// TopicRotationSource generates a new private key locally and sends the CSR to a custom topic served by your own
+// backend. The request is {"certificateSigningRequest": "<PEM>"}, the backend answers on <topic>/accepted with
+// {"certificateId": "...", "certificatePem": "..."} or on <topic>/rejected with an AWSMQTTError. The backend is
+// responsible for activating the certificate and attaching it to the thing.
+type TopicRotationSource struct {
+	Topic string
+	CSR   CSROptions
+}
+
+// NewCertificate implements RotationSource
+func (s *TopicRotationSource) NewCertificate(ctx context.Context, c paho.Client) (CreateKeysAndCertificateAccepted, error) {
+	keyPEM, csrPEM, err := GenerateKeyAndCSR(s.CSR)
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, err
+	}
+
+	reqJSON, err := json.Marshal(CreateCertificateFromCsrRequest{CertificateSigningRequest: string(csrPEM)})
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to marshal rotation request: %v", err)
+	}
+
+	response, err := mqttRequest(ctx, c, s.Topic, codec.JSON, reqJSON)
+	if err != nil {
+		return CreateKeysAndCertificateAccepted{}, err
+	}
+
+	accepted := CreateCertificateFromCsrAccepted{}
+	if err := json.Unmarshal(response, &accepted); err != nil {
+		return CreateKeysAndCertificateAccepted{}, fmt.Errorf("failed to unmarshal rotation response: %w", err)
+	}
+	if accepted.CertificatePem == "" {
+		return CreateKeysAndCertificateAccepted{}, errors.New("rotation response has no certificate")
+	}
+
+	return CreateKeysAndCertificateAccepted{
+		CertificateID:  accepted.CertificateID,
+		CertificatePem: accepted.CertificatePem,
+		PrivateKey:     string(keyPEM),
+	}, nil
+}
+
+// RotationResult describes a completed certificate rotation
+type RotationResult struct {
+	CertificateID  string          `json:"certificateId"`
+	NotAfter       time.Time       `json:"notAfter"`
+	PreviousExpiry time.Time       `json:"previousExpiry"`
+	RotatedAt      time.Time       `json:"rotatedAt"`
+	Paths          CredentialPaths `json:"-"`
+}
+
+// CertificateRotator replaces the certificate of a thing before it expires. The new credentials are saved to the store
+// atomically and the thing is reconnected with them. If the reconnect fails, the previous credentials are restored. If
+// only renewing the subscriptions fails, the new credentials are kept along with the new connection.
+type CertificateRotator struct {
+	Thing  *Thing
+	Store  CredentialStore
+	Source RotationSource
+	// RenewBefore is how long before its expiry the certificate is replaced, defaults to DefaultRenewBefore
+	RenewBefore time.Duration
+	// CheckInterval is how often Run checks the certificate, defaults to DefaultRotationCheckInterval
+	CheckInterval time.Duration
+	// ResponseTimeout is how long to wait for the new certificate, defaults to 30 seconds
+	ResponseTimeout time.Duration
+	// ReportToShadow reports every rotation as the certificate property of the reported shadow state
+	ReportToShadow bool
+	// OnError is called by Run with errors of failed checks and rotations, which are retried at the next check
+	OnError func(err error)
+}
+
+// NeedsRotation reports whether the stored certificate expires within RenewBefore, along with its expiry
+func (r *CertificateRotator) NeedsRotation() (bool, time.Time, error) {
+	cert, _, err := r.Store.Load()
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	notAfter, err := CertificateExpiry(cert)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	renewBefore := r.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = DefaultRenewBefore
+	}
+	return time.Until(notAfter) < renewBefore, notAfter, nil
+}
+
+// Rotate replaces the certificate regardless of its expiry
+func (r *CertificateRotator) Rotate(ctx context.Context) (*RotationResult, error) {
+	if r.Thing == nil || r.Store == nil || r.Source == nil {
+		return nil, errors.New("certificate rotator needs a thing, a credential store and a rotation source")
+	}
+
+	var previousExpiry time.Time
+	if cert, _, err := r.Store.Load(); err == nil {
+		previousExpiry, _ = CertificateExpiry(cert)
+	}
+
+	timeout := r.ResponseTimeout
+	if timeout <= 0 {
+		timeout = defaultResponseTimeout
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	certs, err := r.Source.NewCertificate(requestCtx, r.Thing.mqttClient())
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain new certificate: %w", err)
+	}
+
+	notAfter, err := CertificateExpiry([]byte(certs.CertificatePem))
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := r.Store.Save(certs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save new certificate: %w", err)
+	}
+
+	reconnectErr := r.Thing.Reconnect([]byte(certs.CertificatePem), []byte(certs.PrivateKey))
+	var renewalErr *SubscriptionRenewalError
+	if reconnectErr != nil && !errors.As(reconnectErr, &renewalErr) {
+		if rollbackErr := saved.Rollback(); rollbackErr != nil {
+			return nil, fmt.Errorf("%w (restoring previous certificate: %v)", reconnectErr, rollbackErr)
+		}
+		return nil, reconnectErr
+	}
+
+	result := &RotationResult{
+		CertificateID:  certs.CertificateID,
+		NotAfter:       notAfter,
+		PreviousExpiry: previousExpiry,
+		RotatedAt:      time.Now().UTC(),
+		Paths:          saved.CredentialPaths,
+	}
+
+	// the thing is connected with the new certificate, so it is kept even if a subscription was not renewed
+	if reconnectErr != nil {
+		return result, fmt.Errorf("certificate rotated, but %w", reconnectErr)
+	}
+	if r.ReportToShadow {
+		if err := r.reportToShadow(result); err != nil {
+			return result, fmt.Errorf("certificate rotated, but failed to report it: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// RotateForJob rotates the certificate as the execution of the job and reports the outcome as the job status
+func (r *CertificateRotator) RotateForJob(ctx context.Context, jobID string) (*RotationResult, error) {
+	result, err := r.Rotate(ctx)
+	if result == nil {
+		if reportErr := r.Thing.UpdateJobExecution(jobID, JobFailed, map[string]string{"reason": err.Error()}); reportErr != nil {
+			return nil, fmt.Errorf("%w (reporting job failure: %v)", err, reportErr)
+		}
+		return nil, err
+	}
+
+	details := map[string]string{
+		"certificateId": result.CertificateID,
+		"notAfter":      result.NotAfter.Format(time.RFC3339),
+	}
+	if reportErr := r.Thing.UpdateJobExecution(jobID, JobSucceeded, details); reportErr != nil && err == nil {
+		err = fmt.Errorf("certificate rotated, but failed to report job success: %w", reportErr)
+	}
+	return result, err
+}
+
+// RotateIfNeeded rotates the certificate if it expires within RenewBefore. It returns a nil result if the certificate
+// was not rotated.
+func (r *CertificateRotator) RotateIfNeeded(ctx context.Context) (*RotationResult, error) {
+	needed, _, err := r.NeedsRotation()
+	if err != nil || !needed {
+		return nil, err
+	}
+	return r.Rotate(ctx)
+}
+
+// Run checks the certificate every CheckInterval and rotates it when needed, until the context is done
+func (r *CertificateRotator) Run(ctx context.Context) error {
+	interval := r.CheckInterval
+	if interval <= 0 {
+		interval = DefaultRotationCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.RotateIfNeeded(ctx); err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *CertificateRotator) reportToShadow(result *RotationResult) error {
+	shadow, err := json.Marshal(map[string]interface{}{
+		"state": map[string]interface{}{
+			"reported": map[string]interface{}{
+				"certificate": result,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal shadow: %w", err)
+	}
+	return r.Thing.UpdateThingShadow(shadow)
+}
@@ -0,0 +1,197 @@
+package thing_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/thing"
+	"github.com/stretchr/testify/assert"
+)
+
+func selfSignedCertificate(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCertificateRotator_NeedsRotation(t *testing.T) {
+	for _, tc := range []struct {
+		validFor time.Duration
+		needed   bool
+	}{
+		{validFor: 365 * 24 * time.Hour, needed: false},
+		{validFor: 7 * 24 * time.Hour, needed: true},
+	} {
+		store := thing.NewFileCredentialStore(t.TempDir())
+		notAfter := time.Now().Add(tc.validFor).Truncate(time.Second).UTC()
+		_, err := store.Save(thing.CreateKeysAndCertificateAccepted{
+			CertificatePem: string(selfSignedCertificate(t, notAfter)),
+			PrivateKey:     "KEY",
+		})
+		assert.NoError(t, err)
+
+		rotator := &thing.CertificateRotator{Store: store}
+		needed, expiry, err := rotator.NeedsRotation()
+		assert.NoError(t, err, "certificate expiry read without error")
+		assert.Equal(t, tc.needed, needed, "rotation needed for a certificate valid for %s", tc.validFor)
+		assert.True(t, notAfter.Equal(expiry))
+	}
+
+	_, err := thing.CertificateExpiry([]byte("not a certificate"))
+	assert.Error(t, err, "data without a certificate is rejected")
+}
+
+func TestTopicRotationSource(t *testing.T) {
+	certPEM := selfSignedCertificate(t, time.Now().Add(time.Hour))
+	client := newFakeClient(func(topic string, payload []byte) (string, []byte) {
+		request := thing.CreateCertificateFromCsrRequest{}
+		assert.NoError(t, json.Unmarshal(payload, &request))
+		assert.Contains(t, request.CertificateSigningRequest, "CERTIFICATE REQUEST")
+
+		response, _ := json.Marshal(thing.CreateCertificateFromCsrAccepted{CertificateID: "cert-2", CertificatePem: string(certPEM)})
+		return "/accepted", response
+	})
+
+	source := &thing.TopicRotationSource{Topic: "fleet/rotate/device-1"}
+	certs, err := source.NewCertificate(context.Background(), client)
+	assert.NoError(t, err, "new certificate obtained without error")
+	assert.Equal(t, "cert-2", certs.CertificateID)
+	assert.Equal(t, string(certPEM), certs.CertificatePem)
+	assert.Contains(t, certs.PrivateKey, "PRIVATE KEY", "the private key is generated locally")
+}
+
+// signCSR returns a certificate for the public key of the CSR, signed by a throwaway CA
+func signCSR(t *testing.T, csrPEM string, notAfter time.Time) string {
+	block, _ := pem.Decode([]byte(csrPEM))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(t, err)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rotation CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, caKey)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCertificateRotator_Rotate(t *testing.T) {
+	oldCert := string(selfSignedCertificate(t, time.Now().Add(7*24*time.Hour)))
+	notAfter := time.Now().Add(365 * 24 * time.Hour).Truncate(time.Second).UTC()
+
+	for _, tc := range []struct {
+		name         string
+		connectErr   error
+		subscribeErr error
+		rotated      bool
+	}{
+		{name: "reconnected", rotated: true},
+		{name: "connection refused", connectErr: errors.New("not authorized")},
+		{name: "subscription not renewed", subscribeErr: errors.New("subscription rejected"), rotated: true},
+	} {
+		store := thing.NewFileCredentialStore(t.TempDir())
+		_, err := store.Save(thing.CreateKeysAndCertificateAccepted{CertificateID: "cert-1", CertificatePem: oldCert, PrivateKey: "KEY"})
+		assert.NoError(t, err)
+
+		previous := newFakeClient(func(topic string, payload []byte) (string, []byte) {
+			if topic != "fleet/rotate/device-1" {
+				return "", nil
+			}
+			request := thing.CreateCertificateFromCsrRequest{}
+			assert.NoError(t, json.Unmarshal(payload, &request))
+			response, _ := json.Marshal(thing.CreateCertificateFromCsrAccepted{
+				CertificateID:  "cert-2",
+				CertificatePem: signCSR(t, request.CertificateSigningRequest, notAfter),
+			})
+			return "/accepted", response
+		})
+		previous.options.AddBroker("ssl://example.iot.eu-west-1.amazonaws.com:8883").SetClientID("device-1")
+		previous.connected = true
+
+		var next *fakeClient
+		thing.SetNewClient(t, func(o *paho.ClientOptions) paho.Client {
+			next = newFakeClient(func(string, []byte) (string, []byte) { return "", nil })
+			next.options = o
+			next.connectErr = tc.connectErr
+			next.subscribeErr = tc.subscribeErr
+			return next
+		})
+
+		th := thing.NewThingWithClient(previous, "device-1")
+		_, err = th.SubscribeForCustomTopic("fleet/commands/device-1")
+		assert.NoError(t, err)
+
+		rotator := &thing.CertificateRotator{
+			Thing:  th,
+			Store:  store,
+			Source: &thing.TopicRotationSource{Topic: "fleet/rotate/device-1"},
+		}
+		result, err := rotator.Rotate(context.Background())
+
+		cert, _, loadErr := store.Load()
+		assert.NoError(t, loadErr, tc.name)
+		if !tc.rotated {
+			assert.Error(t, err, tc.name)
+			assert.Nil(t, result, tc.name)
+			assert.Equal(t, oldCert, string(cert), "%s: the previous certificate is restored", tc.name)
+			assert.True(t, previous.IsConnectionOpen(), "%s: the previous connection is restored", tc.name)
+			continue
+		}
+
+		assert.Equal(t, "cert-2", result.CertificateID, tc.name)
+		assert.True(t, notAfter.Equal(result.NotAfter), tc.name)
+		assert.NotEqual(t, oldCert, string(cert), "%s: the new certificate is kept", tc.name)
+		assert.True(t, next.IsConnectionOpen(), "%s: the thing is connected with the new certificate", tc.name)
+		assert.False(t, previous.IsConnectionOpen(), "%s: the previous connection is closed", tc.name)
+
+		reader := next.OptionsReader()
+		assert.Equal(t, "device-1", reader.ClientID(), "%s: the client ID is kept", tc.name)
+		assert.Equal(t, "example.iot.eu-west-1.amazonaws.com", reader.Servers()[0].Hostname(), "%s: the endpoint is kept", tc.name)
+
+		if tc.subscribeErr != nil {
+			var renewalErr *thing.SubscriptionRenewalError
+			assert.True(t, errors.As(err, &renewalErr), "%s: %v", tc.name, err)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.True(t, next.subscribed("fleet/commands/device-1"), "%s: the subscription is renewed", tc.name)
+	}
+}
@@ -31,7 +31,7 @@ func (t *Thing) GetThingShadow() (Shadow, error) {
 		fmt.Sprintf("$aws/things/%s/shadow/get/rejected", t.thingName),
 	)
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/get/accepted", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -41,7 +41,7 @@ func (t *Thing) GetThingShadow() (Shadow, error) {
 		return nil, token.Error()
 	}
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/get/rejected", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -51,13 +51,13 @@ func (t *Thing) GetThingShadow() (Shadow, error) {
 		return nil, token.Error()
 	}
 
-	if token := t.client.Publish(
+	if err := t.publish(
+		ShadowTraffic,
 		fmt.Sprintf("$aws/things/%s/shadow/get", t.thingName),
 		0,
-		false,
 		[]byte("{}"),
-	); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	); err != nil {
+		return nil, err
 	}
 
 	for {
@@ -76,11 +76,13 @@ func (t *Thing) GetThingShadow() (Shadow, error) {
 	}
 }
 
-// UpdateThingShadow publishes an async message with new thing shadow
+// UpdateThingShadow publishes an async message with new thing shadow. Shadows that are not valid JSON or exceed the
+// shadow size limits are rejected with an InvalidJSONError or PayloadTooLargeError before publishing.
 func (t *Thing) UpdateThingShadow(payload Shadow) error {
-	token := t.client.Publish(fmt.Sprintf("$aws/things/%s/shadow/update", t.thingName), 1, false, []byte(payload))
-	token.Wait()
-	return token.Error()
+	if err := validateShadow(payload); err != nil {
+		return err
+	}
+	return t.publish(ShadowTraffic, fmt.Sprintf("$aws/things/%s/shadow/update", t.thingName), 1, payload)
 }
 
 // SubscribeForThingShadowChanges subscribes for the device shadow update topic and returns two channels: shadow and shadow error.
@@ -90,7 +92,7 @@ func (t *Thing) SubscribeForThingShadowChanges() (chan Shadow, chan ShadowError,
 	shadowChan := make(chan Shadow)
 	shadowErrChan := make(chan ShadowError)
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/update/accepted", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -100,7 +102,7 @@ func (t *Thing) SubscribeForThingShadowChanges() (chan Shadow, chan ShadowError,
 		return nil, nil, token.Error()
 	}
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/update/rejected", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -113,11 +115,13 @@ func (t *Thing) SubscribeForThingShadowChanges() (chan Shadow, chan ShadowError,
 	return shadowChan, shadowErrChan, nil
 }
 
-// UpdateThingShadowDocument publishes an async message with new thing shadow document
+// UpdateThingShadowDocument publishes an async message with new thing shadow document. It is validated the same way
+// as UpdateThingShadow.
 func (t *Thing) UpdateThingShadowDocument(payload Shadow) error {
-	token := t.client.Publish(fmt.Sprintf("$aws/things/%s/shadow/update/documents", t.thingName), 0, false, []byte(payload))
-	token.Wait()
-	return token.Error()
+	if err := validateShadow(payload); err != nil {
+		return err
+	}
+	return t.publish(ShadowTraffic, fmt.Sprintf("$aws/things/%s/shadow/update/documents", t.thingName), 0, payload)
 }
 
 // DeleteThingShadow publishes a message to remove the device's shadow and waits for the result. In case shadow delete was
@@ -131,7 +135,7 @@ func (t *Thing) DeleteThingShadow() error {
 		fmt.Sprintf("$aws/things/%s/shadow/delete/rejected", t.thingName),
 	)
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/delete/accepted", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -141,7 +145,7 @@ func (t *Thing) DeleteThingShadow() error {
 		return token.Error()
 	}
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		fmt.Sprintf("$aws/things/%s/shadow/delete/rejected", t.thingName),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
@@ -151,13 +155,13 @@ func (t *Thing) DeleteThingShadow() error {
 		return token.Error()
 	}
 
-	if token := t.client.Publish(
+	if err := t.publish(
+		ShadowTraffic,
 		fmt.Sprintf("$aws/things/%s/shadow/delete", t.thingName),
 		0,
-		false,
 		[]byte("{}"),
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	); err != nil {
+		return err
 	}
 
 	for {
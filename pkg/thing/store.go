@@ -0,0 +1,274 @@
+package thing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	certificateFileName  = "device.certificate.pem"
+	privateKeyFileName   = "device.private.key"
+	encryptedKeyFileName = "device.private.key.enc"
+	certificateMetaFile  = "cert.json"
+	certificateFileMode  = 0644
+	privateKeyFileMode   = 0600
+	certificateMetaMode  = 0600
+	encryptionKeySize    = 32
+)
+
+// CredentialPaths holds the locations of stored device credentials
+type CredentialPaths struct {
+	CertificatePath string `json:"certificatePath"`
+	PrivateKeyPath  string `json:"privateKeyPath"`
+	MetadataPath    string `json:"metadataPath"`
+}
+
+// SavedCredentials is returned by CredentialStore.Save
+type SavedCredentials struct {
+	CredentialPaths
+	// Rollback undoes the save, restoring the files it replaced and removing the ones it created
+	Rollback func() error
+}
+
+// CredentialStore persists the certificate and private key produced by provisioning
+type CredentialStore interface {
+	// Save stores the certificate, private key and metadata. Either all of them are stored or none.
+	Save(certs CreateKeysAndCertificateAccepted) (*SavedCredentials, error)
+	// Load returns the PEM encoded certificate and private key
+	Load() (certificatePEM []byte, privateKeyPEM []byte, err error)
+	// Delete removes the stored credentials
+	Delete() error
+}
+
+// certificateMetadata is written to cert.json next to the certificate, it never contains the private key
+type certificateMetadata struct {
+	CertificateID             string `json:"certificateId"`
+	CertificatePem            string `json:"certificatePem"`
+	CertificateOwnershipToken string `json:"certificateOwnershipToken"`
+}
+
+// FileCredentialStore stores the credentials as files in a directory. Every file is written to a temporary file,
+// synced and renamed into place, and the private key is only readable by its owner.
+type FileCredentialStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// NewFileCredentialStore returns a store writing device.certificate.pem, device.private.key and cert.json to dir
+func NewFileCredentialStore(dir string) *FileCredentialStore {
+	return &FileCredentialStore{dir: dir}
+}
+
+// NewEncryptedFileCredentialStore returns a store that encrypts the private key at rest with AES-256-GCM under the
+// 32 byte key. The private key is written to device.private.key.enc and must be read back with Load.
+func NewEncryptedFileCredentialStore(dir string, key []byte) (*FileCredentialStore, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return &FileCredentialStore{dir: dir, aead: aead}, nil
+}
+
+// Paths returns the locations the store writes to
+func (s *FileCredentialStore) Paths() CredentialPaths {
+	keyFile := privateKeyFileName
+	if s.aead != nil {
+		keyFile = encryptedKeyFileName
+	}
+	return CredentialPaths{
+		CertificatePath: filepath.Join(s.dir, certificateFileName),
+		PrivateKeyPath:  filepath.Join(s.dir, keyFile),
+		MetadataPath:    filepath.Join(s.dir, certificateMetaFile),
+	}
+}
+
+// Save implements CredentialStore
+func (s *FileCredentialStore) Save(certs CreateKeysAndCertificateAccepted) (*SavedCredentials, error) {
+	paths := s.Paths()
+
+	privateKey := []byte(certs.PrivateKey)
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		privateKey = s.aead.Seal(nonce, nonce, privateKey, nil)
+	}
+
+	metadata, err := json.MarshalIndent(certificateMetadata{
+		CertificateID:             certs.CertificateID,
+		CertificatePem:            certs.CertificatePem,
+		CertificateOwnershipToken: certs.CertificateOwnershipToken,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal certificate metadata: %v", err)
+	}
+
+	files := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{paths.PrivateKeyPath, privateKey, privateKeyFileMode},
+		{paths.CertificatePath, []byte(certs.CertificatePem), certificateFileMode},
+		{paths.MetadataPath, metadata, certificateMetaMode},
+	}
+
+	var undo []func() error
+	rollback := func() error {
+		var firstErr error
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := syncDir(s.dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		undo = nil
+		return firstErr
+	}
+
+	for _, f := range files {
+		restore, err := backupFile(f.path)
+		if err != nil {
+			_ = rollback()
+			return nil, err
+		}
+		if err := writeFileAtomic(f.path, f.data, f.mode); err != nil {
+			_ = rollback()
+			return nil, fmt.Errorf("failed to write %s: %w", filepath.Base(f.path), err)
+		}
+		undo = append(undo, restore)
+	}
+
+	if err := syncDir(s.dir); err != nil {
+		_ = rollback()
+		return nil, err
+	}
+
+	return &SavedCredentials{CredentialPaths: paths, Rollback: rollback}, nil
+}
+
+// Load implements CredentialStore
+func (s *FileCredentialStore) Load() ([]byte, []byte, error) {
+	paths := s.Paths()
+
+	certificatePEM, err := ioutil.ReadFile(paths.CertificatePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	privateKey, err := ioutil.ReadFile(paths.PrivateKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	if s.aead != nil {
+		if len(privateKey) < s.aead.NonceSize() {
+			return nil, nil, errors.New("encrypted private key is truncated")
+		}
+		nonce, sealed := privateKey[:s.aead.NonceSize()], privateKey[s.aead.NonceSize():]
+		privateKey, err = s.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt private key: %w", err)
+		}
+	}
+
+	return certificatePEM, privateKey, nil
+}
+
+// Delete implements CredentialStore
+func (s *FileCredentialStore) Delete() error {
+	paths := s.Paths()
+	for _, path := range []string{paths.PrivateKeyPath, paths.CertificatePath, paths.MetadataPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// backupFile keeps the current content of the file in memory and returns a function putting it back. If the file does
+// not exist the function removes it instead.
+func backupFile(path string) (func() error, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return func() error {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	return func() error {
+		return writeFileAtomic(path, data, info.Mode().Perm())
+	}, nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory, syncs it and renames it over path, so
+// readers see either the old or the new content
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// syncDir flushes renames in the directory to disk. Windows does not support syncing directories.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
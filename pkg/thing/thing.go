@@ -5,7 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"path"
-	"time"
+	"sync"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
@@ -17,32 +17,42 @@ type ThingName = string
 
 // Thing a structure for working with the AWS IoT device shadows
 type Thing struct {
-	client    paho.Client
-	thingName ThingName
-}
-
-// RootPEM is the  Amazon Root CA for IoT Core - Subject to change (but likely not often)
-// https://www.amazontrust.com/repository/AmazonRootCA1.pem
-const RootPEM = `-----BEGIN CERTIFICATE-----
-MIIDQTCCAimgAwIBAgITBmyfz5m/jAo54vB4ikPmljZbyjANBgkqhkiG9w0BAQsF
-ADA5MQswCQYDVQQGEwJVUzEPMA0GA1UEChMGQW1hem9uMRkwFwYDVQQDExBBbWF6
-b24gUm9vdCBDQSAxMB4XDTE1MDUyNjAwMDAwMFoXDTM4MDExNzAwMDAwMFowOTEL
-MAkGA1UEBhMCVVMxDzANBgNVBAoTBkFtYXpvbjEZMBcGA1UEAxMQQW1hem9uIFJv
-b3QgQ0EgMTCCASIwDQYJKoZIhvcNAQEBBQADggEPADCCAQoCggEBALJ4gHHKeNXj
-ca9HgFB0fW7Y14h29Jlo91ghYPl0hAEvrAIthtOgQ3pOsqTQNroBvo3bSMgHFzZM
-9O6II8c+6zf1tRn4SWiw3te5djgdYZ6k/oI2peVKVuRF4fn9tBb6dNqcmzU5L/qw
-IFAGbHrQgLKm+a/sRxmPUDgH3KKHOVj4utWp+UhnMJbulHheb4mjUcAwhmahRWa6
-VOujw5H5SNz/0egwLX0tdHA114gk957EWW67c4cX8jJGKLhD+rcdqsq08p8kDi1L
-93FcXmn/6pUCyziKrlA4b9v7LWIbxcceVOF34GfID5yHI9Y/QCB/IIDEgEw+OyQm
-jgSubJrIqg0CAwEAAaNCMEAwDwYDVR0TAQH/BAUwAwEB/zAOBgNVHQ8BAf8EBAMC
-AYYwHQYDVR0OBBYEFIQYzIU07LwMlJQuCFmcx7IQTgoIMA0GCSqGSIb3DQEBCwUA
-A4IBAQCY8jdaQZChGsV2USggNiMOruYou6r4lK5IpDB/G/wkjUu0yKGX9rbxenDI
-U5PMCCjjmCXPI6T53iHTfIUJrU6adTrCC2qJeHZERxhlbI1Bjjt/msv0tadQ1wUs
-N+gDS63pYaACbvXy8MWy7Vu33PqUXHeeE6V/Uq2V8viTO96LXFvKWlJbYK8U90vv
-o/ufQJVtMVT8QtPHRh8jrdkPSHCa2XV4cdFyQzR1bldZwgJcJmApzyMZFo6IQ6XU
-5MsI+yMRQ+hDKXJioaldXgjUkK642M4UwtBV8ob2xJNDd2ZhwLnoQdeXeGADbkpy
-rqXRfboQnoZsG4q5WTP468SQvvG5
------END CERTIFICATE-----`
+	mu            sync.RWMutex
+	reconnectMu   sync.Mutex
+	client        paho.Client
+	subscriptions map[string]subscription
+	thingName     ThingName
+	limiter       *RateLimiter
+	qos           byte
+}
+
+// newClient creates the MQTT clients connected by Reconnect and Bootstrap, replaced in tests
+var newClient = paho.NewClient
+
+// SubscriptionRenewalError is returned by Reconnect when the thing is connected with the new certificate, but a
+// subscription could not be renewed on the new connection
+type SubscriptionRenewalError struct {
+	Topic string
+	Err   error
+}
+
+func (e *SubscriptionRenewalError) Error() string {
+	return fmt.Sprintf("failed to renew subscription to %s: %v", e.Topic, e.Err)
+}
+
+// Unwrap returns the subscribe error
+func (e *SubscriptionRenewalError) Unwrap() error {
+	return e.Err
+}
+
+// subscription is kept for every active subscription, so it can be renewed after Reconnect
+type subscription struct {
+	qos      byte
+	callback paho.MessageHandler
+}
+
+// RootPEM is the Amazon Root CA for IoT Core, see mqtt.RootPEM
+const RootPEM = mqtt.RootPEM
 
 // NewThingFromStrings returns a new instance of Thing
 func NewThingFromStrings(cert string, key string, awsEndpoint string, thingName ThingName) (*Thing, error) {
@@ -61,15 +71,7 @@ func NewThingFromStrings(cert string, key string, awsEndpoint string, thingName
 		return nil, err
 	}
 
-	awsServerURL := fmt.Sprintf("ssl://%s:8883", awsEndpoint)
-
-	mqttOpts := paho.NewClientOptions()
-	mqttOpts.AddBroker(awsServerURL)
-	mqttOpts.SetMaxReconnectInterval(1 * time.Second)
-	mqttOpts.SetClientID(string(thingName))
-	mqttOpts.SetTLSConfig(tlsConfig)
-
-	c := paho.NewClient(mqttOpts)
+	c := paho.NewClient(mqtt.NewClientOptions(awsEndpoint, string(thingName), tlsConfig))
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
@@ -93,20 +95,131 @@ func NewThingFromFiles(keyPair models.KeyPair, awsEndpoint string, thingName Thi
 	}, nil
 }
 
+// Name returns the name of the thing
+func (t *Thing) Name() ThingName {
+	return t.thingName
+}
+
 // Disconnect terminates the MQTT connection between the client and the AWS server. Recommended to use in defer to avoid
 // connection leaks.
 func (t *Thing) Disconnect() {
-	t.client.Disconnect(1)
+	t.mqttClient().Disconnect(1)
+}
+
+// mqttClient returns the current MQTT client of the thing, which is replaced by Reconnect
+func (t *Thing) mqttClient() paho.Client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client
+}
+
+// Reconnect replaces the MQTT connection with one authenticated by the new certificate and key. The client is built
+// with the same options as the original one, keeping the endpoint, client ID and CA, and all active subscriptions are
+// renewed on the new connection. If the new connection fails, the thing reconnects with the previous certificate.
+// Once connected with the new certificate, the thing keeps the new connection even if a subscription cannot be renewed,
+// which is returned as a SubscriptionRenewalError. Publishes during the reconnect fail instead of waiting for it.
+func (t *Thing) Reconnect(cert []byte, key []byte) error {
+	tlsCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificates: %w", err)
+	}
+
+	t.reconnectMu.Lock()
+	defer t.reconnectMu.Unlock()
+
+	previous := t.mqttClient()
+	options := previous.OptionsReader()
+	tlsConfig := &tls.Config{}
+	if options.TLSConfig() != nil {
+		tlsConfig = options.TLSConfig().Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{tlsCert}
+	endpoint := ""
+	if servers := options.Servers(); len(servers) > 0 {
+		endpoint = servers[0].Hostname()
+	}
+	c := newClient(mqtt.NewClientOptions(endpoint, options.ClientID(), tlsConfig))
+
+	// AWS IoT drops one of two connections with the same client ID, so the previous connection has to go first
+	previous.Disconnect(250)
+
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		if restore := previous.Connect(); restore.Wait() && restore.Error() != nil {
+			return fmt.Errorf("failed to connect with the new certificate: %w (reconnecting with the previous certificate: %v)", token.Error(), restore.Error())
+		}
+		return fmt.Errorf("failed to connect with the new certificate: %w", token.Error())
+	}
+
+	t.mu.Lock()
+	t.client = c
+	subscriptions := make(map[string]subscription, len(t.subscriptions))
+	for topic, sub := range t.subscriptions {
+		subscriptions[topic] = sub
+	}
+	t.mu.Unlock()
+
+	for topic, sub := range subscriptions {
+		if token := c.Subscribe(topic, sub.qos, sub.callback); token.Wait() && token.Error() != nil {
+			return &SubscriptionRenewalError{Topic: topic, Err: token.Error()}
+		}
+	}
+	return nil
+}
+
+// SetRateLimiter sets the limiter all publishes of the thing are charged against. A nil limiter disables rate limiting.
+func (t *Thing) SetRateLimiter(limiter *RateLimiter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limiter = limiter
+}
+
+// ThrottleStats returns the rate limiter counters per traffic class, or nil when no rate limiter is set.
+func (t *Thing) ThrottleStats() map[TrafficClass]ThrottleStats {
+	t.mu.RLock()
+	limiter := t.limiter
+	t.mu.RUnlock()
+	return limiter.Stats()
+}
+
+// SetPublishQoS sets the MQTT QoS used for custom topic and rule publishes. AWS IoT Core supports QoS 0 and 1. With
+// QoS 1, messages published while the client is reconnecting are queued and sent once the connection is back.
+func (t *Thing) SetPublishQoS(qos byte) error {
+	if qos > 1 {
+		return fmt.Errorf("unsupported QoS %d, AWS IoT Core supports QoS 0 and 1", qos)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.qos = qos
+	return nil
+}
+
+// publishQoS returns the QoS set by SetPublishQoS
+func (t *Thing) publishQoS() byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.qos
 }
 
-// PublishToCustomTopic publishes an async message to the custom topic.
+// PublishToCustomTopic publishes an async message to the custom topic. Payloads larger than MaxPayloadSize are
+// rejected with a PayloadTooLargeError before publishing.
 func (t *Thing) PublishToCustomTopic(payload Payload, topic string) error {
-	token := t.client.Publish(
-		topic,
-		0,
-		false,
-		[]byte(payload),
-	)
+	if err := validatePayloadSize(payload); err != nil {
+		return err
+	}
+	return t.publish(TelemetryTraffic, topic, t.publishQoS(), payload)
+}
+
+// publish charges the message against the rate limiter and publishes it, waiting for the publish to complete
+func (t *Thing) publish(class TrafficClass, topic string, qos byte, payload []byte) error {
+	t.mu.RLock()
+	limiter, client := t.limiter, t.client
+	t.mu.RUnlock()
+
+	if err := limiter.Wait(class, len(payload)); err != nil {
+		return err
+	}
+
+	token := client.Publish(topic, qos, false, payload)
 	token.Wait()
 	return token.Error()
 }
@@ -115,7 +228,7 @@ func (t *Thing) PublishToCustomTopic(payload Payload, topic string) error {
 func (t *Thing) SubscribeForCustomTopic(topic string) (chan Payload, error) {
 	payloadChan := make(chan Payload)
 
-	if token := t.client.Subscribe(
+	if token := t.subscribe(
 		topic,
 		0,
 		func(client paho.Client, msg paho.Message) {
@@ -130,13 +243,33 @@ func (t *Thing) SubscribeForCustomTopic(topic string) (chan Payload, error) {
 
 // UnsubscribeFromCustomTopic terminates the subscription to the custom topic.
 // The specified topic argument will be prepended by a prefix "$aws/things/<thing_name>"
-func (t Thing) UnsubscribeFromCustomTopic(topic string) error {
+func (t *Thing) UnsubscribeFromCustomTopic(topic string) error {
 	return t.unsubscribe(path.Join("$aws/things", t.thingName, topic))
 }
 
+// subscribe subscribes to the topic and keeps the subscription, so Reconnect can renew it
+func (t *Thing) subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	t.mu.Lock()
+	if t.subscriptions == nil {
+		t.subscriptions = map[string]subscription{}
+	}
+	t.subscriptions[topic] = subscription{qos: qos, callback: callback}
+	c := t.client
+	t.mu.Unlock()
+
+	return c.Subscribe(topic, qos, callback)
+}
+
 // unsubscribe terminates the MQTT subscription for the provided tokens
-func (t Thing) unsubscribe(topics ...string) error {
-	token := t.client.Unsubscribe(topics...)
+func (t *Thing) unsubscribe(topics ...string) error {
+	t.mu.Lock()
+	for _, topic := range topics {
+		delete(t.subscriptions, topic)
+	}
+	c := t.client
+	t.mu.Unlock()
+
+	token := c.Unsubscribe(topics...)
 	token.Wait()
 	return token.Error()
 }
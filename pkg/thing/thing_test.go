@@ -16,21 +16,16 @@ import (
 var thingName = ""
 var testEndpoint = ""
 
-func TestMain(m *testing.M) {
-	var ok bool
-
-	thingName, ok = os.LookupEnv("AWS_IOT_THING_NAME")
-	if !ok {
-		panic("AWS_IOT_THING_NAME environment variable must be defined")
-	}
-
-	testEndpoint, ok = os.LookupEnv("AWS_MQTT_ENDPOINT")
-	if !ok {
-		panic("AWS_MQTT_ENDPOINT environment variable must be defined")
+// requireAWS skips integration tests that connect to AWS IoT unless AWS_IOT_THING_NAME and AWS_MQTT_ENDPOINT are
+// defined, so the unit tests of the package run without them
+func requireAWS(t *testing.T) {
+	t.Helper()
+	var thingOK, endpointOK bool
+	thingName, thingOK = os.LookupEnv("AWS_IOT_THING_NAME")
+	testEndpoint, endpointOK = os.LookupEnv("AWS_MQTT_ENDPOINT")
+	if !thingOK || !endpointOK {
+		t.Skip("AWS_IOT_THING_NAME and AWS_MQTT_ENDPOINT environment variables must be defined")
 	}
-
-	code := m.Run()
-	os.Exit(code)
 }
 
 var keyPair = models.KeyPair{
@@ -48,6 +43,8 @@ type shadowStruct struct {
 }
 
 func TestNewThingFromFiles(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -56,6 +53,8 @@ func TestNewThingFromFiles(t *testing.T) {
 }
 
 func TestNewThingFromStrings(t *testing.T) {
+	requireAWS(t)
+
 	cert, err := ioutil.ReadFile(keyPair.CertificatePath)
 	key, err := ioutil.ReadFile(keyPair.PrivateKeyPath)
 	th, err := thing.NewThingFromStrings(string(cert), string(key), testEndpoint, thingName)
@@ -66,6 +65,8 @@ func TestNewThingFromStrings(t *testing.T) {
 }
 
 func TestThingShadow(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -103,6 +104,8 @@ func TestThingShadow(t *testing.T) {
 }
 
 func TestThing_UpdateThingShadowShouldFail(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -112,6 +115,10 @@ func TestThing_UpdateThingShadowShouldFail(t *testing.T) {
 	assert.NoError(t, err, "received thing shadow subscription channel without error")
 
 	err = th.UpdateThingShadow(thing.Shadow("invalid JSON"))
+	var jsonErr *thing.InvalidJSONError
+	assert.ErrorAs(t, err, &jsonErr, "invalid JSON is rejected before publishing")
+
+	err = th.UpdateThingShadow(thing.Shadow(`{"state": "invalid"}`))
 	assert.NoError(t, err, "thing shadow updated without error")
 
 	_, ok := <-thingShadowErrChan
@@ -119,6 +126,8 @@ func TestThing_UpdateThingShadowShouldFail(t *testing.T) {
 }
 
 func TestThing_UpdateThingShadowDocument(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -139,6 +148,8 @@ func TestThing_UpdateThingShadowDocument(t *testing.T) {
 }
 
 func TestThing_DeleteThingShadow(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -149,6 +160,8 @@ func TestThing_DeleteThingShadow(t *testing.T) {
 }
 
 func TestThing_ListenForJobs(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -159,6 +172,8 @@ func TestThing_ListenForJobs(t *testing.T) {
 }
 
 func TestThing_UnsubscribeFromJobs(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -169,6 +184,8 @@ func TestThing_UnsubscribeFromJobs(t *testing.T) {
 }
 
 func TestThing_CustomTopic(t *testing.T) {
+	requireAWS(t)
+
 	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
 	assert.NoError(t, err, "thing instance created without error")
 	assert.NotNil(t, th, "thing instance is not nil")
@@ -189,3 +206,18 @@ func TestThing_CustomTopic(t *testing.T) {
 
 	assert.Equal(t, customPayload, remotePayload)
 }
+
+func TestThing_PublishToRule(t *testing.T) {
+	requireAWS(t)
+
+	th, err := thing.NewThingFromFiles(keyPair, testEndpoint, thingName)
+	assert.NoError(t, err, "thing instance created without error")
+	assert.NotNil(t, th, "thing instance is not nil")
+	defer th.Disconnect()
+
+	err = th.PublishToRule("invalid-rule-name", "telemetry", thing.Payload(`{"value": 1}`))
+	assert.Error(t, err, "rule names with dashes are rejected")
+
+	err = th.PublishToRule("test_rule", "telemetry/"+thingName, thing.Payload(`{"value": 1}`))
+	assert.NoError(t, err, "published to the rule without error")
+}
@@ -0,0 +1,44 @@
+package thing
+
+import (
+	"fmt"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/codec"
+)
+
+// DecodeErrorHandler is called with the payloads of a decoded subscription that could not be decoded
+type DecodeErrorHandler func(topic string, payload Payload, err error)
+
+// PublishValue encodes the value with the codec and publishes it to the custom topic
+func (t *Thing) PublishValue(topic string, v interface{}, c codec.Codec) error {
+	payload, err := c.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s payload: %w", c.Name(), err)
+	}
+	return t.PublishToCustomTopic(payload, topic)
+}
+
+// SubscribeForCustomTopicDecoded subscribes for the custom topic and decodes every message with the codec. The decoded
+// values are delivered to target, which must be a channel (chan T) or a handler function (func(T)). Messages that fail
+// to decode are passed to onError, if set, and skipped so they do not block the subscription.
+func (t *Thing) SubscribeForCustomTopicDecoded(topic string, c codec.Codec, target interface{}, onError DecodeErrorHandler) error {
+	handle, err := codec.NewHandler(c, target)
+	if err != nil {
+		return err
+	}
+
+	if token := t.subscribe(
+		topic,
+		0,
+		func(client paho.Client, msg paho.Message) {
+			if err := handle(msg.Payload()); err != nil && onError != nil {
+				onError(msg.Topic(), msg.Payload(), err)
+			}
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultAuditPublishTimeout is how long MQTTAuditLog waits for a record to be published by default
+const DefaultAuditPublishTimeout = 10 * time.Second
+
+// Outcomes of an audited tunnel session
+const (
+	OutcomeClosed   = "closed"
+	OutcomeFailed   = "failed"
+	OutcomeReplaced = "replaced"
+	OutcomeExpired  = "expired"
+	OutcomeShutdown = "shutdown"
+	OutcomeRejected = "rejected"
+)
+
+// AuditRecord describes a tunnel session once it has ended or was rejected
+type AuditRecord struct {
+	SessionID     uint64    `json:"sessionId,omitempty"`
+	Services      []string  `json:"services"`
+	Region        string    `json:"region"`
+	StartedAt     time.Time `json:"startedAt"`
+	EndedAt       time.Time `json:"endedAt"`
+	BytesReceived int64     `json:"bytesReceived"`
+	BytesSent     int64     `json:"bytesSent"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// AuditSink stores the audit records of the tunnel sessions
+type AuditSink interface {
+	Record(record AuditRecord) error
+}
+
+// FileAuditLog appends the audit records to a file as JSON lines
+type FileAuditLog struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileAuditLog returns a FileAuditLog writing to the path
+func NewFileAuditLog(path string) *FileAuditLog {
+	return &FileAuditLog{Path: path}
+}
+
+// Record appends the record to the file, which is created readable by the owner only
+func (l *FileAuditLog) Record(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// MQTTAuditLog publishes the audit records on an MQTT topic
+type MQTTAuditLog struct {
+	Client paho.Client
+	Topic  string
+	// Timeout is how long to wait for a record to be published, defaults to DefaultAuditPublishTimeout
+	Timeout time.Duration
+}
+
+// Record publishes the record with QoS 1 and waits for it to be delivered until the timeout
+func (l *MQTTAuditLog) Record(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAuditPublishTimeout
+	}
+	token := l.Client.Publish(l.Topic, 1, false, data)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("failed to publish audit record: no acknowledgement within %s", timeout)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("failed to publish audit record: %w", token.Error())
+	}
+	return nil
+}
+
+// AuditSinks records to every sink, returning the first error
+type AuditSinks []AuditSink
+
+// Record records to every sink, even if one of them fails
+func (s AuditSinks) Record(record AuditRecord) error {
+	var first error
+	for _, sink := range s {
+		if err := sink.Record(record); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,67 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log := tunnel.NewFileAuditLog(path)
+	assert.NoError(t, log.Record(tunnel.AuditRecord{SessionID: 1, Services: []string{"SSH"}, BytesSent: 10, Outcome: tunnel.OutcomeClosed}))
+	assert.NoError(t, log.Record(tunnel.AuditRecord{SessionID: 2, Services: []string{"SSH"}, Outcome: tunnel.OutcomeFailed, Error: "boom"}))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "audit log readable by the owner only")
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []tunnel.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := tunnel.AuditRecord{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record), "records written as JSON lines")
+		records = append(records, record)
+	}
+	assert.Len(t, records, 2, "records appended")
+	assert.EqualValues(t, 10, records[0].BytesSent)
+	assert.Equal(t, "boom", records[1].Error)
+}
+
+// pendingToken is a paho.Token that never completes, like a publish while the connection is down
+type pendingToken struct {
+	paho.Token
+}
+
+func (pendingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+// disconnectedClient is a paho.Client whose publishes never complete
+type disconnectedClient struct {
+	paho.Client
+}
+
+func (disconnectedClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	return pendingToken{}
+}
+
+func TestMQTTAuditLog_Timeout(t *testing.T) {
+	log := &tunnel.MQTTAuditLog{Client: disconnectedClient{}, Topic: "audit", Timeout: 10 * time.Millisecond}
+
+	start := time.Now()
+	err := log.Record(tunnel.AuditRecord{SessionID: 1, Outcome: tunnel.OutcomeClosed})
+	assert.Error(t, err, "unacknowledged publish fails")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "record does not wait beyond the timeout")
+}
@@ -1,10 +1,17 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/identity"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/networking"
 	"github.com/spf13/cobra"
 )
 
@@ -14,15 +21,32 @@ var (
 	certificatePath string
 	rootCAPath      string
 	thingName       string
+	identitySpec    string
+	thingNamePrefix string
+	interfacePolicy = networking.DefaultSelectionPolicy()
+	serviceFlags    []string
+	maxSessions     int
+	policyPath      string
+	approveCommand  string
+	auditLogPath    string
+	auditTopic      string
 )
 
 func init() {
 	ListenForTunnelCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", "", "The AWS IoT endpoint")
-	ListenForTunnelCmd.PersistentFlags().StringVarP(&thingName, "thingname", "t", "", "The thing name to use")
+	ListenForTunnelCmd.PersistentFlags().StringVarP(&thingName, "thingname", "t", "", "The thing name to use, derived from the unique ID when empty")
+	ListenForTunnelCmd.PersistentFlags().StringVar(&identitySpec, "identity", identity.DefaultSpec, "The unique ID source used without --thingname: a comma separated fallback chain of mac[:<interface>], eui64[:<interface>], machine-id, dmi-serial, cpu-serial and file:<path>")
+	networking.AddSelectionPolicyFlags(ListenForTunnelCmd.PersistentFlags(), &interfacePolicy)
+	ListenForTunnelCmd.PersistentFlags().StringVar(&thingNamePrefix, "thingname-prefix", "gateway-", "The prefix of the thing name derived from the unique ID")
 	ListenForTunnelCmd.PersistentFlags().StringVarP(&privateKeyPath, "private-key", "k", "", "The private key path")
 	ListenForTunnelCmd.PersistentFlags().StringVarP(&certificatePath, "certificate", "c", "", "The certificate path")
 	ListenForTunnelCmd.PersistentFlags().StringVarP(&rootCAPath, "root-ca", "r", "", "The root CA path")
-
+	ListenForTunnelCmd.PersistentFlags().IntVar(&maxSessions, "max-sessions", DefaultMaxSessions, "The maximum number of concurrent tunnels")
+	ListenForTunnelCmd.PersistentFlags().StringArrayVarP(&serviceFlags, "service", "s", []string{"SSH=localhost:22"}, "A tunnel service and the local address it is forwarded to as <service>=<host:port>, e.g. HTTP=localhost:80")
+	ListenForTunnelCmd.PersistentFlags().StringVar(&policyPath, "policy-file", "", "A JSON tunnel policy of the allowed services, destinations, time windows and maximum session duration")
+	ListenForTunnelCmd.PersistentFlags().StringVar(&approveCommand, "approve-command", "", "A shell command approving every tunnel by exiting with 0, it gets the services and region in TUNNEL_SERVICES and TUNNEL_REGION")
+	ListenForTunnelCmd.PersistentFlags().StringVar(&auditLogPath, "audit-log", "", "Append a JSON record of every tunnel session to this file")
+	ListenForTunnelCmd.PersistentFlags().StringVar(&auditTopic, "audit-topic", "", "Publish a JSON record of every tunnel session on this MQTT topic")
 }
 
 func checkParameters() error {
@@ -30,7 +54,11 @@ func checkParameters() error {
 		return fmt.Errorf("endpoint is required")
 	}
 	if thingName == "" {
-		return fmt.Errorf("thingname is required")
+		name, err := ThingNameFromIdentity(identitySpec, thingNamePrefix, &interfacePolicy)
+		if err != nil {
+			return err
+		}
+		thingName = name
 	}
 	if privateKeyPath == "" {
 		return fmt.Errorf("private-key is required")
@@ -45,6 +73,20 @@ func checkParameters() error {
 	return nil
 }
 
+// ThingNameFromIdentity returns the thing name made of the prefix and the unique ID of the identity spec. The policy
+// chooses the interface of MAC address identities, nil uses networking.DefaultSelectionPolicy.
+func ThingNameFromIdentity(spec string, prefix string, policy *networking.SelectionPolicy) (string, error) {
+	provider, err := identity.ParseWithPolicy(spec, policy)
+	if err != nil {
+		return "", err
+	}
+	uniqueID, err := provider.ID()
+	if err != nil {
+		return "", fmt.Errorf("error getting unique ID: %v", err)
+	}
+	return prefix + uniqueID, nil
+}
+
 // ListenForTunnelCmd listens for a new tunnel to be requested
 var ListenForTunnelCmd = &cobra.Command{
 	Use:   "listen-for-tunnel",
@@ -62,7 +104,25 @@ var ListenForTunnelCmd = &cobra.Command{
 			CACertificatePath: rootCAPath,
 		}
 
-		if err := ListenForTunnel(thingName, keypair, endpoint); err != nil {
+		services, err := ParseServices(serviceFlags)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		manager := NewSessionManager(services, maxSessions)
+		manager.Policy, err = NewPolicy(policyPath, approveCommand)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if auditLogPath != "" {
+			manager.Audit = NewFileAuditLog(auditLogPath)
+		}
+		manager.AuditTopic = auditTopic
+
+		if err := ListenForTunnelWithManager(ctx, thingName, keypair, endpoint, manager); err != nil && !errors.Is(err, context.Canceled) {
 			log.Fatal(err)
 		}
 	},
@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Services maps the service IDs of a tunnel to the local addresses in host:port format they are forwarded to. The
+// empty service ID matches every service without its own mapping.
+type Services map[string]string
+
+// DefaultServices forwards SSH to the local SSH server
+func DefaultServices() Services {
+	return Services{"SSH": "localhost:22"}
+}
+
+// ParseServices parses service mappings given as <service ID>=<host:port>, e.g. HTTP=localhost:80
+func ParseServices(specs []string) (Services, error) {
+	services := Services{}
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("service %q is not in the <service>=<host:port> format", spec)
+		}
+		id, address := spec[:i], spec[i+1:]
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid address of service %s: %w", id, err)
+		}
+		services[id] = address
+	}
+	return services, nil
+}
+
+// Address returns the local address of the service
+func (s Services) Address(serviceID string) (string, bool) {
+	if address, ok := s[serviceID]; ok {
+		return address, true
+	}
+	address, ok := s[""]
+	return address, ok
+}
+
+// Check returns an error naming the services without a local address
+func (s Services) Check(serviceIDs []string) error {
+	var missing []string
+	for _, id := range serviceIDs {
+		if _, ok := s.Address(id); !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("no local address for tunnel services %s", strings.Join(missing, ", "))
+}
+
+// destination forwards the streams of the services multiplexed over one tunnel to their local addresses
+type destination struct {
+	*multiplexer
+	services Services
+	dial     func(network, address string) (net.Conn, error)
+}
+
+// ProxyDestination forwards the streams of the tunnel connection to the local addresses of their services, until the
+// session is reset, the connection is closed or the context is done. Each service has at most one stream at a time, a
+// new stream of a service replaces its previous one. Failures of single streams are passed to onError, which may be
+// nil. The tunnel connection is closed on return.
+func ProxyDestination(ctx context.Context, tunnel io.ReadWriteCloser, services Services, onError func(error)) error {
+	return proxyDestination(ctx, tunnel, services, onError, nil)
+}
+
+// proxyDestination is ProxyDestination counting the relayed bytes in stats, which may be nil
+func proxyDestination(ctx context.Context, tunnel io.ReadWriteCloser, services Services, onError func(error), stats *TransferStats) error {
+	d := &destination{
+		multiplexer: newMultiplexer(tunnel, onError, stats),
+		services:    services,
+		dial:        net.Dial,
+	}
+	stop := d.closeOnDone(ctx)
+	defer stop()
+	defer tunnel.Close()
+	defer d.closeAll()
+
+	err := d.run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (d *destination) run() error {
+	for {
+		m, err := ReadMessage(d.tunnel)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch m.Type {
+		case MessageServiceIDs:
+			if err := d.services.Check(m.AvailableServiceIDs); err != nil {
+				d.handleError(err)
+			}
+
+		case MessageStreamStart:
+			d.start(m.ServiceID, m.StreamID)
+
+		case MessageStreamReset:
+			d.close(m.ServiceID, m.StreamID)
+
+		case MessageSessionReset:
+			return nil
+
+		case MessageData:
+			d.write(m.ServiceID, m.StreamID, m.Payload)
+
+		default:
+			if !m.Ignorable {
+				d.handleError(fmt.Errorf("unsupported tunnel message type %d", m.Type))
+			}
+		}
+	}
+}
+
+// start connects a new stream to the local address of the service
+func (d *destination) start(serviceID string, streamID int32) {
+	d.mu.Lock()
+	if previous, ok := d.streams[serviceID]; ok {
+		previous.conn.Close()
+		delete(d.streams, serviceID)
+	}
+	d.mu.Unlock()
+
+	address, ok := d.services.Address(serviceID)
+	if !ok {
+		d.handleStreamError(serviceID, streamID, errors.New("no local address for the service"))
+		d.reset(serviceID, streamID)
+		return
+	}
+	conn, err := d.dial("tcp", address)
+	if err != nil {
+		d.handleStreamError(serviceID, streamID, fmt.Errorf("failed to connect to %s: %w", address, err))
+		d.reset(serviceID, streamID)
+		return
+	}
+
+	s := &stream{id: streamID, conn: conn}
+	d.add(serviceID, s)
+	go d.forward(serviceID, s)
+}
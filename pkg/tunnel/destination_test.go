@@ -0,0 +1,108 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoServer answers every connection with the received data, prefixed with the name
+func echoServer(t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1024)
+				n, err := conn.Read(b)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte(name+":"), b[:n]...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestParseServices(t *testing.T) {
+	services, err := tunnel.ParseServices([]string{"SSH=localhost:22", "HTTP=127.0.0.1:80"})
+	assert.NoError(t, err, "services parsed without error")
+	assert.Equal(t, tunnel.Services{"SSH": "localhost:22", "HTTP": "127.0.0.1:80"}, services)
+
+	assert.Error(t, services.Check([]string{"SSH", "VNC"}), "service without address is reported")
+	assert.NoError(t, tunnel.Services{"": "localhost:22"}.Check([]string{"SSH", "VNC"}), "empty service ID matches every service")
+
+	_, err = tunnel.ParseServices([]string{"SSH"})
+	assert.Error(t, err, "service without address is rejected")
+	_, err = tunnel.ParseServices([]string{"SSH=localhost"})
+	assert.Error(t, err, "address without port is rejected")
+}
+
+func TestProxyDestination(t *testing.T) {
+	services := tunnel.Services{
+		"SSH":  echoServer(t, "ssh"),
+		"HTTP": echoServer(t, "http"),
+	}
+
+	local, remote := net.Pipe()
+	errs := make(chan error, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- tunnel.ProxyDestination(context.Background(), local, services, func(err error) { errs <- err })
+	}()
+
+	send := func(m *tunnel.Message) {
+		assert.NoError(t, tunnel.WriteMessage(remote, m))
+	}
+	receive := func() *tunnel.Message {
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		m, err := tunnel.ReadMessage(remote)
+		assert.NoError(t, err, "message received from destination")
+		return m
+	}
+
+	send(&tunnel.Message{Type: tunnel.MessageServiceIDs, AvailableServiceIDs: []string{"SSH", "HTTP"}})
+
+	for _, service := range []struct{ id, name string }{{"HTTP", "http"}, {"SSH", "ssh"}} {
+		send(&tunnel.Message{Type: tunnel.MessageStreamStart, ServiceID: service.id, StreamID: 1})
+		send(&tunnel.Message{Type: tunnel.MessageData, ServiceID: service.id, StreamID: 1, Payload: []byte("hello")})
+
+		m := receive()
+		assert.Equal(t, tunnel.MessageData, m.Type, service.id)
+		assert.Equal(t, service.id, m.ServiceID, "data is sent back on the stream of the service")
+		assert.Equal(t, service.name+":hello", string(m.Payload), "data is forwarded to the address of the service")
+
+		m = receive()
+		assert.Equal(t, tunnel.MessageStreamReset, m.Type, "stream is reset when the local connection closes")
+		assert.Equal(t, service.id, m.ServiceID)
+	}
+
+	send(&tunnel.Message{Type: tunnel.MessageStreamStart, ServiceID: "VNC", StreamID: 1})
+	m := receive()
+	assert.Equal(t, tunnel.MessageStreamReset, m.Type, "stream of a service without address is reset")
+	assert.Equal(t, "VNC", m.ServiceID)
+	var destErr *tunnel.DestinationError
+	assert.True(t, errors.As(<-errs, &destErr), "stream failure is reported")
+	assert.Equal(t, "VNC", destErr.ServiceID)
+
+	send(&tunnel.Message{Type: tunnel.MessageSessionReset})
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "session reset ends the proxy without error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not end on session reset")
+	}
+	remote.Close()
+}
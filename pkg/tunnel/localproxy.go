@@ -1,77 +1,214 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/seqsense/aws-iot-device-sdk-go/v5/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// SubprotocolV2 is the websocket subprotocol of the secure tunneling protocol with multiplexed services. The
+	// github.com/seqsense/aws-iot-device-sdk-go tunnel package only speaks aws.iot.securetunneling-1.0, whose messages
+	// carry no service IDs, so the V2 protocol is implemented in this package.
+	SubprotocolV2 = "aws.iot.securetunneling-2.0"
+
+	pingPeriod  = 5 * time.Second
+	dialTimeout = 30 * time.Second
+	userAgent   = "aws-iot-device-sdk-go/tunnel"
 )
 
 // ProxyParams holds the parameters for running the local proxy
 type ProxyParams struct {
-	AccessToken     string
-	ProxyEndpoint   string
-	Region          string
-	SourcePort      int
-	DestinationApp  string
+	AccessToken   string
+	ProxyEndpoint string
+	Region        string
+	SourcePort    int
+	// SourcePorts maps the service IDs of the tunnel to the local ports they are listened on in source mode
+	SourcePorts map[string]int
+	// SourceHost is the host the source listeners bind to, all interfaces if empty
+	SourceHost     string
+	DestinationApp string
+	// Services maps the service IDs of the tunnel to local addresses in destination mode. DestinationApp is used for
+	// every service without its own mapping.
+	Services        Services
 	NoSSLHostVerify bool
 	ProxyScheme     string
+	// OnError is called with failures of single streams, which do not end the tunnel. They are logged if it is nil.
+	OnError func(error)
+	// Stats counts the bytes relayed by the session if it is not nil
+	Stats *TransferStats
+}
+
+// endpoint returns the proxy endpoint of the parameters
+func (p ProxyParams) endpoint() (string, error) {
+	switch {
+	case p.ProxyEndpoint != "" && p.Region == "":
+		return p.ProxyEndpoint, nil
+	case p.Region != "" && p.ProxyEndpoint == "":
+		return fmt.Sprintf("data.tunneling.iot.%s.amazonaws.com", p.Region), nil
+	default:
+		return "", errors.New("one of ProxyEndpoint or Region must be specified")
+	}
 }
 
-// StartLocalProxy starts a local proxy to the AWS IoT MQTT endpoint
-func StartLocalProxy(params ProxyParams) error {
+// StartLocalProxy runs a local proxy for the tunnel until the session ends or the context is done. In source mode it
+// listens on SourcePort, in destination mode it forwards the services to their local addresses. On shutdown the
+// listener and the tunnel connection are closed and the context error is returned.
+func StartLocalProxy(ctx context.Context, params ProxyParams) error {
 	if params.ProxyScheme == "" {
 		params.ProxyScheme = "wss"
 	}
-
 	if params.AccessToken == "" {
-		log.Fatal("error: AccessToken must be specified")
+		return errors.New("AccessToken must be specified")
 	}
-
-	var endpoint string
-	switch {
-	case params.ProxyEndpoint != "" && params.Region == "":
-		endpoint = params.ProxyEndpoint
-	case params.Region != "" && params.ProxyEndpoint == "":
-		endpoint = fmt.Sprintf("data.tunneling.iot.%s.amazonaws.com", params.Region)
-	default:
-		log.Fatal("error: one of ProxyEndpoint or Region must be specified")
+	endpoint, err := params.endpoint()
+	if err != nil {
+		return err
 	}
-
-	proxyOpts := []tunnel.ProxyOption{
-		func(opt *tunnel.ProxyOptions) error {
-			opt.InsecureSkipVerify = params.NoSSLHostVerify
-			opt.Scheme = params.ProxyScheme
-			return nil
-		},
-		tunnel.WithErrorHandler(tunnel.ErrorHandlerFunc(func(err error) {
+	onError := params.OnError
+	if onError == nil {
+		onError = func(err error) {
 			log.Print(err)
-		})),
+		}
 	}
 
+	isDestination := params.DestinationApp != "" || len(params.Services) > 0
+	isSource := params.SourcePort > 0 || len(params.SourcePorts) > 0
 	switch {
-	case params.SourcePort > 0 && params.DestinationApp == "":
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", params.SourcePort))
+	case isSource && !isDestination:
+		listeners, err := params.listen()
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return err
 		}
-		err = tunnel.ProxySource(listener, endpoint, params.AccessToken, proxyOpts...)
+		ws, err := openTunnel(ctx, endpoint, "source", params.AccessToken, params.ProxyScheme, params.NoSSLHostVerify)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
 		}
+		stopPing := startPing(ws)
+		defer stopPing()
 
-	case params.DestinationApp != "" && params.SourcePort == 0:
-		err := tunnel.ProxyDestination(func() (io.ReadWriteCloser, error) {
-			return net.Dial("tcp", params.DestinationApp)
-		}, endpoint, params.AccessToken, proxyOpts...)
+		return proxySource(ctx, ws, listeners, onError, params.Stats)
+
+	case isDestination && !isSource:
+		services := Services{}
+		for id, address := range params.Services {
+			services[id] = address
+		}
+		if params.DestinationApp != "" {
+			services[""] = params.DestinationApp
+		}
+
+		ws, err := openTunnel(ctx, endpoint, "destination", params.AccessToken, params.ProxyScheme, params.NoSSLHostVerify)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return err
 		}
+		stopPing := startPing(ws)
+		defer stopPing()
+
+		return proxyDestination(ctx, ws, services, onError, params.Stats)
 
 	default:
-		log.Fatal("error: one of SourcePort or DestinationApp must be specified")
+		return errors.New("one of SourcePort, SourcePorts, DestinationApp or Services must be specified")
+	}
+}
+
+// listen opens the source listeners of the services
+func (p ProxyParams) listen() (map[string]net.Listener, error) {
+	ports := map[string]int{}
+	for id, port := range p.SourcePorts {
+		ports[id] = port
 	}
-	return nil
+	if p.SourcePort > 0 {
+		ports[""] = p.SourcePort
+	}
+
+	listeners := map[string]net.Listener{}
+	for id, port := range ports {
+		listener, err := net.Listen("tcp", net.JoinHostPort(p.SourceHost, strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on source port %d: %w", port, err)
+		}
+		listeners[id] = listener
+	}
+	return listeners, nil
+}
+
+// openTunnel connects to the secure tunneling proxy endpoint with the V2 protocol
+func openTunnel(ctx context.Context, endpoint, mode, token, scheme string, insecureSkipVerify bool) (*websocket.Conn, error) {
+	if scheme != "wss" && scheme != "ws" {
+		return nil, fmt.Errorf("unsupported proxy scheme %s", scheme)
+	}
+
+	config, err := websocket.NewConfig(
+		fmt.Sprintf("%s://%s/tunnel?local-proxy-mode=%s", scheme, endpoint, mode),
+		fmt.Sprintf("https://%s", endpoint),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel connection config: %w", err)
+	}
+	if scheme == "wss" {
+		serverName := endpoint
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			serverName = host
+		}
+		config.TlsConfig = &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: insecureSkipVerify,
+		}
+	}
+	config.Header = http.Header{
+		"Access-Token": []string{token},
+		"User-Agent":   []string{userAgent},
+	}
+	config.Protocol = []string{SubprotocolV2}
+
+	config.Dialer = &net.Dialer{Timeout: dialTimeout}
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tunnel connection: %w", err)
+	}
+	if ctx.Err() != nil {
+		ws.Close()
+		return nil, ctx.Err()
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// startPing keeps the tunnel connection alive until the returned function is called
+func startPing(ws *websocket.Conn) func() {
+	ping := websocket.Codec{
+		Marshal: func(v interface{}) ([]byte, byte, error) {
+			return nil, websocket.PingFrame, nil
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ping.Send(ws, nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
 }
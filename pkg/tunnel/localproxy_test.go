@@ -0,0 +1,244 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// v2MessageType is the Message of the V2 protocol schema published with the AWS local proxy, built with the protobuf
+// runtime so the fake service does not share the encoding of tunnel.Message. The type enum is declared as int32,
+// which has the same wire format.
+func v2MessageType(t *testing.T) protoreflect.MessageType {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum()}
+	}
+	optional, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("Message.proto"),
+		Package: proto.String("com.amazonaws.iot.securedtunneling"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Message"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("type", 1, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional),
+				field("streamId", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional),
+				field("ignorable", 3, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional),
+				field("payload", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional),
+				field("serviceId", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional),
+				field("availableServiceIds", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated),
+				field("connectionId", 7, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional),
+			},
+		}},
+	}, nil)
+	assert.NoError(t, err)
+	return dynamicpb.NewMessageType(file.Messages().ByName("Message"))
+}
+
+// fakeTunnelService is the secure tunneling service between a source and a destination local proxy. It accepts one
+// V2 connection per mode, announces the services to both and relays the messages between them.
+type fakeTunnelService struct {
+	t           *testing.T
+	messageType protoreflect.MessageType
+	services    []string
+	tokens      map[string]string
+
+	mu        sync.Mutex
+	conns     map[string]*websocket.Conn
+	paired    chan struct{}
+	announced sync.WaitGroup
+	// started holds the service IDs of the streams the source started
+	started []string
+}
+
+func newFakeTunnelService(t *testing.T, services []string) *fakeTunnelService {
+	s := &fakeTunnelService{
+		t:           t,
+		messageType: v2MessageType(t),
+		services:    services,
+		tokens:      map[string]string{"source": "source-token", "destination": "destination-token"},
+		conns:       map[string]*websocket.Conn{},
+		paired:      make(chan struct{}),
+	}
+	s.announced.Add(2)
+	return s
+}
+
+// handshake accepts connections with the V2 subprotocol and the access token of their mode
+func (s *fakeTunnelService) handshake(config *websocket.Config, r *http.Request) error {
+	mode := r.URL.Query().Get("local-proxy-mode")
+	if token, ok := s.tokens[mode]; !ok || r.Header.Get("Access-Token") != token {
+		return fmt.Errorf("invalid access token for mode %q", mode)
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == tunnel.SubprotocolV2 {
+			config.Protocol = []string{protocol}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported subprotocols %v", config.Protocol)
+}
+
+func (s *fakeTunnelService) serve(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	mode := ws.Request().URL.Query().Get("local-proxy-mode")
+	peerMode := map[string]string{"source": "destination", "destination": "source"}[mode]
+
+	s.mu.Lock()
+	s.conns[mode] = ws
+	if len(s.conns) == 2 {
+		close(s.paired)
+	}
+	s.mu.Unlock()
+	<-s.paired
+
+	available := s.messageType.New()
+	fields := available.Descriptor().Fields()
+	available.Set(fields.ByName("type"), protoreflect.ValueOfInt32(int32(tunnel.MessageServiceIDs)))
+	list := available.Mutable(fields.ByName("availableServiceIds")).List()
+	for _, id := range s.services {
+		list.Append(protoreflect.ValueOfString(id))
+	}
+	s.write(ws, available.Interface())
+	s.announced.Done()
+	s.announced.Wait()
+
+	s.mu.Lock()
+	peer := s.conns[peerMode]
+	s.mu.Unlock()
+	defer peer.Close()
+
+	for {
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(ws, size); err != nil {
+			return
+		}
+		data := make([]byte, int(size[0])<<8|int(size[1]))
+		if _, err := io.ReadFull(ws, data); err != nil {
+			return
+		}
+
+		m := s.messageType.New()
+		if !assert.NoError(s.t, proto.Unmarshal(data, m.Interface()), "message of the %s decoded with the V2 schema", mode) {
+			return
+		}
+		if mode == "source" && m.Get(fields.ByName("type")).Int() == int64(tunnel.MessageStreamStart) {
+			s.mu.Lock()
+			s.started = append(s.started, m.Get(fields.ByName("serviceId")).String())
+			s.mu.Unlock()
+		}
+		if _, err := peer.Write(append(size, data...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeTunnelService) write(ws *websocket.Conn, m proto.Message) {
+	data, err := proto.Marshal(m)
+	assert.NoError(s.t, err)
+	_, err = ws.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...))
+	assert.NoError(s.t, err)
+}
+
+func (s *fakeTunnelService) startedStreams() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.started...)
+}
+
+// freePort returns a local port that was free a moment ago
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartLocalProxy_V2(t *testing.T) {
+	service := newFakeTunnelService(t, []string{"SSH", "HTTP"})
+	server := httptest.NewServer(websocket.Server{Handshake: service.handshake, Handler: service.serve})
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := tunnel.StartLocalProxy(ctx, tunnel.ProxyParams{
+		AccessToken:   "wrong-token",
+		ProxyEndpoint: endpoint,
+		ProxyScheme:   "ws",
+		Services:      tunnel.Services{"SSH": echoServer(t, "ssh")},
+	})
+	assert.Error(t, err, "connection with an invalid access token rejected")
+
+	destinationDone := make(chan error, 1)
+	go func() {
+		destinationDone <- tunnel.StartLocalProxy(ctx, tunnel.ProxyParams{
+			AccessToken:   "destination-token",
+			ProxyEndpoint: endpoint,
+			ProxyScheme:   "ws",
+			Services:      tunnel.Services{"SSH": echoServer(t, "ssh"), "HTTP": echoServer(t, "http")},
+		})
+	}()
+
+	ports := map[string]int{"SSH": freePort(t), "HTTP": freePort(t)}
+	sourceDone := make(chan error, 1)
+	go func() {
+		sourceDone <- tunnel.StartLocalProxy(ctx, tunnel.ProxyParams{
+			AccessToken:   "source-token",
+			ProxyEndpoint: endpoint,
+			ProxyScheme:   "ws",
+			SourcePorts:   ports,
+			SourceHost:    "127.0.0.1",
+		})
+	}()
+
+	select {
+	case <-service.paired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("source and destination did not connect to the tunnel")
+	}
+
+	for _, id := range []string{"HTTP", "SSH"} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ports[id]))
+		if !assert.NoError(t, err, "connected to the source listener of %s", id) {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		response, err := io.ReadAll(conn)
+		assert.NoError(t, err, "connection closed after the destination closed the stream")
+		assert.Equal(t, strings.ToLower(id)+":hello", string(response), "connection forwarded to the destination of %s", id)
+		conn.Close()
+	}
+	assert.Equal(t, []string{"HTTP", "SSH"}, service.startedStreams(), "streams started with the service IDs of the V2 protocol")
+
+	cancel()
+	for _, done := range []<-chan error{sourceDone, destinationDone} {
+		select {
+		case err := <-done:
+			assert.True(t, errors.Is(err, context.Canceled), "local proxy ends with the context: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("local proxy did not end with the context")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MessageType is the type of a secure tunneling message
+type MessageType int32
+
+// Message types of the secure tunneling protocol
+const (
+	MessageUnknown         MessageType = 0
+	MessageData            MessageType = 1
+	MessageStreamStart     MessageType = 2
+	MessageStreamReset     MessageType = 3
+	MessageSessionReset    MessageType = 4
+	MessageServiceIDs      MessageType = 5
+	MessageConnectionStart MessageType = 6
+	MessageConnectionReset MessageType = 7
+)
+
+// maxMessageSize is the largest message the two byte length prefix can frame
+const maxMessageSize = 0xffff
+
+// Message is a secure tunneling message. ServiceID, AvailableServiceIDs and ConnectionID were added with protocol V2
+// and V3 to multiplex several services over one tunnel.
+//
+// More info here: https://github.com/aws-samples/aws-iot-securetunneling-localproxy/blob/main/V2WebSocketProtocolGuide.md
+type Message struct {
+	Type                MessageType
+	StreamID            int32
+	Ignorable           bool
+	Payload             []byte
+	ServiceID           string
+	AvailableServiceIDs []string
+	ConnectionID        uint32
+}
+
+// protobuf field numbers of Message
+const (
+	fieldType                protowire.Number = 1
+	fieldStreamID            protowire.Number = 2
+	fieldIgnorable           protowire.Number = 3
+	fieldPayload             protowire.Number = 4
+	fieldServiceID           protowire.Number = 5
+	fieldAvailableServiceIDs protowire.Number = 6
+	fieldConnectionID        protowire.Number = 7
+)
+
+// Marshal encodes the message as protobuf, omitting fields with zero values like proto3
+func (m *Message) Marshal() []byte {
+	var b []byte
+	if m.Type != 0 {
+		b = protowire.AppendTag(b, fieldType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Type))
+	}
+	if m.StreamID != 0 {
+		b = protowire.AppendTag(b, fieldStreamID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.StreamID))
+	}
+	if m.Ignorable {
+		b = protowire.AppendTag(b, fieldIgnorable, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if len(m.Payload) > 0 {
+		b = protowire.AppendTag(b, fieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Payload)
+	}
+	if m.ServiceID != "" {
+		b = protowire.AppendTag(b, fieldServiceID, protowire.BytesType)
+		b = protowire.AppendString(b, m.ServiceID)
+	}
+	for _, id := range m.AvailableServiceIDs {
+		b = protowire.AppendTag(b, fieldAvailableServiceIDs, protowire.BytesType)
+		b = protowire.AppendString(b, id)
+	}
+	if m.ConnectionID != 0 {
+		b = protowire.AppendTag(b, fieldConnectionID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ConnectionID))
+	}
+	return b
+}
+
+// Unmarshal decodes a protobuf encoded message, skipping unknown fields
+func (m *Message) Unmarshal(b []byte) error {
+	*m = Message{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("failed to decode message tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.VarintType && (num == fieldType || num == fieldStreamID || num == fieldIgnorable || num == fieldConnectionID):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("failed to decode message field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch num {
+			case fieldType:
+				m.Type = MessageType(int32(v))
+			case fieldStreamID:
+				m.StreamID = int32(v)
+			case fieldIgnorable:
+				m.Ignorable = v != 0
+			case fieldConnectionID:
+				m.ConnectionID = uint32(v)
+			}
+
+		case typ == protowire.BytesType && (num == fieldPayload || num == fieldServiceID || num == fieldAvailableServiceIDs):
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("failed to decode message field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch num {
+			case fieldPayload:
+				m.Payload = append([]byte(nil), v...)
+			case fieldServiceID:
+				m.ServiceID = string(v)
+			case fieldAvailableServiceIDs:
+				m.AvailableServiceIDs = append(m.AvailableServiceIDs, string(v))
+			}
+
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("failed to skip message field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// WriteMessage writes the message with its two byte length prefix in a single write
+func WriteMessage(w io.Writer, m *Message) error {
+	data := m.Marshal()
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum message size", len(data))
+	}
+	frame := append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// ReadMessage reads a message with its two byte length prefix. It returns io.EOF if the reader ends between messages.
+func ReadMessage(r io.Reader) (*Message, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read message length: %w", err)
+	}
+
+	data := make([]byte, int(size[0])<<8|int(size[1]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	m := &Message{}
+	if err := m.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,46 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/seqsense/aws-iot-device-sdk-go/v5/tunnel/msg"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMessage_RoundTrip(t *testing.T) {
+	m := &tunnel.Message{
+		Type:                tunnel.MessageServiceIDs,
+		StreamID:            -3,
+		Ignorable:           true,
+		Payload:             []byte("payload"),
+		ServiceID:           "HTTP",
+		AvailableServiceIDs: []string{"SSH", "HTTP", "VNC"},
+		ConnectionID:        2,
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, tunnel.WriteMessage(buf, m), "message written without error")
+	assert.Equal(t, buf.Len()-2, int(buf.Bytes()[0])<<8|int(buf.Bytes()[1]), "message is framed by its length")
+
+	decoded, err := tunnel.ReadMessage(buf)
+	assert.NoError(t, err, "message read without error")
+	assert.Equal(t, m, decoded)
+}
+
+func TestMessage_V1Compatibility(t *testing.T) {
+	data, err := proto.Marshal(&msg.Message{Type: msg.Message_DATA, StreamId: 7, Payload: []byte("data")})
+	assert.NoError(t, err)
+
+	m := &tunnel.Message{}
+	assert.NoError(t, m.Unmarshal(data), "V1 message decoded without error")
+	assert.Equal(t, &tunnel.Message{Type: tunnel.MessageData, StreamID: 7, Payload: []byte("data")}, m)
+
+	v1 := &msg.Message{}
+	assert.NoError(t, proto.Unmarshal(m.Marshal(), v1), "message decoded by the V1 implementation")
+	assert.Equal(t, msg.Message_DATA, v1.Type)
+	assert.EqualValues(t, 7, v1.StreamId)
+	assert.Equal(t, []byte("data"), v1.Payload)
+}
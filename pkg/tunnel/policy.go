@@ -0,0 +1,294 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// PolicyError is returned when a tunnel is rejected by the Policy
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "tunnel rejected by policy: " + e.Reason
+}
+
+// TimeWindow is a daily period tunnels are allowed in. A window ending before it starts spans midnight.
+type TimeWindow struct {
+	// Days are the weekdays the window starts on, every day if empty
+	Days []time.Weekday
+	// Start and End are the times of day in 15:04 format
+	Start string
+	End   string
+}
+
+// contains reports whether the time is inside the window
+func (w TimeWindow) contains(t time.Time) (bool, error) {
+	start, err := minuteOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := minuteOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case start <= end && minute >= start && minute < end:
+	case start > end && minute >= start:
+	case start > end && minute < end:
+		// the window started the day before
+		day = (day + 6) % 7
+	default:
+		return false, nil
+	}
+
+	if len(w.Days) == 0 {
+		return true, nil
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Policy controls which tunnels a device accepts. Zero values allow everything.
+type Policy struct {
+	// AllowedServices are the services tunnels may request
+	AllowedServices []string
+	// AllowedDestinations are path.Match patterns of the local addresses the services may be forwarded to, e.g.
+	// localhost:22 or localhost:*
+	AllowedDestinations []string
+	// Windows are the periods tunnels are accepted in
+	Windows []TimeWindow
+	// Location is the time zone of the windows, defaults to the local time zone
+	Location *time.Location
+	// MaxSessionDuration ends sessions running longer
+	MaxSessionDuration time.Duration
+	// Approve is called for every tunnel allowed by the other rules, a returned error rejects the tunnel. It blocks
+	// the handling of further notifications, so it should return promptly.
+	Approve func(ctx context.Context, n Notification) error
+	// Now returns the current time, defaults to time.Now
+	Now func() time.Time
+}
+
+// Check returns a *PolicyError if the tunnel is not allowed
+func (p *Policy) Check(ctx context.Context, n Notification, services Services) error {
+	if len(p.AllowedServices) > 0 {
+		for _, service := range n.Services {
+			if !contains(p.AllowedServices, service) {
+				return &PolicyError{Reason: fmt.Sprintf("service %s is not allowed", service)}
+			}
+		}
+	}
+
+	if len(p.AllowedDestinations) > 0 {
+		for _, service := range n.Services {
+			address, _ := services.Address(service)
+			if !matchesAny(p.AllowedDestinations, address) {
+				return &PolicyError{Reason: fmt.Sprintf("destination %s of service %s is not allowed", address, service)}
+			}
+		}
+	}
+
+	if len(p.Windows) > 0 {
+		allowed, err := p.inWindow()
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &PolicyError{Reason: "outside of the allowed time windows"}
+		}
+	}
+
+	if p.Approve != nil {
+		if err := p.Approve(ctx, n); err != nil {
+			return &PolicyError{Reason: fmt.Sprintf("not approved: %v", err)}
+		}
+	}
+	return nil
+}
+
+func (p *Policy) inWindow() (bool, error) {
+	now := time.Now
+	if p.Now != nil {
+		now = p.Now
+	}
+	location := p.Location
+	if location == nil {
+		location = time.Local
+	}
+
+	t := now().In(location)
+	for _, w := range p.Windows {
+		in, err := w.contains(t)
+		if err != nil {
+			return false, err
+		}
+		if in {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFile is the JSON format of a policy file
+type policyFile struct {
+	AllowedServices     []string `json:"allowedServices"`
+	AllowedDestinations []string `json:"allowedDestinations"`
+	Windows             []struct {
+		Days  []string `json:"days"`
+		Start string   `json:"start"`
+		End   string   `json:"end"`
+	} `json:"windows"`
+	TimeZone           string `json:"timeZone"`
+	MaxSessionDuration string `json:"maxSessionDuration"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParsePolicy parses a policy in JSON, e.g.
+//
+//	{
+//	  "allowedServices": ["SSH", "HTTP"],
+//	  "allowedDestinations": ["localhost:*"],
+//	  "windows": [{"days": ["Mon", "Tue", "Wed", "Thu", "Fri"], "start": "08:00", "end": "18:00"}],
+//	  "timeZone": "Europe/Berlin",
+//	  "maxSessionDuration": "2h"
+//	}
+func ParsePolicy(data []byte) (*Policy, error) {
+	file := policyFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tunnel policy: %w", err)
+	}
+
+	p := &Policy{
+		AllowedServices:     file.AllowedServices,
+		AllowedDestinations: file.AllowedDestinations,
+	}
+	for _, pattern := range file.AllowedDestinations {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid destination pattern %q: %w", pattern, err)
+		}
+	}
+	for _, fw := range file.Windows {
+		w := TimeWindow{Start: fw.Start, End: fw.End}
+		for _, day := range fw.Days {
+			d, ok := time.Weekday(0), false
+			if len(day) >= 3 {
+				d, ok = weekdays[strings.ToLower(day[:3])]
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday %q", day)
+			}
+			w.Days = append(w.Days, d)
+		}
+		if _, err := minuteOfDay(w.Start); err != nil {
+			return nil, err
+		}
+		if _, err := minuteOfDay(w.End); err != nil {
+			return nil, err
+		}
+		p.Windows = append(p.Windows, w)
+	}
+	if file.TimeZone != "" {
+		location, err := time.LoadLocation(file.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %w", err)
+		}
+		p.Location = location
+	}
+	if file.MaxSessionDuration != "" {
+		d, err := time.ParseDuration(file.MaxSessionDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maximum session duration: %w", err)
+		}
+		p.MaxSessionDuration = d
+	}
+	return p, nil
+}
+
+// LoadPolicy reads a policy file in the ParsePolicy format
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tunnel policy: %w", err)
+	}
+	return ParsePolicy(data)
+}
+
+// NewPolicy returns the policy of the policy file and the approval command, nil if neither is given
+func NewPolicy(path, command string) (*Policy, error) {
+	if path == "" && command == "" {
+		return nil, nil
+	}
+	policy := &Policy{}
+	if path != "" {
+		p, err := LoadPolicy(path)
+		if err != nil {
+			return nil, err
+		}
+		policy = p
+	}
+	if command != "" {
+		policy.Approve = CommandApprover(command)
+	}
+	return policy, nil
+}
+
+// CommandApprover returns an approval hook running the shell command, which approves the tunnel by exiting with 0.
+// The command gets the services and region of the tunnel in TUNNEL_SERVICES and TUNNEL_REGION.
+func CommandApprover(command string) func(ctx context.Context, n Notification) error {
+	return func(ctx context.Context, n Notification) error {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"TUNNEL_SERVICES="+strings.Join(n.Services, ","),
+			"TUNNEL_REGION="+n.Region,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := tunnel.ParsePolicy([]byte(`{
+		"allowedServices": ["SSH"],
+		"allowedDestinations": ["localhost:*"],
+		"windows": [{"days": ["Mon", "friday"], "start": "22:00", "end": "06:00"}],
+		"timeZone": "UTC",
+		"maxSessionDuration": "2h"
+	}`))
+	assert.NoError(t, err, "policy parsed without error")
+	assert.Equal(t, []string{"SSH"}, policy.AllowedServices)
+	assert.Equal(t, []time.Weekday{time.Monday, time.Friday}, policy.Windows[0].Days)
+	assert.Equal(t, time.UTC, policy.Location)
+	assert.Equal(t, 2*time.Hour, policy.MaxSessionDuration)
+
+	for _, data := range []string{
+		`{"windows": [{"days": ["Mo"], "start": "08:00", "end": "18:00"}]}`,
+		`{"windows": [{"start": "8am", "end": "18:00"}]}`,
+		`{"allowedDestinations": ["["]}`,
+		`{"maxSessionDuration": "2"}`,
+		`{"timeZone": "Nowhere/Special"}`,
+	} {
+		_, err := tunnel.ParsePolicy([]byte(data))
+		assert.Error(t, err, "invalid policy rejected: %s", data)
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	services := tunnel.Services{"SSH": "localhost:22", "DB": "10.0.0.5:5432"}
+	// a Saturday
+	now := time.Date(2021, 1, 2, 2, 30, 0, 0, time.UTC)
+	policy := &tunnel.Policy{
+		AllowedServices:     []string{"SSH", "DB"},
+		AllowedDestinations: []string{"localhost:*"},
+		Windows:             []tunnel.TimeWindow{{Days: []time.Weekday{time.Friday}, Start: "22:00", End: "06:00"}},
+		Location:            time.UTC,
+		Now:                 func() time.Time { return now },
+	}
+	ctx := context.Background()
+	var policyErr *tunnel.PolicyError
+
+	assert.NoError(t, policy.Check(ctx, tunnel.Notification{Services: []string{"SSH"}}, services),
+		"window starting the day before spans midnight")
+
+	err := policy.Check(ctx, tunnel.Notification{Services: []string{"HTTP"}}, services)
+	assert.True(t, errors.As(err, &policyErr), "service not allowed")
+
+	err = policy.Check(ctx, tunnel.Notification{Services: []string{"DB"}}, services)
+	assert.True(t, errors.As(err, &policyErr), "destination not allowed")
+
+	now = time.Date(2021, 1, 2, 12, 0, 0, 0, time.UTC)
+	err = policy.Check(ctx, tunnel.Notification{Services: []string{"SSH"}}, services)
+	assert.True(t, errors.As(err, &policyErr), "outside of the time windows")
+
+	policy = &tunnel.Policy{Approve: tunnel.CommandApprover(`test "$TUNNEL_SERVICES" = SSH`)}
+	assert.NoError(t, policy.Check(ctx, tunnel.Notification{Services: []string{"SSH"}}, services), "approved by command")
+	err = policy.Check(ctx, tunnel.Notification{Services: []string{"SSH", "DB"}}, services)
+	assert.True(t, errors.As(err, &policyErr), "not approved by command")
+}
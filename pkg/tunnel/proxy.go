@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DestinationError is passed to the error handler for failures of a single stream, which do not end the tunnel
+type DestinationError struct {
+	ServiceID string
+	StreamID  int32
+	Err       error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("service %q stream %d: %v", e.ServiceID, e.StreamID, e.Err)
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// TransferStats counts the payload bytes relayed by a tunnel session
+type TransferStats struct {
+	received int64
+	sent     int64
+}
+
+// Received returns the bytes received from the tunnel and written to local connections
+func (s *TransferStats) Received() int64 {
+	return atomic.LoadInt64(&s.received)
+}
+
+// Sent returns the bytes read from local connections and sent through the tunnel
+func (s *TransferStats) Sent() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+func (s *TransferStats) addReceived(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.received, int64(n))
+	}
+}
+
+func (s *TransferStats) addSent(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.sent, int64(n))
+	}
+}
+
+// stream is the local connection of the current stream of a service
+type stream struct {
+	id   int32
+	conn net.Conn
+}
+
+// multiplexer relays the streams of the services multiplexed over one tunnel connection. The V2 protocol allows one
+// stream per service at a time.
+type multiplexer struct {
+	tunnel  io.ReadWriteCloser
+	onError func(error)
+	stats   *TransferStats
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+func newMultiplexer(tunnel io.ReadWriteCloser, onError func(error), stats *TransferStats) *multiplexer {
+	return &multiplexer{
+		tunnel:  tunnel,
+		onError: onError,
+		stats:   stats,
+		streams: map[string]*stream{},
+	}
+}
+
+// closeOnDone closes the tunnel connection when the context is done, which ends a blocked read. The returned function
+// stops watching the context.
+func (m *multiplexer) closeOnDone(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.tunnel.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// add makes the stream the current stream of the service, closing and returning the previous one
+func (m *multiplexer) add(serviceID string, s *stream) *stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.streams[serviceID]
+	if previous != nil {
+		previous.conn.Close()
+	}
+	m.streams[serviceID] = s
+	return previous
+}
+
+// forward sends the data of the local connection to the tunnel until the connection is closed
+func (m *multiplexer) forward(serviceID string, s *stream) {
+	b := make([]byte, 8192)
+	for {
+		n, err := s.conn.Read(b)
+		if n > 0 {
+			if err := m.send(&Message{Type: MessageData, StreamID: s.id, ServiceID: serviceID, Payload: b[:n]}); err != nil {
+				m.handleStreamError(serviceID, s.id, err)
+				m.remove(serviceID, s)
+				return
+			}
+			m.stats.addSent(n)
+		}
+		if err != nil {
+			// the stream is only reset if it was closed locally, not by the tunnel or a new stream
+			if m.remove(serviceID, s) {
+				m.reset(serviceID, s.id)
+			}
+			return
+		}
+	}
+}
+
+// write writes data of the tunnel to the local connection of the stream
+func (m *multiplexer) write(serviceID string, streamID int32, payload []byte) {
+	m.mu.Lock()
+	s, ok := m.streams[serviceID]
+	m.mu.Unlock()
+	if !ok || s.id != streamID {
+		return
+	}
+
+	n, err := s.conn.Write(payload)
+	m.stats.addReceived(n)
+	if err != nil {
+		m.handleStreamError(serviceID, streamID, fmt.Errorf("failed to write to local connection: %w", err))
+		if m.remove(serviceID, s) {
+			m.reset(serviceID, streamID)
+		}
+	}
+}
+
+// close closes the local connection of the stream reset by the tunnel
+func (m *multiplexer) close(serviceID string, streamID int32) {
+	m.mu.Lock()
+	s, ok := m.streams[serviceID]
+	m.mu.Unlock()
+	if ok && s.id == streamID {
+		m.remove(serviceID, s)
+	}
+}
+
+// remove closes the stream and reports whether it still was the current stream of the service
+func (m *multiplexer) remove(serviceID string, s *stream) bool {
+	s.conn.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.streams[serviceID] != s {
+		return false
+	}
+	delete(m.streams, serviceID)
+	return true
+}
+
+func (m *multiplexer) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for serviceID, s := range m.streams {
+		s.conn.Close()
+		delete(m.streams, serviceID)
+	}
+}
+
+// reset tells the other side of the tunnel that the stream has ended
+func (m *multiplexer) reset(serviceID string, streamID int32) {
+	if err := m.send(&Message{Type: MessageStreamReset, StreamID: streamID, ServiceID: serviceID}); err != nil {
+		m.handleStreamError(serviceID, streamID, err)
+	}
+}
+
+func (m *multiplexer) send(msg *Message) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return WriteMessage(m.tunnel, msg)
+}
+
+func (m *multiplexer) handleStreamError(serviceID string, streamID int32, err error) {
+	m.handleError(&DestinationError{ServiceID: serviceID, StreamID: streamID, Err: err})
+}
+
+func (m *multiplexer) handleError(err error) {
+	if m.onError != nil {
+		m.onError(err)
+	}
+}
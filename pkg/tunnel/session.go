@@ -0,0 +1,260 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSessions is the number of concurrent tunnel sessions a SessionManager allows by default
+const DefaultMaxSessions = 4
+
+// ErrTooManySessions is returned when a new tunnel would exceed the maximum number of sessions
+var ErrTooManySessions = errors.New("maximum number of tunnel sessions reached")
+
+// SessionInfo describes an active tunnel session
+type SessionInfo struct {
+	ID        uint64    `json:"id"`
+	Services  []string  `json:"services"`
+	Region    string    `json:"region"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+type session struct {
+	info     SessionInfo
+	cancel   context.CancelFunc
+	done     chan struct{}
+	replaced bool
+}
+
+// SessionManager runs every tunnel session in its own goroutine. A tunnel notification for the same services as an
+// active session replaces it, as AWS IoT sends a new notification when the access tokens of a tunnel are rotated.
+type SessionManager struct {
+	// Services maps the services of the tunnels to local addresses
+	Services Services
+	// MaxSessions is the maximum number of concurrent sessions, defaults to DefaultMaxSessions
+	MaxSessions int
+	// Proxy runs a session until it ends, defaults to StartLocalProxy
+	Proxy func(ctx context.Context, params ProxyParams) error
+	// OnSessionStart and OnSessionEnd are called when a session starts and ends. The error is nil if the session ended
+	// normally, was replaced or was shut down.
+	OnSessionStart func(info SessionInfo)
+	OnSessionEnd   func(info SessionInfo, err error)
+	// Policy rejects tunnels it does not allow and limits the session duration if it is not nil
+	Policy *Policy
+	// Audit records every session once it has ended or was rejected if it is not nil
+	Audit AuditSink
+	// AuditTopic is the MQTT topic ListenForTunnelWithManager also publishes the audit records on if it is not empty
+	AuditTopic string
+
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[string]*session
+	closing  bool
+	wg       sync.WaitGroup
+}
+
+// NewSessionManager returns a SessionManager forwarding the services to their local addresses
+func NewSessionManager(services Services, maxSessions int) *SessionManager {
+	return &SessionManager{
+		Services:    services,
+		MaxSessions: maxSessions,
+	}
+}
+
+// sessionKey identifies the sessions of the same services regardless of their order
+func sessionKey(services []string) string {
+	sorted := append([]string(nil), services...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Start starts a session for the tunnel notification, replacing the active session for the same services. The session
+// runs until it ends, it is replaced or the context is done. Start does not wait for a replaced session to end, the new
+// session connects once it has.
+func (m *SessionManager) Start(ctx context.Context, n Notification) (SessionInfo, error) {
+	return m.start(ctx, n, m.Audit)
+}
+
+// start is Start recording to the audit sink
+func (m *SessionManager) start(ctx context.Context, n Notification, audit AuditSink) (SessionInfo, error) {
+	info, err := m.startSession(ctx, n, audit)
+	if err != nil {
+		now := time.Now().UTC()
+		recordAudit(audit, AuditRecord{
+			Services:  n.Services,
+			Region:    n.Region,
+			StartedAt: now,
+			EndedAt:   now,
+			Outcome:   OutcomeRejected,
+			Error:     err.Error(),
+		})
+	}
+	return info, err
+}
+
+// startSession checks the tunnel against the services, the policy and the maximum number of sessions and starts the
+// session
+func (m *SessionManager) startSession(ctx context.Context, n Notification, audit AuditSink) (SessionInfo, error) {
+	if err := m.Services.Check(n.Services); err != nil {
+		return SessionInfo{}, err
+	}
+	if m.Policy != nil {
+		if err := m.Policy.Check(ctx, n, m.Services); err != nil {
+			return SessionInfo{}, err
+		}
+	}
+	key := sessionKey(n.Services)
+
+	m.mu.Lock()
+	if m.sessions == nil {
+		m.sessions = map[string]*session{}
+	}
+	previous := m.sessions[key]
+	maxSessions := m.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxSessions
+	}
+	if previous == nil && len(m.sessions) >= maxSessions {
+		m.mu.Unlock()
+		return SessionInfo{}, fmt.Errorf("%w (%d)", ErrTooManySessions, maxSessions)
+	}
+
+	m.nextID++
+	sessionCtx, cancel := context.WithCancel(ctx)
+	if m.Policy != nil && m.Policy.MaxSessionDuration > 0 {
+		var cancelTimeout context.CancelFunc
+		sessionCtx, cancelTimeout = context.WithTimeout(sessionCtx, m.Policy.MaxSessionDuration)
+		cancelSession := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelSession()
+		}
+	}
+	s := &session{
+		info: SessionInfo{
+			ID:        m.nextID,
+			Services:  append([]string(nil), n.Services...),
+			Region:    n.Region,
+			StartedAt: time.Now().UTC(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.sessions[key] = s
+	m.mu.Unlock()
+
+	if previous != nil {
+		m.mu.Lock()
+		previous.replaced = true
+		m.mu.Unlock()
+		previous.cancel()
+	}
+
+	proxy := m.Proxy
+	if proxy == nil {
+		proxy = StartLocalProxy
+	}
+	stats := &TransferStats{}
+	params := ProxyParams{
+		Region:      n.Region,
+		AccessToken: n.ClientAccessToken,
+		Services:    m.Services,
+		Stats:       stats,
+	}
+
+	if m.OnSessionStart != nil {
+		m.OnSessionStart(s.info)
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if previous != nil {
+			// the tunnel is connected once the replaced session has let go of its connection
+			<-previous.done
+		}
+		err := proxy(sessionCtx, params)
+
+		record := AuditRecord{
+			SessionID:     s.info.ID,
+			Services:      s.info.Services,
+			Region:        s.info.Region,
+			StartedAt:     s.info.StartedAt,
+			EndedAt:       time.Now().UTC(),
+			BytesReceived: stats.Received(),
+			BytesSent:     stats.Sent(),
+		}
+		m.mu.Lock()
+		switch {
+		case s.replaced:
+			record.Outcome = OutcomeReplaced
+		case ctx.Err() != nil || m.closing:
+			record.Outcome = OutcomeShutdown
+		case errors.Is(sessionCtx.Err(), context.DeadlineExceeded):
+			record.Outcome = OutcomeExpired
+		case err != nil:
+			record.Outcome = OutcomeFailed
+			record.Error = err.Error()
+		default:
+			record.Outcome = OutcomeClosed
+		}
+		if sessionCtx.Err() != nil {
+			// replaced, expired or shut down
+			err = nil
+		}
+		if m.sessions[key] == s {
+			delete(m.sessions, key)
+		}
+		m.mu.Unlock()
+		cancel()
+		recordAudit(audit, record)
+		close(s.done)
+
+		if m.OnSessionEnd != nil {
+			m.OnSessionEnd(s.info, err)
+		}
+	}()
+	return s.info, nil
+}
+
+// recordAudit records the session if there is an audit sink, logging failures as they must not affect the tunnels
+func recordAudit(audit AuditSink, record AuditRecord) {
+	if audit == nil {
+		return
+	}
+	if err := audit.Record(record); err != nil {
+		log.Printf("Failed to record tunnel session: %v\n", err)
+	}
+}
+
+// Sessions returns the active sessions, ordered by their start
+func (m *SessionManager) Sessions() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	infos := make([]SessionInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		infos = append(infos, s.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Close ends all sessions and waits for them
+func (m *SessionManager) Close() {
+	m.mu.Lock()
+	m.closing = true
+	for _, s := range m.sessions {
+		s.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	m.closing = false
+	m.mu.Unlock()
+}
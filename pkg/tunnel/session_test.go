@@ -0,0 +1,163 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy runs sessions until they are ended, recording the access tokens of the running sessions
+type fakeProxy struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func (p *fakeProxy) proxy(ctx context.Context, params tunnel.ProxyParams) error {
+	p.mu.Lock()
+	p.running[params.AccessToken] = true
+	p.mu.Unlock()
+
+	<-ctx.Done()
+
+	p.mu.Lock()
+	delete(p.running, params.AccessToken)
+	p.mu.Unlock()
+	return ctx.Err()
+}
+
+func (p *fakeProxy) isRunning(token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running[token]
+}
+
+func TestSessionManager(t *testing.T) {
+	fake := &fakeProxy{running: map[string]bool{}}
+	ended := make(chan error, 10)
+	manager := tunnel.NewSessionManager(tunnel.Services{"SSH": "localhost:22", "HTTP": "localhost:80"}, 2)
+	manager.Proxy = fake.proxy
+	manager.OnSessionEnd = func(info tunnel.SessionInfo, err error) { ended <- err }
+
+	ctx := context.Background()
+	first, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-1", Services: []string{"SSH"}})
+	assert.NoError(t, err, "session started without error")
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "both", Services: []string{"SSH", "HTTP"}})
+	assert.NoError(t, err, "sessions run concurrently")
+	assert.Eventually(t, func() bool { return fake.isRunning("ssh-1") && fake.isRunning("both") }, time.Second, 10*time.Millisecond)
+
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "http", Services: []string{"HTTP"}})
+	assert.True(t, errors.Is(err, tunnel.ErrTooManySessions), "maximum number of sessions enforced")
+
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "vnc", Services: []string{"VNC"}})
+	assert.Error(t, err, "tunnel with unmapped service rejected")
+
+	second, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-2", Services: []string{"SSH"}})
+	assert.NoError(t, err, "session for the same services replaced")
+	assert.NoError(t, <-ended, "replaced session ends without error")
+	assert.False(t, fake.isRunning("ssh-1"), "replaced session stopped")
+	assert.Eventually(t, func() bool { return fake.isRunning("ssh-2") }, time.Second, 10*time.Millisecond)
+
+	sessions := manager.Sessions()
+	assert.Len(t, sessions, 2, "active sessions exposed")
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.Equal(t, []string{"SSH"}, sessions[1].Services)
+
+	manager.Close()
+	assert.Empty(t, manager.Sessions(), "sessions ended on close")
+	assert.False(t, fake.isRunning("ssh-2") || fake.isRunning("both"))
+}
+
+// memoryAudit keeps the audit records
+type memoryAudit struct {
+	records chan tunnel.AuditRecord
+}
+
+func (a *memoryAudit) Record(record tunnel.AuditRecord) error {
+	a.records <- record
+	return nil
+}
+
+func TestSessionManager_Policy(t *testing.T) {
+	fake := &fakeProxy{running: map[string]bool{}}
+	audit := &memoryAudit{records: make(chan tunnel.AuditRecord, 10)}
+	manager := tunnel.NewSessionManager(tunnel.Services{"SSH": "localhost:22", "HTTP": "localhost:80"}, 2)
+	manager.Proxy = fake.proxy
+	manager.Audit = audit
+	manager.Policy = &tunnel.Policy{AllowedServices: []string{"SSH"}, MaxSessionDuration: 50 * time.Millisecond}
+
+	ctx := context.Background()
+	_, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "http", Services: []string{"HTTP"}})
+	var policyErr *tunnel.PolicyError
+	assert.True(t, errors.As(err, &policyErr), "tunnel rejected by policy")
+	record := <-audit.records
+	assert.Equal(t, tunnel.OutcomeRejected, record.Outcome, "rejection audited")
+	assert.Equal(t, []string{"HTTP"}, record.Services)
+
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "vnc", Services: []string{"VNC"}})
+	assert.Error(t, err, "tunnel with unmapped service rejected")
+	record = <-audit.records
+	assert.Equal(t, tunnel.OutcomeRejected, record.Outcome, "rejection for an unmapped service audited")
+	assert.Equal(t, []string{"VNC"}, record.Services)
+
+	info, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-1", Services: []string{"SSH"}})
+	assert.NoError(t, err, "allowed tunnel started")
+	record = <-audit.records
+	assert.Equal(t, tunnel.OutcomeExpired, record.Outcome, "session ended after the maximum duration")
+	assert.Equal(t, info.ID, record.SessionID)
+	assert.False(t, fake.isRunning("ssh-1"))
+
+	manager.Policy.MaxSessionDuration = 0
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-2", Services: []string{"SSH"}})
+	assert.NoError(t, err)
+	_, err = manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-3", Services: []string{"SSH"}})
+	assert.NoError(t, err)
+	assert.Equal(t, tunnel.OutcomeReplaced, (<-audit.records).Outcome, "replaced session audited")
+
+	manager.Close()
+	assert.Equal(t, tunnel.OutcomeShutdown, (<-audit.records).Outcome, "shut down session audited")
+}
+
+// blockingAudit holds every record until it is released
+type blockingAudit struct {
+	release chan struct{}
+}
+
+func (a *blockingAudit) Record(record tunnel.AuditRecord) error {
+	<-a.release
+	return nil
+}
+
+func TestSessionManager_ReplaceDoesNotBlock(t *testing.T) {
+	fake := &fakeProxy{running: map[string]bool{}}
+	audit := &blockingAudit{release: make(chan struct{})}
+	manager := tunnel.NewSessionManager(tunnel.Services{"SSH": "localhost:22"}, 1)
+	manager.Proxy = fake.proxy
+	manager.Audit = audit
+
+	ctx := context.Background()
+	_, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-1", Services: []string{"SSH"}})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return fake.isRunning("ssh-1") }, time.Second, 10*time.Millisecond)
+
+	started := make(chan struct{})
+	go func() {
+		_, err := manager.Start(ctx, tunnel.Notification{ClientAccessToken: "ssh-2", Services: []string{"SSH"}})
+		assert.NoError(t, err)
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Start waits for the replaced session to be audited")
+	}
+	assert.False(t, fake.isRunning("ssh-2"), "the new session waits for the replaced one to end")
+
+	close(audit.release)
+	assert.Eventually(t, func() bool { return fake.isRunning("ssh-2") }, time.Second, 10*time.Millisecond)
+	manager.Close()
+}
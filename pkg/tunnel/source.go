@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// source forwards the connections accepted by the local listeners of the services over one tunnel
+type source struct {
+	*multiplexer
+	listeners map[string]net.Listener
+
+	idMu      sync.Mutex
+	nextID    int32
+	available []string
+}
+
+// ProxySource forwards the connections accepted by the listeners to the tunnel connection as streams of their
+// services, until the session is reset, the connection is closed or the context is done. A listener for the empty
+// service ID is used for the only service of a tunnel with a single service, like the V1 protocol. A new connection of
+// a service replaces its previous stream, as the V2 protocol allows one stream per service at a time. Failures of
+// single streams are passed to onError, which may be nil. The tunnel connection and the listeners are closed on
+// return.
+func ProxySource(ctx context.Context, tunnel io.ReadWriteCloser, listeners map[string]net.Listener, onError func(error)) error {
+	return proxySource(ctx, tunnel, listeners, onError, nil)
+}
+
+// proxySource is ProxySource counting the relayed bytes in stats, which may be nil
+func proxySource(ctx context.Context, tunnel io.ReadWriteCloser, listeners map[string]net.Listener, onError func(error), stats *TransferStats) error {
+	s := &source{
+		multiplexer: newMultiplexer(tunnel, onError, stats),
+		listeners:   listeners,
+		nextID:      1,
+	}
+	stop := s.closeOnDone(ctx)
+	defer stop()
+	defer tunnel.Close()
+	defer s.closeAll()
+
+	var wg sync.WaitGroup
+	for serviceID, listener := range listeners {
+		wg.Add(1)
+		go func(serviceID string, listener net.Listener) {
+			defer wg.Done()
+			s.accept(serviceID, listener)
+		}(serviceID, listener)
+	}
+	defer wg.Wait()
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	err := s.run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *source) run() error {
+	for {
+		m, err := ReadMessage(s.tunnel)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch m.Type {
+		case MessageServiceIDs:
+			s.idMu.Lock()
+			s.available = m.AvailableServiceIDs
+			s.idMu.Unlock()
+
+		case MessageStreamReset:
+			s.close(m.ServiceID, m.StreamID)
+
+		case MessageSessionReset:
+			return nil
+
+		case MessageData:
+			s.write(m.ServiceID, m.StreamID, m.Payload)
+
+		default:
+			if !m.Ignorable {
+				s.handleError(fmt.Errorf("unsupported tunnel message type %d", m.Type))
+			}
+		}
+	}
+}
+
+// accept starts a stream for every connection of the listener until it is closed
+func (s *source) accept(serviceID string, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.handleError(fmt.Errorf("failed to accept connection for service %q: %w", serviceID, err))
+			}
+			return
+		}
+
+		id, streamID := s.newStreamID(serviceID)
+		st := &stream{id: streamID, conn: conn}
+		if previous := s.add(id, st); previous != nil {
+			s.reset(id, previous.id)
+		}
+		if err := s.send(&Message{Type: MessageStreamStart, StreamID: streamID, ServiceID: id}); err != nil {
+			s.handleStreamError(id, streamID, err)
+			s.remove(id, st)
+			continue
+		}
+		go s.forward(id, st)
+	}
+}
+
+// newStreamID returns the service ID to send for the listener and a new stream ID
+func (s *source) newStreamID(serviceID string) (string, int32) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if serviceID == "" && len(s.available) == 1 {
+		serviceID = s.available[0]
+	}
+	id := s.nextID
+	s.nextID++
+	return serviceID, id
+}
@@ -0,0 +1,69 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/tunnel"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeTunnel connects a source and a destination directly, like the secure tunneling service between them
+func pipeTunnel(t *testing.T, ctx context.Context, sources map[string]net.Listener, services tunnel.Services) (<-chan error, <-chan error) {
+	sourceEnd, destinationEnd := net.Pipe()
+	sourceDone := make(chan error, 1)
+	destinationDone := make(chan error, 1)
+	go func() {
+		sourceDone <- tunnel.ProxySource(ctx, sourceEnd, sources, func(err error) { t.Log(err) })
+	}()
+	go func() {
+		destinationDone <- tunnel.ProxyDestination(ctx, destinationEnd, services, func(err error) { t.Log(err) })
+	}()
+	return sourceDone, destinationDone
+}
+
+func TestProxySource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sources := map[string]net.Listener{}
+	for _, id := range []string{"SSH", "HTTP"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		sources[id] = listener
+	}
+	services := tunnel.Services{"SSH": echoServer(t, "ssh"), "HTTP": echoServer(t, "http")}
+	sourceDone, destinationDone := pipeTunnel(t, ctx, sources, services)
+
+	for id, name := range map[string]string{"SSH": "ssh", "HTTP": "http"} {
+		conn, err := net.Dial("tcp", sources[id].Addr().String())
+		assert.NoError(t, err, "connected to the source listener")
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		response, err := io.ReadAll(conn)
+		assert.NoError(t, err, "connection closed after the destination closed the stream")
+		assert.Equal(t, name+":hello", string(response), "connection forwarded to the destination of the service")
+		conn.Close()
+	}
+
+	cancel()
+	for _, done := range []<-chan error{sourceDone, destinationDone} {
+		select {
+		case err := <-done:
+			assert.True(t, errors.Is(err, context.Canceled), "proxy ends with the context")
+		case <-time.After(5 * time.Second):
+			t.Fatal("proxy did not end with the context")
+		}
+	}
+
+	for id, listener := range sources {
+		_, err := net.Dial("tcp", listener.Addr().String())
+		assert.Error(t, err, "listener of %s closed on shutdown", id)
+	}
+}
@@ -1,81 +1,135 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/models"
 	"github.com/patrickjmcd/aws-iot-device-sdk-go/pkg/mqtt"
 )
 
-type tunnelPayload struct {
+// Notification is the message AWS IoT publishes on the tunnel notify topic of a thing when a tunnel is opened or its
+// access tokens are rotated
+type Notification struct {
 	ClientAccessToken string   `json:"clientAccessToken"`
 	ClientMode        string   `json:"clientMode"`
 	Region            string   `json:"region"`
 	Services          []string `json:"services"`
 }
 
-// ListenForTunnel listens on the MQTT Tunnel Topic and sets up the tunnel once a notify message is received
-func ListenForTunnel(thingName string, keypair models.KeyPair, endpoint string) error {
+// notifyBuffer is the number of tunnel notifications queued while a session is being started
+const notifyBuffer = 16
 
-	notifyChan := make(chan []byte)
+// parseNotification parses and checks a tunnel notify message
+func parseNotification(data []byte) (Notification, error) {
+	payload := Notification{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return payload, fmt.Errorf("failed to unmarshal tunnel notify message: %w", err)
+	}
+	if payload.ClientMode != "destination" {
+		return payload, fmt.Errorf("tunnel client mode %s is not \"destination\"", payload.ClientMode)
+	}
+	if payload.ClientAccessToken == "" {
+		return payload, errors.New("tunnel access token is empty")
+	}
+	if len(payload.Services) == 0 {
+		return payload, errors.New("tunnel services are empty")
+	}
+	return payload, nil
+}
+
+// ListenForTunnel listens on the MQTT Tunnel Topic and sets up the tunnel once a notify message is received. The
+// services of the tunnel are forwarded to their local addresses, every requested service needs one. Up to
+// DefaultMaxSessions tunnels run concurrently.
+func ListenForTunnel(ctx context.Context, thingName string, keypair models.KeyPair, endpoint string, services Services) error {
+	return ListenForTunnelWithManager(ctx, thingName, keypair, endpoint, NewSessionManager(services, DefaultMaxSessions))
+}
+
+// ListenForTunnelWithManager listens on the MQTT Tunnel Topic and starts a session of the manager for every notify
+// message. Invalid notifications, rejected tunnels and failed sessions are logged and the listener waits for the next
+// notification, until the context is done. The audit records are also published on the AuditTopic of the manager if
+// it is set. The sessions are ended on return.
+func ListenForTunnelWithManager(ctx context.Context, thingName string, keypair models.KeyPair, endpoint string, manager *SessionManager) error {
+	if manager.OnSessionStart == nil {
+		manager.OnSessionStart = func(info SessionInfo) {
+			log.Printf("TUNNEL REQUESTED: session %d, %s\n", info.ID, strings.Join(info.Services, ", "))
+		}
+	}
+	if manager.OnSessionEnd == nil {
+		manager.OnSessionEnd = func(info SessionInfo, err error) {
+			if err != nil {
+				log.Printf("TUNNEL FAILED: session %d: %v\n", info.ID, err)
+				return
+			}
+			log.Printf("TUNNEL CLOSED: session %d\n", info.ID)
+		}
+	}
+	notifyChan := make(chan []byte, notifyBuffer)
 
 	client, err := mqtt.MakeMQTTClient(keypair, endpoint, fmt.Sprintf("tunnel-%s", thingName))
 	if err != nil {
 		return err
 	}
+	defer client.Disconnect(250)
 	log.Println("Connected to MQTT")
+	// end the sessions while the client can still publish their records
+	defer manager.Close()
+
+	audit := manager.Audit
+	if manager.AuditTopic != "" {
+		mqttAudit := &MQTTAuditLog{Client: client, Topic: manager.AuditTopic}
+		if audit != nil {
+			audit = AuditSinks{audit, mqttAudit}
+		} else {
+			audit = mqttAudit
+		}
+	}
 
 	// Subscribe to Tunnel Notify topic
+	topic := fmt.Sprintf("$aws/things/%s/tunnels/notify", thingName)
 	if token := client.Subscribe(
-		fmt.Sprintf("$aws/things/%s/tunnels/notify", thingName),
+		topic,
 		0,
 		func(client paho.Client, msg paho.Message) {
-			notifyChan <- msg.Payload()
+			// never block the MQTT client, drop the oldest notification instead
+			for {
+				select {
+				case notifyChan <- msg.Payload():
+					return
+				default:
+				}
+				select {
+				case <-notifyChan:
+					log.Println("Dropping tunnel notification, too many are pending")
+				default:
+				}
+			}
 		},
 	); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	defer client.Unsubscribe(topic).Wait()
 	log.Println("Subscribed to Tunnel Notify topic")
 
 	for {
 		select {
-		case notifyMsg, ok := <-notifyChan:
-			if !ok {
-				return fmt.Errorf("failed to read from tunnel notify channel")
-			}
-			payload := tunnelPayload{}
-			if err := json.Unmarshal(notifyMsg, &payload); err != nil {
-				return fmt.Errorf("failed to unmarshal tunnel notify message: %w", err)
-			}
-
-			if payload.ClientMode != "destination" {
-				return fmt.Errorf("tunnel client mode %s is not \"destination\"", payload.ClientMode)
-			}
+		case <-ctx.Done():
+			return ctx.Err()
 
-			if len(payload.Services) == 0 {
-				return fmt.Errorf("tunnel services are empty")
-			}
-			if len(payload.Services) > 1 {
-				return fmt.Errorf("tunnel services are not a single service")
-			}
-			if payload.Services[0] != "SSH" {
-				return fmt.Errorf("tunnel service %s is not \"SSH\"", payload.Services[0])
-			}
-
-			log.Println("TUNNEL REQUESTED")
-
-			localProxyParams := ProxyParams{
-				Region:      payload.Region,
-				AccessToken: payload.ClientAccessToken,
-			}
-			err = StartLocalProxy(localProxyParams)
+		case notifyMsg := <-notifyChan:
+			notification, err := parseNotification(notifyMsg)
 			if err != nil {
-				return err
+				log.Printf("Ignoring tunnel notification: %v\n", err)
+				continue
+			}
+			if _, err := manager.start(ctx, notification, audit); err != nil {
+				log.Printf("Rejecting tunnel: %v\n", err)
 			}
-			log.Println("TUNNEL CLOSED")
 		}
 	}
 }